@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// adminUsersData is passed to admin_users.html.
+type adminUsersData struct {
+	Users []*User
+	Roles []Role
+	Self  string // ID of the signed-in admin, whose role cannot be changed
+}
+
+// adminUsersHandler lists all users with their roles.
+func (n *Novelshelf) adminUsersHandler(w http.ResponseWriter, r *http.Request) *appError {
+	users, err := n.Users.ListUsers(r.Context())
+	if err != nil {
+		return n.appErrorf(r, err, "could not list users: %v", err)
+	}
+	return adminUsersTmpl.Execute(n, w, r, adminUsersData{
+		Users: users,
+		Roles: roles,
+		Self:  userFromContext(r.Context()).ID,
+	})
+}
+
+// adminSetRoleHandler changes the role of a user. Admins cannot change
+// their own role, so that the last admin cannot lock everyone out.
+func (n *Novelshelf) adminSetRoleHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	role, err := parseRole(r.FormValue("role"))
+	if err != nil {
+		return n.badRequestf(r, err, "%v", err)
+	}
+	if id == userFromContext(ctx).ID {
+		return n.badRequestf(r, errors.New("cannot change own role"), "you cannot change your own role")
+	}
+	u, err := n.Users.GetUser(ctx, id)
+	if errors.Is(err, ErrUserNotFound) {
+		return n.appErrorf(r, ErrNotFound, "%v", err)
+	}
+	if err != nil {
+		return n.appErrorf(r, err, "could not find user: %v", err)
+	}
+	u.Role = role
+	if err := n.Users.UpdateUser(ctx, u); err != nil {
+		return n.appErrorf(r, err, "could not save user: %v", err)
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAPIBodySize caps the size of JSON request bodies accepted by the API.
+const maxAPIBodySize = 1 << 20
+
+// errBodyTooLarge is returned when reading a request body larger than
+// maxAPIBodySize.
+var errBodyTooLarge = fmt.Errorf("request body is larger than %d bytes", maxAPIBodySize)
+
+// apiBody returns the request body, cut off after maxAPIBodySize bytes
+// with errBodyTooLarge.
+func apiBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	return &limitedBody{r: http.MaxBytesReader(w, r.Body, maxAPIBodySize)}
+}
+
+// limitedBody tells the error http.MaxBytesReader returns at the limit
+// from other read errors.
+type limitedBody struct {
+	r io.Reader
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF && b.n >= maxAPIBodySize {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// bodyErrorf reports a request body that could not be parsed: with 413 if
+// it was too large and 400 otherwise.
+func (n *Novelshelf) bodyErrorf(r *http.Request, err error, format string, v ...interface{}) *appError {
+	e := n.badRequestf(r, err, format, v...)
+	if errors.Is(err, errBodyTooLarge) {
+		e.Code = http.StatusRequestEntityTooLarge
+	}
+	return e
+}
+
+func (n *Novelshelf) registerAPIHandlers(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+
+	api.Methods("GET").Path("/novels").
+		Handler(apiHandler(n.apiListHandler))
+	api.Methods("GET").Path("/novels/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(apiHandler(n.apiGetHandler))
+	api.Methods("POST").Path("/novels").
+		Handler(n.requireRole(RoleEditor, apiHandler(n.apiCreateHandler)))
+	api.Methods("POST").Path("/novels:import").
+		Handler(n.requireRole(RoleEditor, apiHandler(n.apiImportHandler)))
+	api.Methods("PUT").Path("/novels/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(n.requireRole(RoleEditor, apiHandler(n.apiUpdateHandler)))
+	api.Methods("PATCH").Path("/novels/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(n.requireRole(RoleEditor, apiHandler(n.apiPatchHandler)))
+	api.Methods("DELETE").Path("/novels/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(n.requireRole(RoleEditor, apiHandler(n.apiDeleteHandler)))
+	api.Methods("GET").Path("/isbn/{isbn}").
+		Handler(apiHandler(n.apiISBNHandler))
+}
+
+func (n *Novelshelf) apiListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if q := r.FormValue("q"); q != "" {
+		novels, err := n.searchNovels(r.Context(), q)
+		if err != nil {
+			return n.appErrorf(r, err, "could not search novels: %v", err)
+		}
+		return n.writeJSON(w, r, http.StatusOK, &NovelPage{Novels: novels})
+	}
+	opts, err := listOptionsFromRequest(r)
+	if err != nil {
+		return n.badRequestf(r, err, "%v", err)
+	}
+	page, err := n.DB.ListNovelsPage(r.Context(), opts)
+	if err != nil {
+		return n.appErrorf(r, err, "could not list novels: %v", err)
+	}
+	if page.Novels == nil {
+		page.Novels = []*Novel{}
+	}
+	return n.writeJSON(w, r, http.StatusOK, page)
+}
+
+func (n *Novelshelf) apiGetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	novel, err := n.DB.GetNovel(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	w.Header().Set("ETag", novelETag(novel))
+	return n.writeJSON(w, r, http.StatusOK, novel)
+}
+
+func (n *Novelshelf) apiCreateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	novel, err := novelFromJSON(w, r)
+	if err != nil {
+		return n.bodyErrorf(r, err, "could not parse novel: %v", err)
+	}
+	if errs := validateNovel(novel); errs != nil {
+		return n.appErrorf(r, errs, "%v", errs)
+	}
+	novel.ID = ""
+	novel.CreatedAt = time.Time{}
+	novel.Version = 0
+	novel.DeletedAt = nil
+	setOwner(r, novel)
+	id, err := n.DB.AddNovel(r.Context(), novel)
+	if err != nil {
+		return n.appErrorf(r, err, "could not save novel: %v", err)
+	}
+	novel.ID = id
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/novels/%s", id))
+	w.Header().Set("ETag", novelETag(novel))
+	return n.writeJSON(w, r, http.StatusCreated, novel)
+}
+
+func (n *Novelshelf) apiUpdateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	old, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	if err := authorize(r, old); err != nil {
+		return n.appErrorf(r, err, "you may only change novels on your own shelf")
+	}
+	novel, err := novelFromJSON(w, r)
+	if err != nil {
+		return n.bodyErrorf(r, err, "could not parse novel: %v", err)
+	}
+	if errs := validateNovel(novel); errs != nil {
+		return n.appErrorf(r, errs, "%v", errs)
+	}
+	if novel.ID != "" && novel.ID != id {
+		return n.badRequestf(r, errors.New("ID mismatch"), "novel ID %q does not match path ID %q", novel.ID, id)
+	}
+	novel.ID = id
+	novel.CreatedAt = old.CreatedAt
+	novel.CreatedBy = old.CreatedBy
+	novel.DeletedAt = nil
+	version, e := n.expectedVersion(r, novel.Version)
+	if e != nil {
+		return e
+	}
+	if version == 0 {
+		version = old.Version
+	}
+	novel.Version = version
+	if err := n.DB.UpdateNovel(ctx, novel); err != nil {
+		return n.updateError(r, err, version)
+	}
+	n.releaseCovers(ctx, old, novel)
+	w.Header().Set("ETag", novelETag(novel))
+	return n.writeJSON(w, r, http.StatusOK, novel)
+}
+
+// apiPatchHandler changes only the fields present in the request body.
+func (n *Novelshelf) apiPatchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	old, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	if err := authorize(r, old); err != nil {
+		return n.appErrorf(r, err, "you may only change novels on your own shelf")
+	}
+	p, err := patchFromJSON(w, r)
+	if err != nil {
+		return n.bodyErrorf(r, err, "could not parse patch: %v", err)
+	}
+	version, e := n.expectedVersion(r, p.Version)
+	if e != nil {
+		return e
+	}
+	// The patched novel is validated as a whole, and the patch then takes
+	// its fields from it as validateNovel normalized them.
+	novel := *old
+	p.apply(&novel)
+	if errs := validateNovel(&novel); errs != nil {
+		return n.appErrorf(r, errs, "%v", errs)
+	}
+	saved, err := n.DB.PatchNovel(ctx, id, newNovelPatch(&novel, version, p.names()...))
+	if err != nil {
+		return n.updateError(r, err, version)
+	}
+	n.releaseCovers(ctx, old, saved)
+	w.Header().Set("ETag", novelETag(saved))
+	return n.writeJSON(w, r, http.StatusOK, saved)
+}
+
+// expectedVersion returns the version of the novel an update applies to:
+// the one named by the If-Match header, or else bodyVersion. It returns 0
+// if the update is unconditional.
+func (n *Novelshelf) expectedVersion(r *http.Request, bodyVersion int) (int, *appError) {
+	switch ifMatch := r.Header.Get("If-Match"); ifMatch {
+	case "":
+		return bodyVersion, nil
+	case "*":
+		return 0, nil
+	default:
+		v, err := parseNovelETag(ifMatch)
+		if err != nil {
+			e := n.appErrorf(r, err, "If-Match %s does not match the current version of the novel", ifMatch)
+			e.Code = http.StatusPreconditionFailed
+			return 0, e
+		}
+		return v, nil
+	}
+}
+
+// updateError explains why saving a novel expected at version failed. A
+// conflict is reported as 412 Precondition Failed if the version was named
+// by If-Match.
+func (n *Novelshelf) updateError(r *http.Request, err error, version int) *appError {
+	if !errors.Is(err, ErrConflict) {
+		return n.appErrorf(r, err, "could not save novel: %v", err)
+	}
+	e := n.appErrorf(r, err, "the novel has changed since version %d; get it again and reapply your changes", version)
+	if r.Header.Get("If-Match") != "" {
+		e.Code = http.StatusPreconditionFailed
+	}
+	return e
+}
+
+// novelETag returns the entity tag of the version of n, for use with
+// If-Match.
+func novelETag(n *Novel) string {
+	return fmt.Sprintf(`"%d"`, n.Version)
+}
+
+// parseNovelETag returns the version named by an entity tag from
+// novelETag.
+func parseNovelETag(tag string) (int, error) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("invalid entity tag %s: %w", tag, ErrConflict)
+	}
+	v, err := strconv.Atoi(tag[1 : len(tag)-1])
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid entity tag %s: %w", tag, ErrConflict)
+	}
+	return v, nil
+}
+
+func (n *Novelshelf) apiDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+	novel, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	if err := authorize(r, novel); err != nil {
+		return n.appErrorf(r, err, "you may only delete novels on your own shelf")
+	}
+	if err := n.DB.DeleteNovel(ctx, id); err != nil {
+		return n.appErrorf(r, err, "could not delete novel: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// novelFromJSON decodes a single Novel from the request body, rejecting
+// unknown fields and bodies larger than maxAPIBodySize.
+func novelFromJSON(w http.ResponseWriter, r *http.Request) (*Novel, error) {
+	dec := json.NewDecoder(apiBody(w, r))
+	dec.DisallowUnknownFields()
+	novel := &Novel{}
+	if err := dec.Decode(novel); err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return nil, errors.New("request body must contain a single JSON object")
+	}
+	return novel, nil
+}
+
+// patchFromJSON decodes a JSON merge patch (RFC 7396) of a novel from the
+// request body: only the fields present are changed, and null resets a
+// field. A version member names the version to patch, as in a PUT.
+func patchFromJSON(w http.ResponseWriter, r *http.Request) (NovelPatch, error) {
+	dec := json.NewDecoder(apiBody(w, r))
+	var members map[string]json.RawMessage
+	if err := dec.Decode(&members); err != nil {
+		return NovelPatch{}, err
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return NovelPatch{}, errors.New("request body must contain a single JSON object")
+	}
+	p := NovelPatch{Fields: make(map[string]interface{})}
+	for name, raw := range members {
+		if name == "version" {
+			if err := json.Unmarshal(raw, &p.Version); err != nil {
+				return NovelPatch{}, fmt.Errorf("version: %v", err)
+			}
+			continue
+		}
+		f, ok := lookupNovelField(name)
+		if !ok {
+			return NovelPatch{}, fmt.Errorf("field %q cannot be changed", name)
+		}
+		v := reflect.New(f.typ())
+		if err := json.Unmarshal(raw, v.Interface()); err != nil {
+			return NovelPatch{}, fmt.Errorf("%s: %v", name, err)
+		}
+		p.Fields[name] = v.Elem().Interface()
+	}
+	return p, nil
+}
+
+func (n *Novelshelf) writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) *appError {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return n.appErrorf(r, err, "could not encode response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+	w.Write([]byte("\n"))
+	return nil
+}
+
+type apiErrorBody struct {
+	Error struct {
+		Code    int              `json:"code"`
+		Message string           `json:"message"`
+		Fields  ValidationErrors `json:"fields,omitempty"`
+	} `json:"error"`
+}
+
+// apiHandler is the JSON counterpart of appHandler: errors are written as a
+// JSON body instead of an empty response.
+type apiHandler func(http.ResponseWriter, *http.Request) *appError
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e := fn(w, r)
+	if e == nil {
+		return
+	}
+	fmt.Fprintf(e.Novel.logWriter, "API handler error: status code: %d, message: %s, underlying err: %v\n",
+		e.Code, e.Message, e.Error)
+
+	var fields ValidationErrors
+	errors.As(e.Error, &fields)
+	writeAPIError(w, e.Code, e.Message, fields)
+
+	e.Novel.reportError(r, e)
+}
+
+// writeAPIError writes an apiErrorBody with the given status code.
+func writeAPIError(w http.ResponseWriter, code int, message string, fields ValidationErrors) {
+	var body apiErrorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	body.Error.Fields = fields
+	b, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	sessionName = "novelshelf"
+	// sessionMaxAge is how long a sign-in lasts, in seconds.
+	sessionMaxAge = 30 * 24 * 60 * 60
+
+	sessionUserKey  = "user"
+	sessionStateKey = "state"
+	sessionNonceKey = "nonce"
+	sessionNextKey  = "next"
+
+	minPasswordLen = 8
+	// bcrypt ignores everything after the 72nd byte of a password.
+	maxPasswordLen = 72
+)
+
+// ErrForbidden is returned when the signed-in user may not do what they
+// asked to.
+var ErrForbidden = errors.New("forbidden")
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// newSessionStore returns the cookie store for sign-in sessions, with
+// signing and encryption keys derived from key. Without a key, random keys
+// are used and every restart signs all users out.
+func newSessionStore(key string, secure bool) *sessions.CookieStore {
+	var hashKey, blockKey []byte
+	if key == "" {
+		hashKey = securecookie.GenerateRandomKey(64)
+		blockKey = securecookie.GenerateRandomKey(32)
+	} else {
+		h := sha512.Sum512([]byte("novelshelf session signing:" + key))
+		b := sha256.Sum256([]byte("novelshelf session encryption:" + key))
+		hashKey, blockKey = h[:], b[:]
+	}
+	store := sessions.NewCookieStore(hashKey, blockKey)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return store
+}
+
+// hashPassword checks that password is acceptable and returns its bcrypt
+// hash.
+func hashPassword(password string) (string, error) {
+	if utf8.RuneCountInString(password) < minPasswordLen {
+		return "", ValidationErrors{"password": fmt.Sprintf("must be at least %d characters", minPasswordLen)}
+	}
+	if len(password) > maxPasswordLen {
+		return "", ValidationErrors{"password": fmt.Sprintf("must be at most %d bytes", maxPasswordLen)}
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("could not hash password: %v", err)
+	}
+	return string(h), nil
+}
+
+// checkPassword reports whether password matches u's password hash.
+func checkPassword(u *User, password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// dummyPasswordHash is compared against when signing in to an unknown
+// account, so that the response time does not reveal which emails exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("novelshelf"), bcrypt.DefaultCost)
+
+// authenticate returns the user with the given email and password.
+func (n *Novelshelf) authenticate(ctx context.Context, email, password string) (*User, error) {
+	u, err := n.Users.GetUserByEmail(ctx, email)
+	if errors.Is(err, ErrUserNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !checkPassword(u, password) {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// userFromContext returns the signed-in user, or nil.
+func userFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userContextKey).(*User)
+	return u
+}
+
+// currentUser returns the user signed in to the session of r, or nil.
+// API clients may instead send their email and password with HTTP basic
+// authentication.
+func (n *Novelshelf) currentUser(r *http.Request) (*User, error) {
+	if email, password, ok := r.BasicAuth(); ok && strings.HasPrefix(r.URL.Path, "/api/") {
+		return n.authenticate(r.Context(), email, password)
+	}
+	s, _ := n.sessions.Get(r, sessionName)
+	id, _ := s.Values[sessionUserKey].(string)
+	if id == "" {
+		return nil, nil
+	}
+	u, err := n.Users.GetUser(r.Context(), id)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	return u, err
+}
+
+// authorize returns ErrForbidden unless the user signed in to r may change
+// novel.
+func authorize(r *http.Request, novel *Novel) error {
+	if !userFromContext(r.Context()).CanEdit(novel) {
+		return fmt.Errorf("novel %q: %w", novel.ID, ErrForbidden)
+	}
+	return nil
+}
+
+// setOwner puts novel on the shelf of the user signed in to r.
+func setOwner(r *http.Request, novel *Novel) {
+	if u := userFromContext(r.Context()); u != nil {
+		novel.CreatedBy = u.ID
+	}
+}
+
+// authMiddleware puts the signed-in user into the request context. Routes
+// decide who may use them with requireRole.
+func (n *Novelshelf) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := n.currentUser(r)
+		if err != nil {
+			fmt.Fprintf(n.logWriter, "could not load signed-in user: %v\n", err)
+			http.Error(w, "could not load signed-in user", http.StatusInternalServerError)
+			return
+		}
+		if u != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, u))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole serves h only to users with at least role. Everyone else is
+// asked to sign in, or turned away with 403 if they are signed in already:
+// pages redirect to the login form and the API answers with a JSON error.
+func (n *Novelshelf) requireRole(role Role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := userFromContext(r.Context())
+		if u.HasRole(role) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		api := strings.HasPrefix(r.URL.Path, "/api/")
+		switch {
+		case u == nil && api:
+			w.Header().Set("WWW-Authenticate", `Basic realm="novelshelf"`)
+			writeAPIError(w, http.StatusUnauthorized, "sign in required", nil)
+		case u == nil:
+			back := r.URL.RequestURI()
+			if r.Method != "GET" {
+				back = r.Referer()
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(safeNext(back)), http.StatusSeeOther)
+		case api:
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("requires the %s role", role), nil)
+		default:
+			appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+				err := fmt.Errorf("%s role required: %w", role, ErrForbidden)
+				return n.appErrorf(r, err, "you need the %s role to do this", role)
+			}).ServeHTTP(w, r)
+		}
+	})
+}
+
+// safeNext returns next if it is a path on this site, so that the login
+// form cannot be used to redirect elsewhere, and "/novels" otherwise.
+func safeNext(next string) string {
+	if u, err := url.Parse(next); err == nil && u.Scheme == "" && u.Host == "" &&
+		strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	return "/novels"
+}
+
+// signIn starts a session for u.
+func (n *Novelshelf) signIn(w http.ResponseWriter, r *http.Request, u *User) error {
+	s, _ := n.sessions.Get(r, sessionName)
+	// Start from a fresh session so nothing from before signing in leaks
+	// into it.
+	for k := range s.Values {
+		delete(s.Values, k)
+	}
+	s.Values[sessionUserKey] = u.ID
+	return s.Save(r, w)
+}
+
+// loginData is passed to login.html.
+type loginData struct {
+	Email    string
+	Next     string
+	Error    string
+	Provider string // name of the identity provider, if any
+}
+
+func (n *Novelshelf) loginData(r *http.Request) loginData {
+	d := loginData{Email: r.FormValue("email"), Next: safeNext(r.FormValue("next"))}
+	if n.identity != nil {
+		d.Provider = n.identity.Name()
+	}
+	return d
+}
+
+func (n *Novelshelf) loginFormHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return loginTmpl.Execute(n, w, r, n.loginData(r))
+}
+
+func (n *Novelshelf) loginHandler(w http.ResponseWriter, r *http.Request) *appError {
+	d := n.loginData(r)
+	u, err := n.authenticate(r.Context(), r.FormValue("email"), r.FormValue("password"))
+	if err != nil {
+		return n.appErrorf(r, err, "could not sign in: %v", err)
+	}
+	if u == nil {
+		d.Error = "Incorrect email or password."
+		w.WriteHeader(http.StatusUnauthorized)
+		return loginTmpl.Execute(n, w, r, d)
+	}
+	if err := n.signIn(w, r, u); err != nil {
+		return n.appErrorf(r, err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, d.Next, http.StatusFound)
+	return nil
+}
+
+func (n *Novelshelf) logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, _ := n.sessions.Get(r, sessionName)
+	s.Options.MaxAge = -1
+	if err := s.Save(r, w); err != nil {
+		return n.appErrorf(r, err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, "/novels", http.StatusFound)
+	return nil
+}
+
+// randomToken returns a random URL-safe string for OAuth2 states and
+// nonces.
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(24))
+}
+
+// providerLoginHandler sends the user to the identity provider to sign in.
+func (n *Novelshelf) providerLoginHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if n.identity == nil {
+		return n.appErrorf(r, ErrNotFound, "no identity provider is configured")
+	}
+	state, nonce := randomToken(), randomToken()
+	s, _ := n.sessions.Get(r, sessionName)
+	s.Values[sessionStateKey] = state
+	s.Values[sessionNonceKey] = nonce
+	s.Values[sessionNextKey] = safeNext(r.FormValue("next"))
+	if err := s.Save(r, w); err != nil {
+		return n.appErrorf(r, err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, n.identity.AuthCodeURL(state, nonce), http.StatusFound)
+	return nil
+}
+
+// providerCallbackHandler completes signing in through the identity
+// provider. Users are matched by their identity at the provider; the first
+// sign-in creates an account, or links an existing password account with
+// the same, verified, email address.
+func (n *Novelshelf) providerCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if n.identity == nil {
+		return n.appErrorf(r, ErrNotFound, "no identity provider is configured")
+	}
+	ctx := r.Context()
+	s, _ := n.sessions.Get(r, sessionName)
+	state, _ := s.Values[sessionStateKey].(string)
+	nonce, _ := s.Values[sessionNonceKey].(string)
+	next, _ := s.Values[sessionNextKey].(string)
+	if state == "" || r.FormValue("state") != state {
+		return n.badRequestf(r, errors.New("state mismatch"), "sign-in was not started from this browser; please try again")
+	}
+	if e := r.FormValue("error"); e != "" {
+		return n.badRequestf(r, errors.New(e), "sign-in failed: %s", e)
+	}
+	id, err := n.identity.Exchange(ctx, r.FormValue("code"), nonce)
+	if err != nil {
+		return n.badRequestf(r, err, "sign-in failed: %v", err)
+	}
+
+	u, err := n.Users.GetUserByIdentity(ctx, id.Provider, id.Subject)
+	if errors.Is(err, ErrUserNotFound) {
+		u, err = n.userForIdentity(ctx, id)
+	}
+	if err != nil {
+		return n.appErrorf(r, err, "could not sign in: %v", err)
+	}
+	if err := n.signIn(w, r, u); err != nil {
+		return n.appErrorf(r, err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, safeNext(next), http.StatusFound)
+	return nil
+}
+
+// userForIdentity links id to the existing account with its email address,
+// if the provider verified the address, or creates a new account with the
+// default role.
+func (n *Novelshelf) userForIdentity(ctx context.Context, id *Identity) (*User, error) {
+	u, err := n.Users.GetUserByEmail(ctx, id.Email)
+	switch {
+	case err == nil && id.EmailVerified && u.Subject == "":
+		u.Provider, u.Subject = id.Provider, id.Subject
+		if err := n.Users.UpdateUser(ctx, u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	case err == nil:
+		return nil, fmt.Errorf("%q: %w", id.Email, ErrUserExists)
+	case !errors.Is(err, ErrUserNotFound):
+		return nil, err
+	}
+	u = &User{Email: id.Email, Name: id.Name, Provider: id.Provider, Subject: id.Subject, Role: n.defaultRole}
+	if _, err := n.Users.AddUser(ctx, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
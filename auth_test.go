@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	if _, err := hashPassword("short"); err == nil {
+		t.Error("hashPassword(short): want error")
+	}
+	if _, err := hashPassword(strings.Repeat("x", maxPasswordLen+1)); err == nil {
+		t.Error("hashPassword(too long): want error")
+	}
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{PasswordHash: hash}
+	if !checkPassword(u, testPassword) {
+		t.Error("checkPassword: want match")
+	}
+	if checkPassword(u, testPassword+"!") || checkPassword(&User{}, "") {
+		t.Error("checkPassword: want mismatch")
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for next, want := range map[string]string{
+		"/novels/add":          "/novels/add",
+		"/novels?page=2":       "/novels?page=2",
+		"":                     "/novels",
+		"https://evil.example": "/novels",
+		"//evil.example/":      "/novels",
+		"/\\evil.example":      "/novels",
+		"novels":               "/novels",
+	} {
+		if got := safeNext(next); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestSignInRequired(t *testing.T) {
+	anon := newTestClient()
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := anon.Get(serv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/novels"); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/novels" {
+		t.Errorf("GET /novels: got %d at %s, want the list", resp.StatusCode, resp.Request.URL)
+	}
+	if resp := get("/novels/add"); resp.Request.URL.Path != "/login" || resp.Request.URL.Query().Get("next") != "/novels/add" {
+		t.Errorf("GET /novels/add: got %s, want the login form", resp.Request.URL)
+	}
+
+	before, err := n.DB.ListNovels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := anon.PostForm(serv.URL+"/novels", url.Values{"title": {"anonymous"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/login" {
+		t.Errorf("POST /novels: got %s, want the login form", resp.Request.URL)
+	}
+	after, err := n.DB.ListNovels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("POST /novels without signing in added a novel")
+	}
+
+	body := `{"title": "api"}`
+	resp, err = anon.Post(serv.URL+"/api/v1/novels", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("API POST without credentials: got status %d, want %d with a challenge", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// With credentials the request gets as far as validation, which the
+	// empty novel fails without anything being added.
+	req, _ := http.NewRequest("POST", serv.URL+"/api/v1/novels", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(testEmail, testPassword)
+	resp, err = anon.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("API POST with basic auth: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	req, _ = http.NewRequest("DELETE", serv.URL+"/api/v1/novels/doesnotexist", nil)
+	req.SetBasicAuth(testEmail, "wrong password")
+	resp, err = anon.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("API DELETE with a wrong password: got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginAndLogout(t *testing.T) {
+	c := newTestClient()
+	resp, err := c.PostForm(serv.URL+"/login", url.Values{"email": {testEmail}, "password": {"wrong password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(b), "Incorrect email or password") {
+		t.Errorf("wrong password: got status %d, want %d and an error message", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp, err = c.PostForm(serv.URL+"/login", url.Values{
+		"email":    {strings.ToUpper(testEmail)},
+		"password": {testPassword},
+		"next":     {"/novels/add"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/novels/add" || !strings.Contains(string(b), "Test Reader") {
+		t.Fatalf("login: got %s, want the add form for Test Reader", resp.Request.URL)
+	}
+
+	resp, err = c.Post(serv.URL+"/logout", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = c.Get(serv.URL + "/novels/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/login" {
+		t.Errorf("after logout: got %s, want the login form", resp.Request.URL)
+	}
+}
+
+func TestLocalProvider(t *testing.T) {
+	signIn := func(email string) *http.Response {
+		t.Helper()
+		c := newTestClient()
+		resp, err := c.Get(serv.URL + "/auth/login?next=/novels/add")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Request.URL.Path != localProviderPath {
+			t.Fatalf("/auth/login: got %s, want the local sign-in form", resp.Request.URL)
+		}
+		q := resp.Request.URL.Query()
+		resp, err = c.PostForm(serv.URL+localProviderPath, url.Values{
+			"email": {email},
+			"name":  {"Local Reader"},
+			"state": {q.Get("state")},
+			"nonce": {q.Get("nonce")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// New accounts get the default role, so the viewer is turned away from
+	// the form they asked for.
+	resp := signIn("local@example.com")
+	if resp.StatusCode != http.StatusForbidden || resp.Request.URL.Path != "/novels/add" {
+		t.Fatalf("local sign-in: got %d at %s, want 403 at the add form", resp.StatusCode, resp.Request.URL)
+	}
+	u, err := n.Users.GetUserByIdentity(context.Background(), "local", "local@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByIdentity: %v", err)
+	}
+	if u.Name != "Local Reader" || u.Role != RoleViewer {
+		t.Errorf("got user %+v, want a viewer", u)
+	}
+	signIn("local@example.com")
+	if again, _ := n.Users.GetUserByEmail(context.Background(), "local@example.com"); again.ID != u.ID {
+		t.Errorf("signing in again created user %q, want %q", again.ID, u.ID)
+	}
+
+	// The stand-in provider vouches for nothing, so it cannot take over the
+	// password account with the same address.
+	if resp := signIn(testEmail); resp.StatusCode != http.StatusConflict {
+		t.Errorf("local sign-in as %s: got status %d, want %d", testEmail, resp.StatusCode, http.StatusConflict)
+	}
+	existing, err := n.Users.GetUserByEmail(context.Background(), testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.Provider != "" || existing.Subject != "" {
+		t.Errorf("password account was linked to the local provider: %+v", existing)
+	}
+
+	// A callback with a state this browser did not start is rejected.
+	resp, err = newTestClient().Get(serv.URL + "/auth/callback?state=forged&code=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged callback: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAdduserCommand(t *testing.T) {
+	ctx := context.Background()
+	shelf := &Novelshelf{Users: newMemoryDB(), logWriter: ioutil.Discard}
+	defer func(r io.Reader) { commandInput = r }(commandInput)
+
+	commandInput = strings.NewReader(testPassword + "\n")
+	var out bytes.Buffer
+	if err := shelf.adduserCommand(ctx, []string{"-email", "New@Example.com", "-name", "New", "-role", "admin"}, &out); err != nil {
+		t.Fatalf("adduser: %v", err)
+	}
+	u, err := shelf.authenticate(ctx, "new@example.com", testPassword)
+	if err != nil || u == nil || u.Name != "New" || u.Role != RoleAdmin {
+		t.Errorf("authenticate after adduser: got %+v, %v", u, err)
+	}
+
+	commandInput = strings.NewReader(testPassword + "\n")
+	if err := shelf.adduserCommand(ctx, []string{"-email", "new@example.com"}, &out); !errors.Is(err, ErrUserExists) {
+		t.Errorf("adduser with a taken email: got %v, want ErrUserExists", err)
+	}
+	commandInput = strings.NewReader(testPassword + "\n")
+	if err := shelf.adduserCommand(ctx, []string{"-email", "other@example.com", "-role", "owner"}, &out); err == nil {
+		t.Error("adduser with an unknown role: want error")
+	}
+	commandInput = strings.NewReader("short\n")
+	if err := shelf.adduserCommand(ctx, []string{"-email", "other@example.com"}, &out); err == nil {
+		t.Error("adduser with a short password: want error")
+	}
+}
+
+func TestShelves(t *testing.T) {
+	ctx := context.Background()
+	n.DB = testDBs["memory"]
+	resp, err := wt.PostForm("/novels", url.Values{"title": {"my shelf novel"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	novelPath := resp.Request.URL.Path
+	id := strings.TrimPrefix(novelPath, "/novels/")
+	novel, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if novel.CreatedBy != testUser.ID {
+		t.Errorf("CreatedBy: got %q, want %q", novel.CreatedBy, testUser.ID)
+	}
+	defer n.DB.DeleteNovel(ctx, id)
+	bodyContains(t, wt, novelPath, "Edit book")
+	bodyContains(t, wt, "/novels?createdBy="+testUser.ID, "my shelf novel")
+
+	otherUser, other := addTestUser(t, "other@example.com", RoleEditor)
+	if _, body := doRequest(t, other, "GET", novelPath); strings.Contains(body, "Edit book") {
+		t.Errorf("another user is offered to edit the novel")
+	}
+	if _, body := doRequest(t, other, "GET", "/novels?createdBy="+otherUser.ID); strings.Contains(body, "my shelf novel") {
+		t.Errorf("novel is listed on another user's shelf")
+	}
+	for _, req := range []struct{ method, path string }{
+		{"GET", novelPath + "/edit"},
+		{"POST", novelPath},
+		{"POST", novelPath + ":delete"},
+		{"PUT", "/api/v1/novels/" + id},
+		{"DELETE", "/api/v1/novels/" + id},
+	} {
+		if resp, _ := doRequest(t, other, req.method, req.path); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s as another user: got status %d, want %d", req.method, req.path, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	// Novels without an owner can only be changed by admins.
+	unowned, err := n.DB.AddNovel(ctx, &Novel{Title: "unowned"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, "/novels/"+unowned+"/edit", http.StatusForbidden)
+
+	for _, path := range []string{novelPath, "/novels/" + unowned} {
+		if resp, _ := doRequest(t, adminWT.Client, "POST", path+":delete"); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/novels" {
+			t.Errorf("admin delete of %s: got %d at %s, want the list", path, resp.StatusCode, resp.Request.URL)
+		}
+	}
+	if _, err := n.DB.GetNovel(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNovel after admin delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	viewer, viewerClient := addTestUser(t, "viewer@example.com", RoleViewer)
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/novels/add"},
+		{"POST", "/novels"},
+		{"POST", "/api/v1/novels"},
+		{"GET", "/admin/users"},
+	} {
+		if resp, _ := doRequest(t, viewerClient, req.method, req.path); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s as a viewer: got status %d, want %d", req.method, req.path, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	for _, path := range []string{"/logs", "/errors", "/admin/users"} {
+		checkStatus(t, path, http.StatusForbidden)
+		if resp, _ := doRequest(t, newTestClient(), "GET", path); resp.Request.URL.Path != "/login" {
+			t.Errorf("GET %s signed out: got %s, want the login form", path, resp.Request.URL)
+		}
+	}
+
+	bodyContains(t, adminWT, "/admin/users", viewer.Email)
+	resp, err := adminWT.PostForm("/admin/users/"+viewer.ID, url.Values{"role": {"editor"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/admin/users" {
+		t.Errorf("setting role: got %d at %s, want the users page", resp.StatusCode, resp.Request.URL)
+	}
+	if resp, _ := doRequest(t, viewerClient, "GET", "/novels/add"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /novels/add after promotion to editor: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	admin, err := n.Users.GetUserByEmail(context.Background(), testAdminEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id, role string
+		want     int
+	}{
+		{admin.ID, "viewer", http.StatusBadRequest},
+		{viewer.ID, "owner", http.StatusBadRequest},
+		{"doesnotexist", "viewer", http.StatusNotFound},
+	} {
+		resp, err := adminWT.PostForm("/admin/users/"+tc.id, url.Values{"role": {tc.role}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("setting role of %q to %q: got status %d, want %d", tc.id, tc.role, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// addTestUser adds a password account with role and returns it with a
+// client signed in to it.
+func addTestUser(t *testing.T, email string, role Role) (*User, *http.Client) {
+	t.Helper()
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Email: email, PasswordHash: hash, Role: role}
+	if _, err := n.Users.AddUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	c, err := signedInClient(email, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, c
+}
+
+// doRequest makes a request without a body with c and returns the response
+// and its body.
+func doRequest(t *testing.T, c *http.Client, method, path string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, serv.URL+path, nil)
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
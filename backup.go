@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tar archive holding, in this order:
+//
+//	manifest.json   a backupManifest
+//	users.jsonl     a backupUser per line for the owners of the novels
+//	novels.jsonl    a backupNovel per line, including those in the trash
+//	images/<name>   the cover images stored in the ImageStore
+//
+// It only depends on the NovelDatabase and ImageStore interfaces, so a
+// backup of one backend can be restored into any other.
+const (
+	backupManifestName = "manifest.json"
+	backupUsersName    = "users.jsonl"
+	backupNovelsName   = "novels.jsonl"
+	backupImagesDir    = "images/"
+)
+
+// backupFormatVersion is incremented whenever the backup format changes in
+// a way older versions of restore cannot read.
+const backupFormatVersion = 1
+
+type backupManifest struct {
+	FormatVersion int               `json:"formatVersion"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	Novels        int               `json:"novels"`
+	Images        map[string]string `json:"images"` // content types by image name
+}
+
+// backupUser identifies the owner of novels across backends, where user
+// IDs differ. Passwords and identities are not backed up.
+type backupUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
+// backupNovel is a novel with the names its covers are stored under in
+// the archive.
+type backupNovel struct {
+	*Novel
+	Covers map[string]string `json:"covers,omitempty"` // image names by field name, "imageURL" or "thumbnailURL"
+}
+
+// coverFields returns the fields of novel holding the URLs of its covers.
+func coverFields(novel *Novel) map[string]*string {
+	return map[string]*string{"imageURL": &novel.ImageURL, "thumbnailURL": &novel.ThumbnailURL}
+}
+
+// backup writes a backup of every novel, in the trash or not, and their
+// covers to w.
+func (n *Novelshelf) backup(ctx context.Context, w io.Writer) (*backupManifest, error) {
+	novels, err := n.DB.ListNovels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backup: could not list novels: %v", err)
+	}
+	trash, err := n.DB.ListTrash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backup: could not list trash: %v", err)
+	}
+	novels = append(novels, trash...)
+
+	m := &backupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     time.Now(),
+		Novels:        len(novels),
+		Images:        make(map[string]string),
+	}
+	var users, records bytes.Buffer
+	usersEnc, recordsEnc := json.NewEncoder(&users), json.NewEncoder(&records)
+	owners := make(map[string]bool)
+	var images []string
+	for _, novel := range novels {
+		rec := backupNovel{Novel: novel}
+		for field, u := range coverFields(novel) {
+			name, ok := "", false
+			if n.Images != nil {
+				name, ok = n.Images.Name(*u)
+			}
+			if !ok {
+				continue
+			}
+			if rec.Covers == nil {
+				rec.Covers = make(map[string]string)
+			}
+			rec.Covers[field] = name
+			if _, seen := m.Images[name]; !seen {
+				m.Images[name] = ""
+				images = append(images, name)
+			}
+		}
+		if err := recordsEnc.Encode(rec); err != nil {
+			return nil, fmt.Errorf("backup: could not encode novel %q: %v", novel.ID, err)
+		}
+		if novel.CreatedBy == "" || owners[novel.CreatedBy] {
+			continue
+		}
+		owners[novel.CreatedBy] = true
+		u, err := n.Users.GetUser(ctx, novel.CreatedBy)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup: could not get owner of novel %q: %v", novel.ID, err)
+		}
+		if err := usersEnc.Encode(backupUser{ID: u.ID, Email: u.Email}); err != nil {
+			return nil, fmt.Errorf("backup: %v", err)
+		}
+	}
+
+	// The images are read before anything is written, as the manifest at
+	// the start of the archive lists their content types.
+	data := make(map[string][]byte)
+	for _, name := range images {
+		rc, contentType, err := n.Images.Get(ctx, name)
+		if errors.Is(err, ErrImageNotFound) {
+			delete(m.Images, name)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup: could not read image %q: %v", name, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("backup: could not read image %q: %v", name, err)
+		}
+		data[name] = b
+		m.Images[name] = contentType
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	if err := add(backupManifestName, manifest); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	if err := add(backupUsersName, users.Bytes()); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	if err := add(backupNovelsName, records.Bytes()); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	for _, name := range images {
+		if b, ok := data[name]; ok {
+			if err := add(backupImagesDir+name, b); err != nil {
+				return nil, fmt.Errorf("backup: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	return m, nil
+}
+
+// restoreResult reports the outcome of restoring a backup.
+type restoreResult struct {
+	Novels  int               // novels restored, including those in the trash
+	Trashed int               // novels restored into the trash
+	Images  int               // images restored
+	NoOwner int               // novels whose owner has no account here
+	NoCover int               // covers that could not be restored
+	IDs     map[string]string // IDs of the novels added, by their ID in the backup
+}
+
+// restore adds the novels and covers in the backup read from r. The
+// novels get new IDs, returned in the result by their ID in the backup,
+// and are put on the shelves of the users here with the same email
+// addresses as their owners. Novels that were in the trash are restored
+// into the trash, deleted when they were. With dryRun the backup is only
+// read.
+func (n *Novelshelf) restore(ctx context.Context, r io.Reader, dryRun bool) (*restoreResult, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("restore: not a backup: %v", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	res := &restoreResult{IDs: make(map[string]string)}
+	var m *backupManifest
+	var records []backupNovel
+	owners := make(map[string]string) // user IDs here by user ID in the backup
+	restored := make(map[string]bool) // images restored
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("restore: %v", err)
+		}
+		if m == nil && hdr.Name != backupManifestName {
+			return nil, fmt.Errorf("restore: not a backup: the archive does not start with %s", backupManifestName)
+		}
+		switch {
+		case hdr.Name == backupManifestName:
+			m = &backupManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("restore: could not read %s: %v", hdr.Name, err)
+			}
+			if m.FormatVersion > backupFormatVersion {
+				return nil, fmt.Errorf("restore: the backup has format version %d; this version of novelshelf reads up to %d", m.FormatVersion, backupFormatVersion)
+			}
+		case hdr.Name == backupUsersName:
+			err := readJSONLines(tr, func(dec *json.Decoder) error {
+				var bu backupUser
+				if err := dec.Decode(&bu); err != nil {
+					return err
+				}
+				u, err := n.Users.GetUserByEmail(ctx, bu.Email)
+				if errors.Is(err, ErrUserNotFound) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				owners[bu.ID] = u.ID
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("restore: could not read %s: %v", hdr.Name, err)
+			}
+		case hdr.Name == backupNovelsName:
+			err := readJSONLines(tr, func(dec *json.Decoder) error {
+				rec := backupNovel{Novel: &Novel{}}
+				if err := dec.Decode(&rec); err != nil {
+					return err
+				}
+				records = append(records, rec)
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("restore: could not read %s: %v", hdr.Name, err)
+			}
+		case strings.HasPrefix(hdr.Name, backupImagesDir):
+			name := path.Base(hdr.Name)
+			contentType, ok := m.Images[name]
+			if !ok || n.Images == nil {
+				continue
+			}
+			if !dryRun {
+				if err := n.Images.Put(ctx, name, tr, contentType); err != nil {
+					return nil, fmt.Errorf("restore: could not store image %q: %v", name, err)
+				}
+			}
+			restored[name] = true
+			res.Images++
+		}
+	}
+	if m == nil {
+		return nil, errors.New("restore: the backup is empty")
+	}
+
+	var live, trashed []*Novel
+	var deletedAt []*time.Time
+	for _, rec := range records {
+		novel := rec.Novel
+		for field, u := range coverFields(novel) {
+			name, ok := rec.Covers[field]
+			switch {
+			case !ok:
+				// Covers linked from elsewhere are kept as they are.
+			case restored[name]:
+				*u = n.Images.URL(name)
+			default:
+				*u = ""
+				res.NoCover++
+			}
+		}
+		if novel.CreatedBy != "" {
+			novel.CreatedBy = owners[novel.CreatedBy]
+			if novel.CreatedBy == "" {
+				res.NoOwner++
+			}
+		}
+		if novel.DeletedAt != nil {
+			deletedAt = append(deletedAt, novel.DeletedAt)
+			novel.DeletedAt = nil
+			trashed = append(trashed, novel)
+		} else {
+			live = append(live, novel)
+		}
+	}
+	res.Novels = len(records)
+	res.Trashed = len(trashed)
+	if dryRun {
+		return res, nil
+	}
+	for _, novels := range [][]*Novel{live, trashed} {
+		for start := 0; start < len(novels); start += maxNovelBatch {
+			end := start + maxNovelBatch
+			if end > len(novels) {
+				end = len(novels)
+			}
+			batch := novels[start:end]
+			oldIDs := make([]string, len(batch))
+			for i, novel := range batch {
+				oldIDs[i] = novel.ID
+				novel.ID = ""
+			}
+			ids, err := n.DB.AddNovels(ctx, batch)
+			for i, id := range ids {
+				res.IDs[oldIDs[i]] = id
+			}
+			if err != nil {
+				return res, fmt.Errorf("restore: could not add novels: %v", err)
+			}
+		}
+	}
+	// Trashed novels are moved to the trash as they were, so that they keep
+	// when they were deleted and nothing records a new delete.
+	for i, novel := range trashed {
+		novel.DeletedAt = deletedAt[i]
+	}
+	if err := n.DB.PutNovels(ctx, trashed); err != nil {
+		return res, fmt.Errorf("restore: could not move novels to the trash: %v", err)
+	}
+	return res, nil
+}
+
+// readJSONLines calls decode for each line of r.
+func readJSONLines(r io.Reader, decode func(*json.Decoder) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxImportSize)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := decode(json.NewDecoder(bytes.NewReader(line))); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// backupCommand implements "novelshelf backup", which writes a backup
+// archive of the novels and their covers to a file, or to standard output
+// if the file is "-".
+func (n *Novelshelf) backupCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("backup: give the file to write the backup to")
+	}
+	if fs.Arg(0) == "-" {
+		_, err := n.backup(ctx, out)
+		return err
+	}
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	m, err := n.backup(ctx, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	fmt.Fprintf(out, "Backed up %d novels and %d images to %s\n", m.Novels, len(m.Images), fs.Arg(0))
+	return nil
+}
+
+// restoreCommand implements "novelshelf restore", which adds the novels
+// and covers in a backup archive, or standard input if the file is "-".
+func (n *Novelshelf) restoreCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "only read the backup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("restore: give the backup file to restore")
+	}
+	in := commandInput
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("restore: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	res, err := n.restore(ctx, in, *dryRun)
+	if err != nil {
+		if res != nil {
+			fmt.Fprintf(out, "%d novels were restored before the error\n", len(res.IDs))
+		}
+		return err
+	}
+	verb := "Restored"
+	if *dryRun {
+		verb = "Would restore"
+	}
+	fmt.Fprintf(out, "%s %d novels (%d into the trash) and %d images\n", verb, res.Novels, res.Trashed, res.Images)
+	if res.NoOwner > 0 {
+		fmt.Fprintf(out, "%d novels were put on no shelf, as their owners have no account here\n", res.NoOwner)
+	}
+	if res.NoCover > 0 {
+		fmt.Fprintf(out, "%d covers could not be restored\n", res.NoCover)
+	}
+	return nil
+}
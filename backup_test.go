@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "novelshelf-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcImages, err := newLocalImageStore(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDB := newMemoryDB()
+	src := &Novelshelf{DB: srcDB, Users: srcDB, Images: srcImages, logWriter: ioutil.Discard}
+	owner := &User{Email: "owner@example.com", Role: RoleEditor}
+	if _, err := srcDB.AddUser(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	const cover = "6ba7b810-9dad-11d1-80b4-00c04fd430c8-full.jpg"
+	if err := srcImages.Put(ctx, cover, strings.NewReader("jpeg"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	liveID, err := srcDB.AddNovel(ctx, &Novel{Title: "三四郎", CreatedBy: owner.ID, ImageURL: srcImages.URL(cover), ThumbnailURL: "https://example.com/thumb.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashedID, err := srcDB.AddNovel(ctx, &Novel{Title: "行人", CreatedBy: "gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srcDB.DeleteNovel(ctx, trashedID); err != nil {
+		t.Fatal(err)
+	}
+	srcTrashed, err := srcDB.GetTrashedNovel(ctx, trashedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	m, err := src.backup(ctx, &archive)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if m.Novels != 2 || m.Images[cover] != "image/jpeg" {
+		t.Errorf("backup: got manifest %+v", m)
+	}
+
+	// Restore into a SQL database, where the owner has another ID.
+	dstDB, err := newSQLDB("sqlite3", filepath.Join(dir, "novels.db"))
+	if err != nil {
+		t.Fatalf("newSQLDB: %v", err)
+	}
+	defer dstDB.Close(ctx)
+	dstUsers := newMemoryDB()
+	dstUsers.AddUser(ctx, &User{Email: "someone@example.com"})
+	dstOwner := &User{Email: owner.Email, Role: RoleEditor}
+	if _, err := dstUsers.AddUser(ctx, dstOwner); err != nil {
+		t.Fatal(err)
+	}
+	dstImages, err := newLocalImageStore(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := &Novelshelf{DB: dstDB, Users: dstUsers, Images: dstImages, logWriter: ioutil.Discard}
+
+	res, err := dst.restore(ctx, bytes.NewReader(archive.Bytes()), true)
+	if err != nil || res.Novels != 2 || len(res.IDs) != 0 {
+		t.Fatalf("restore dry run: got %+v, %v", res, err)
+	}
+	if novels, _ := dstDB.ListNovels(ctx); len(novels) != 0 {
+		t.Errorf("restore dry run: added %d novels", len(novels))
+	}
+
+	res, err = dst.restore(ctx, bytes.NewReader(archive.Bytes()), false)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if res.Novels != 2 || res.Trashed != 1 || res.Images != 1 || res.NoOwner != 1 || res.NoCover != 0 {
+		t.Errorf("restore: got %+v", res)
+	}
+	novel, err := dstDB.GetNovel(ctx, res.IDs[liveID])
+	if err != nil {
+		t.Fatalf("GetNovel: %v", err)
+	}
+	if novel.Title != "三四郎" || novel.CreatedBy != dstOwner.ID || novel.ImageURL != dstImages.URL(cover) || novel.ThumbnailURL != "https://example.com/thumb.jpg" {
+		t.Errorf("restored novel: got %+v", novel)
+	}
+	rc, contentType, err := dstImages.Get(ctx, cover)
+	if err != nil {
+		t.Fatalf("restored cover: %v", err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "jpeg" || contentType != "image/jpeg" {
+		t.Errorf("restored cover: got %q of type %q", b, contentType)
+	}
+	trashed, err := dstDB.GetTrashedNovel(ctx, res.IDs[trashedID])
+	if err != nil {
+		t.Fatalf("GetTrashedNovel: %v", err)
+	}
+	if trashed.Title != "行人" || trashed.CreatedBy != "" {
+		t.Errorf("restored trashed novel: got %+v", trashed)
+	}
+	if want := srcTrashed.DeletedAt.Truncate(time.Microsecond); trashed.DeletedAt == nil || !trashed.DeletedAt.Truncate(time.Microsecond).Equal(want) {
+		t.Errorf("restored trashed novel: got DeletedAt %v, want %v", trashed.DeletedAt, want)
+	}
+
+	if _, err := dst.restore(ctx, strings.NewReader("title\n"), false); err == nil {
+		t.Error("restore of a CSV file: want error")
+	}
+}
+
+func TestBackupCommand(t *testing.T) {
+	ctx := context.Background()
+	srcDB := newMemoryDB()
+	src := &Novelshelf{DB: srcDB, Users: srcDB, logWriter: ioutil.Discard}
+	if _, err := srcDB.AddNovel(ctx, &Novel{Title: "彼岸過迄"}); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := src.backupCommand(ctx, []string{"-"}, &archive); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	dstDB := newMemoryDB()
+	dst := &Novelshelf{DB: dstDB, Users: dstDB, logWriter: ioutil.Discard}
+	defer func(r io.Reader) { commandInput = r }(commandInput)
+	commandInput = &archive
+	var out bytes.Buffer
+	if err := dst.restoreCommand(ctx, []string{"-"}, &out); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if !strings.Contains(out.String(), "Restored 1 novels") {
+		t.Errorf("restore: got output %q", out.String())
+	}
+	if novels, _ := dstDB.ListNovels(ctx); len(novels) != 1 || novels[0].Title != "彼岸過迄" {
+		t.Errorf("restore: got %+v", novels)
+	}
+}
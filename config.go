@@ -0,0 +1,292 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config selects the backends Novelshelf runs with. It is read from an
+// optional JSON file and then overridden by environment variables, so a
+// deployment can keep its settings in app.yaml while a developer can start
+// the app offline with no configuration at all.
+type Config struct {
+	// Port is the HTTP port to listen on. Env: PORT.
+	Port string `json:"port"`
+
+	// ProjectID is the Google Cloud project used by the Firestore, Cloud
+	// Storage and Error Reporting backends. Env: GOOGLE_CLOUD_PROJECT.
+	ProjectID string `json:"projectID"`
+
+	// Database is "memory", "firestore", "sqlite3" or "postgres".
+	// Env: NOVELSHELF_DB.
+	Database string `json:"database"`
+
+	// DatabaseDSN is the data source name for the SQL databases, e.g. a
+	// file path for sqlite3. Env: NOVELSHELF_DB_DSN.
+	DatabaseDSN string `json:"databaseDSN"`
+
+	// ImageStore is "gcs", "local" or "none". Env: NOVELSHELF_IMAGE_STORE.
+	ImageStore string `json:"imageStore"`
+
+	// ImageDir is the directory the local image store keeps covers in.
+	// Env: NOVELSHELF_IMAGE_DIR.
+	ImageDir string `json:"imageDir"`
+
+	// Bucket is the Cloud Storage bucket for cover images. It defaults to
+	// the App Engine default bucket of ProjectID. Env: NOVELSHELF_BUCKET.
+	Bucket string `json:"bucket"`
+
+	// ErrorReporter is "errorreporting" for Cloud Error Reporting or "log"
+	// to write errors to the log. Env: NOVELSHELF_ERROR_REPORTER.
+	ErrorReporter string `json:"errorReporter"`
+
+	// ISBNProvider is "openlibrary" to look up books in Open Library,
+	// "fixture" to answer from ISBNFixtures or "none".
+	// Env: NOVELSHELF_ISBN_PROVIDER.
+	ISBNProvider string `json:"isbnProvider"`
+
+	// ISBNFixtures is the JSON file the fixture ISBN provider reads.
+	// Env: NOVELSHELF_ISBN_FIXTURES.
+	ISBNFixtures string `json:"isbnFixtures"`
+
+	// SessionKey is the secret sign-in cookies are signed and encrypted
+	// with. Without it a random key is used and restarting the app signs
+	// everyone out. Env: NOVELSHELF_SESSION_KEY.
+	SessionKey string `json:"sessionKey"`
+
+	// AuthProvider is "oidc" to also sign in through an OpenID Connect
+	// provider, "local" for a stand-in provider that signs in anyone (for
+	// development only; refused on App Engine) or "none" for password
+	// sign-in only.
+	// Env: NOVELSHELF_AUTH_PROVIDER.
+	AuthProvider string `json:"authProvider"`
+
+	// OIDCIssuer, OIDCClientID, OIDCClientSecret and OIDCRedirectURL
+	// configure the "oidc" provider. The redirect URL must point to
+	// /auth/callback. Env: NOVELSHELF_OIDC_ISSUER, NOVELSHELF_OIDC_CLIENT_ID,
+	// NOVELSHELF_OIDC_CLIENT_SECRET, NOVELSHELF_OIDC_REDIRECT_URL.
+	OIDCIssuer       string `json:"oidcIssuer"`
+	OIDCClientID     string `json:"oidcClientID"`
+	OIDCClientSecret string `json:"oidcClientSecret"`
+	OIDCRedirectURL  string `json:"oidcRedirectURL"`
+
+	// DefaultRole is the role of accounts created by signing in through
+	// the identity provider: "viewer", "editor" or "admin". Admins can
+	// change it afterwards. Env: NOVELSHELF_DEFAULT_ROLE.
+	DefaultRole string `json:"defaultRole"`
+
+	// TrashRetention is how long deleted novels stay in the trash before
+	// they are purged for good, as a duration such as "720h". "0" keeps
+	// them until they are purged by hand. Env: NOVELSHELF_TRASH_RETENTION.
+	TrashRetention string `json:"trashRetention"`
+
+	// SearchRefresh is how often the search index is refreshed from the
+	// database, as a duration such as "1h", to pick up writes made by
+	// commands or other instances. Each refresh reads every novel, which on
+	// Firestore is billed as one document read per novel, so it is off by
+	// default. Env: NOVELSHELF_SEARCH_REFRESH.
+	SearchRefresh string `json:"searchRefresh"`
+}
+
+// configEnv maps environment variables to the Config fields they set.
+func (c *Config) configEnv() map[string]*string {
+	return map[string]*string{
+		"PORT":                          &c.Port,
+		"GOOGLE_CLOUD_PROJECT":          &c.ProjectID,
+		"NOVELSHELF_DB":                 &c.Database,
+		"NOVELSHELF_DB_DSN":             &c.DatabaseDSN,
+		"NOVELSHELF_IMAGE_STORE":        &c.ImageStore,
+		"NOVELSHELF_IMAGE_DIR":          &c.ImageDir,
+		"NOVELSHELF_BUCKET":             &c.Bucket,
+		"NOVELSHELF_ERROR_REPORTER":     &c.ErrorReporter,
+		"NOVELSHELF_ISBN_PROVIDER":      &c.ISBNProvider,
+		"NOVELSHELF_ISBN_FIXTURES":      &c.ISBNFixtures,
+		"NOVELSHELF_SESSION_KEY":        &c.SessionKey,
+		"NOVELSHELF_AUTH_PROVIDER":      &c.AuthProvider,
+		"NOVELSHELF_OIDC_ISSUER":        &c.OIDCIssuer,
+		"NOVELSHELF_OIDC_CLIENT_ID":     &c.OIDCClientID,
+		"NOVELSHELF_OIDC_CLIENT_SECRET": &c.OIDCClientSecret,
+		"NOVELSHELF_OIDC_REDIRECT_URL":  &c.OIDCRedirectURL,
+		"NOVELSHELF_DEFAULT_ROLE":       &c.DefaultRole,
+		"NOVELSHELF_TRASH_RETENTION":    &c.TrashRetention,
+		"NOVELSHELF_SEARCH_REFRESH":     &c.SearchRefresh,
+	}
+}
+
+// loadConfig reads the config file at path, if path is not empty, applies
+// environment overrides and fills in defaults. Without a project ID the
+// defaults need no cloud services: an in-memory database, covers stored on
+// local disk and errors written to the log.
+func loadConfig(path string) (*Config, error) {
+	c := &Config{}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("config: could not parse %s: %v", path, err)
+		}
+	}
+	for name, field := range c.configEnv() {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Port == "" {
+		c.Port = "8080"
+	}
+	cloud := c.ProjectID != ""
+	if c.Database == "" {
+		c.Database = "memory"
+		if cloud {
+			c.Database = "firestore"
+		}
+	}
+	if c.ImageStore == "" {
+		c.ImageStore = "local"
+		if cloud {
+			c.ImageStore = "gcs"
+		}
+	}
+	if c.ImageDir == "" {
+		c.ImageDir = "images"
+	}
+	if c.Bucket == "" && cloud {
+		c.Bucket = c.ProjectID + ".appspot.com"
+	}
+	if c.ErrorReporter == "" {
+		c.ErrorReporter = "log"
+		if cloud {
+			c.ErrorReporter = "errorreporting"
+		}
+	}
+	if c.ISBNProvider == "" {
+		c.ISBNProvider = "openlibrary"
+	}
+	if c.AuthProvider == "" {
+		c.AuthProvider = "none"
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = string(RoleViewer)
+	}
+	if c.TrashRetention == "" {
+		c.TrashRetention = defaultTrashRetention.String()
+	}
+}
+
+func (c *Config) validate() error {
+	switch c.Database {
+	case "memory", "firestore", "sqlite3", "postgres":
+	default:
+		return fmt.Errorf("config: unknown database %q", c.Database)
+	}
+	switch c.ImageStore {
+	case "gcs", "local", "none":
+	default:
+		return fmt.Errorf("config: unknown image store %q", c.ImageStore)
+	}
+	switch c.ErrorReporter {
+	case "errorreporting", "log":
+	default:
+		return fmt.Errorf("config: unknown error reporter %q", c.ErrorReporter)
+	}
+	switch c.ISBNProvider {
+	case "openlibrary", "fixture", "none":
+	default:
+		return fmt.Errorf("config: unknown ISBN provider %q", c.ISBNProvider)
+	}
+	switch c.AuthProvider {
+	case "oidc", "local", "none":
+	default:
+		return fmt.Errorf("config: unknown auth provider %q", c.AuthProvider)
+	}
+	if _, err := parseRole(c.DefaultRole); err != nil {
+		return fmt.Errorf("config: default role: %v", err)
+	}
+	if _, err := c.trashRetention(); err != nil {
+		return err
+	}
+	if _, err := c.searchRefresh(); err != nil {
+		return err
+	}
+
+	needsProject := c.Database == "firestore" || c.ImageStore == "gcs" || c.ErrorReporter == "errorreporting"
+	if needsProject && c.ProjectID == "" {
+		return fmt.Errorf("config: GOOGLE_CLOUD_PROJECT must be set to use firestore, gcs or errorreporting")
+	}
+	if (c.Database == "sqlite3" || c.Database == "postgres") && c.DatabaseDSN == "" {
+		return fmt.Errorf("config: NOVELSHELF_DB_DSN must be set to use %s", c.Database)
+	}
+	if c.ImageStore == "gcs" && c.Bucket == "" {
+		return fmt.Errorf("config: NOVELSHELF_BUCKET must be set to use gcs")
+	}
+	if c.ISBNProvider == "fixture" && c.ISBNFixtures == "" {
+		return fmt.Errorf("config: NOVELSHELF_ISBN_FIXTURES must be set to use the fixture ISBN provider")
+	}
+	// App Engine serves the app to everyone, and the local provider lets
+	// anyone sign in as anyone.
+	if c.AuthProvider == "local" && os.Getenv("GAE_ENV") != "" {
+		return fmt.Errorf("config: the local auth provider cannot be used on App Engine")
+	}
+	if c.AuthProvider == "oidc" && (c.OIDCIssuer == "" || c.OIDCClientID == "" || c.OIDCClientSecret == "" || c.OIDCRedirectURL == "") {
+		return fmt.Errorf("config: NOVELSHELF_OIDC_ISSUER, NOVELSHELF_OIDC_CLIENT_ID, NOVELSHELF_OIDC_CLIENT_SECRET and NOVELSHELF_OIDC_REDIRECT_URL must be set to use oidc")
+	}
+	return nil
+}
+
+// trashRetention parses TrashRetention. An empty TrashRetention disables
+// purging.
+func (c *Config) trashRetention() (time.Duration, error) {
+	if c.TrashRetention == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.TrashRetention)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("config: invalid trash retention %q", c.TrashRetention)
+	}
+	return d, nil
+}
+
+// searchRefresh parses SearchRefresh. An empty SearchRefresh, or "0",
+// disables refreshing.
+func (c *Config) searchRefresh() (time.Duration, error) {
+	if c.SearchRefresh == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.SearchRefresh)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("config: invalid search refresh %q", c.SearchRefresh)
+	}
+	return d, nil
+}
+
+// newDatabase opens the database selected by c.
+func newDatabase(ctx context.Context, c *Config) (NovelDatabase, error) {
+	switch c.Database {
+	case "firestore":
+		client, err := firestore.NewClient(ctx, c.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("firestore.NewClient: %v", err)
+		}
+		return newFirestoreDB(client)
+	case "sqlite3", "postgres":
+		return newSQLDB(c.Database, c.DatabaseDSN)
+	}
+	return newMemoryDB(), nil
+}
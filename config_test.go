@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for _, name := range []string{"PORT", "GOOGLE_CLOUD_PROJECT", "NOVELSHELF_DB", "NOVELSHELF_DB_DSN",
+		"NOVELSHELF_IMAGE_STORE", "NOVELSHELF_IMAGE_DIR", "NOVELSHELF_BUCKET", "NOVELSHELF_ERROR_REPORTER",
+		"NOVELSHELF_ISBN_PROVIDER", "NOVELSHELF_ISBN_FIXTURES", "NOVELSHELF_TRASH_RETENTION", "NOVELSHELF_SEARCH_REFRESH"} {
+		if v, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			defer os.Setenv(name, v)
+		}
+	}
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("offline defaults: %v", err)
+	}
+	if cfg.Database != "memory" || cfg.ImageStore != "local" || cfg.ErrorReporter != "log" || cfg.Port != "8080" || cfg.ISBNProvider != "openlibrary" || cfg.DefaultRole != "viewer" || cfg.TrashRetention != "720h0m0s" {
+		t.Errorf("offline defaults: got %+v", cfg)
+	}
+
+	dir, err := ioutil.TempDir("", "novelshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"projectID": "p", "database": "sqlite3", "databaseDSN": "novels.db"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOVELSHELF_ERROR_REPORTER", "log")
+	defer os.Unsetenv("NOVELSHELF_ERROR_REPORTER")
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("config file: %v", err)
+	}
+	if cfg.Database != "sqlite3" || cfg.ImageStore != "gcs" || cfg.Bucket != "p.appspot.com" || cfg.ErrorReporter != "log" {
+		t.Errorf("config file: got %+v", cfg)
+	}
+
+	os.Setenv("NOVELSHELF_DB", "firestore")
+	defer os.Unsetenv("NOVELSHELF_DB")
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("firestore without project: want error")
+	}
+	os.Setenv("NOVELSHELF_DB", "memory")
+	os.Setenv("NOVELSHELF_ISBN_PROVIDER", "fixture")
+	defer os.Unsetenv("NOVELSHELF_ISBN_PROVIDER")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("fixture ISBN provider without fixtures: want error")
+	}
+	os.Setenv("NOVELSHELF_ISBN_PROVIDER", "")
+	os.Setenv("NOVELSHELF_DEFAULT_ROLE", "owner")
+	defer os.Unsetenv("NOVELSHELF_DEFAULT_ROLE")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("unknown default role: want error")
+	}
+	os.Setenv("NOVELSHELF_DEFAULT_ROLE", "")
+	for _, retention := range []string{"a month", "-1h"} {
+		os.Setenv("NOVELSHELF_TRASH_RETENTION", retention)
+		if _, err := loadConfig(""); err == nil {
+			t.Errorf("trash retention %q: want error", retention)
+		}
+	}
+	os.Setenv("NOVELSHELF_TRASH_RETENTION", "0")
+	defer os.Unsetenv("NOVELSHELF_TRASH_RETENTION")
+	if cfg, err := loadConfig(""); err != nil {
+		t.Errorf("trash retention 0: %v", err)
+	} else if d, _ := cfg.trashRetention(); d != 0 {
+		t.Errorf("trash retention 0: got %v", d)
+	}
+	os.Setenv("NOVELSHELF_TRASH_RETENTION", "")
+	os.Setenv("NOVELSHELF_SEARCH_REFRESH", "often")
+	defer os.Unsetenv("NOVELSHELF_SEARCH_REFRESH")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("search refresh \"often\": want error")
+	}
+	os.Setenv("NOVELSHELF_SEARCH_REFRESH", "1h")
+	if cfg, err := loadConfig(""); err != nil {
+		t.Errorf("search refresh 1h: %v", err)
+	} else if d, _ := cfg.searchRefresh(); d != time.Hour {
+		t.Errorf("search refresh 1h: got %v", d)
+	}
+	os.Setenv("NOVELSHELF_SEARCH_REFRESH", "")
+	os.Setenv("NOVELSHELF_AUTH_PROVIDER", "local")
+	defer os.Unsetenv("NOVELSHELF_AUTH_PROVIDER")
+	os.Setenv("GAE_ENV", "standard")
+	_, err = loadConfig("")
+	os.Unsetenv("GAE_ENV")
+	if err == nil {
+		t.Error("local auth provider on App Engine: want error")
+	}
+	if _, err := loadConfig(""); err != nil {
+		t.Errorf("local auth provider: %v", err)
+	}
+	os.Setenv("NOVELSHELF_AUTH_PROVIDER", "")
+	os.Setenv("NOVELSHELF_DB", "mongodb")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("unknown database: want error")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// maxCoverBytes caps the size of an uploaded cover image.
+	maxCoverBytes = 10 << 20
+	// maxCoverPixels caps the decoded size of a cover image, so that a small
+	// file cannot expand into an enormous bitmap.
+	maxCoverPixels = 50 * 1000 * 1000
+)
+
+// coverVariant is one of the sizes a cover is stored in. Images are scaled
+// down to fit within MaxWidth x MaxHeight and never scaled up.
+type coverVariant struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+var (
+	coverThumbnail = coverVariant{Name: "thumb", MaxWidth: 200, MaxHeight: 300}
+	coverFull      = coverVariant{Name: "full", MaxWidth: 1200, MaxHeight: 1800}
+)
+
+// coverVariants are the sizes every uploaded cover is stored in: a
+// thumbnail for list.html and the full size for detail.html.
+var coverVariants = []coverVariant{coverThumbnail, coverFull}
+
+// allowedCoverTypes are the sniffed content types accepted for covers.
+var allowedCoverTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// encodedCover is a cover image re-encoded at one size.
+type encodedCover struct {
+	Variant     coverVariant
+	Data        []byte
+	ContentType string
+	Ext         string
+}
+
+// processCover reads an uploaded image, checks that it really is a JPEG,
+// PNG, GIF or WebP within the size limits, applies its EXIF orientation and
+// re-encodes it at every size in coverVariants. Re-encoding drops EXIF and
+// any other metadata. Images with transparency are encoded as PNG and all
+// others as JPEG; only the first frame of an animated GIF is kept.
+// Unacceptable images are reported as ValidationErrors for the image field.
+func processCover(r io.Reader) ([]encodedCover, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxCoverBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxCoverBytes {
+		return nil, ValidationErrors{"image": fmt.Sprintf("must be at most %d MB", maxCoverBytes>>20)}
+	}
+	if ct := http.DetectContentType(b); !allowedCoverTypes[ct] {
+		return nil, ValidationErrors{"image": "must be a JPEG, PNG, GIF or WebP image"}
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, ValidationErrors{"image": "could not be read as an image"}
+	}
+	if cfg.Width*cfg.Height > maxCoverPixels {
+		return nil, ValidationErrors{"image": fmt.Sprintf("must be at most %d megapixels", maxCoverPixels/1000000)}
+	}
+	img, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, ValidationErrors{"image": "could not be read as an image"}
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(b))
+	}
+
+	covers := make([]encodedCover, 0, len(coverVariants))
+	for _, v := range coverVariants {
+		c, err := encodeCover(fitWithin(img, v.MaxWidth, v.MaxHeight))
+		if err != nil {
+			return nil, err
+		}
+		c.Variant = v
+		covers = append(covers, c)
+	}
+	return covers, nil
+}
+
+func encodeCover(img image.Image) (encodedCover, error) {
+	var buf bytes.Buffer
+	if isOpaque(img) {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return encodedCover{}, fmt.Errorf("could not encode cover: %v", err)
+		}
+		return encodedCover{Data: buf.Bytes(), ContentType: "image/jpeg", Ext: ".jpg"}, nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return encodedCover{}, fmt.Errorf("could not encode cover: %v", err)
+	}
+	return encodedCover{Data: buf.Bytes(), ContentType: "image/png", Ext: ".png"}, nil
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// fitWithin scales img down to fit within maxW x maxH, keeping its aspect
+// ratio. Images that already fit are returned as they are.
+func fitWithin(img image.Image, maxW, maxH int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxW && h <= maxH {
+		return img
+	}
+	if w*maxH > h*maxW {
+		h = h * maxW / w
+		w = maxW
+	} else {
+		w = w * maxH / h
+		h = maxH
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of the JPEG data b,
+// or 1 if it has none.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return 1
+		}
+		marker := b[i+1]
+		size := int(binary.BigEndian.Uint16(b[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(b) {
+			// Start of scan: no more metadata segments follow.
+			return 1
+		}
+		seg := b[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads the Orientation tag from IFD0 of the TIFF
+// structure in an EXIF segment.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[off:]) == 0x0112 {
+			o := int(order.Uint16(tiff[off+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// applyOrientation transforms img so that it displays upright given its
+// EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° counter-clockwise; turn it clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° clockwise; turn it counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// storedCover holds the URLs of the stored variants of a cover.
+type storedCover struct {
+	Names        []string
+	ImageURL     string
+	ThumbnailURL string
+}
+
+// newCoverBase returns a new unique name to store a cover's variants under.
+func newCoverBase() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// storeCover processes the image read from r and stores every variant in
+// n.Images under names derived from base.
+func (n *Novelshelf) storeCover(ctx context.Context, base string, r io.Reader) (*storedCover, error) {
+	covers, err := processCover(r)
+	if err != nil {
+		return nil, err
+	}
+	sc := &storedCover{}
+	for _, c := range covers {
+		name := base + "-" + c.Variant.Name + c.Ext
+		if err := n.Images.Put(ctx, name, bytes.NewReader(c.Data), c.ContentType); err != nil {
+			return nil, err
+		}
+		sc.Names = append(sc.Names, name)
+		switch c.Variant {
+		case coverFull:
+			sc.ImageURL = n.Images.URL(name)
+		case coverThumbnail:
+			sc.ThumbnailURL = n.Images.URL(name)
+		}
+	}
+	return sc, nil
+}
+
+// coverURLs returns the URLs of every variant of novel's cover.
+func coverURLs(novel *Novel) []string {
+	if novel == nil {
+		return nil
+	}
+	var urls []string
+	for _, u := range []string{novel.ImageURL, novel.ThumbnailURL} {
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// coverExists reports whether the cover image at url can still be served.
+// Covers outside n.Images are assumed to exist.
+func (n *Novelshelf) coverExists(ctx context.Context, url string) bool {
+	if url == "" || n.Images == nil {
+		return true
+	}
+	name, ok := n.Images.Name(url)
+	if !ok {
+		return true
+	}
+	rc, _, err := n.Images.Get(ctx, name)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
+// releaseCovers deletes the cover images of prev that cur no longer refers
+// to, such as the old cover after it was replaced or every cover of a
+// deleted novel (cur == nil). It must be called after the change to the
+// database, as covers still referred to by any stored novel, in the trash
+// or not, are kept. Images outside n.Images, such as covers linked from
+// elsewhere, are left alone. Failures are only logged: a cover left behind
+// is collected later by the gc command.
+func (n *Novelshelf) releaseCovers(ctx context.Context, prev, cur *Novel) {
+	if n.Images == nil {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, u := range coverURLs(cur) {
+		keep[u] = true
+	}
+	var names []string
+	for _, u := range coverURLs(prev) {
+		if keep[u] {
+			continue
+		}
+		if name, ok := n.Images.Name(u); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	referenced, err := n.referencedCovers(ctx)
+	if err != nil {
+		fmt.Fprintf(n.logWriter, "could not release covers: %v\n", err)
+		return
+	}
+	for _, name := range names {
+		if referenced[name] {
+			continue
+		}
+		if err := n.Images.Delete(ctx, name); err != nil && !errors.Is(err, ErrImageNotFound) {
+			fmt.Fprintf(n.logWriter, "could not delete cover %q: %v\n", name, err)
+		}
+	}
+}
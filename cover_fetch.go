@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// coverFetchTimeout bounds the whole download of a cover imported from
+	// a URL, including redirects and reading the body.
+	coverFetchTimeout = 20 * time.Second
+	// maxCoverRedirects is the number of redirects followed when importing
+	// a cover.
+	maxCoverRedirects = 5
+)
+
+// nonPublicNets are the address ranges covers are never fetched from, so
+// that importing a cover cannot be used to reach the app's own network.
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newCoverClient returns the HTTP client used to import covers from a
+// URL. It only connects to public addresses, checked after DNS resolution
+// so that a host name cannot point it at an internal service, and it
+// ignores proxy settings for the same reason.
+func newCoverClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicIP(net.ParseIP(host)) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: coverFetchTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxCoverRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxCoverRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// importCover downloads the image at rawURL and stores it like an
+// uploaded cover. Problems with the URL or the image it points to are
+// reported as ValidationErrors for the coverURL field.
+func (n *Novelshelf) importCover(ctx context.Context, rawURL string) (*storedCover, error) {
+	invalid := func(msg string) error { return ValidationErrors{"coverURL": msg} }
+
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, invalid("must be an http or https URL")
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, invalid("must be an http or https URL")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "image/jpeg, image/png, image/gif, image/webp")
+
+	resp, err := n.coverClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(n.logWriter, "could not import cover from %s: %v\n", u, err)
+		return nil, invalid("could not be downloaded")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, invalid(fmt.Sprintf("could not be downloaded: %s", resp.Status))
+	}
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || !strings.HasPrefix(mt, "image/") {
+		return nil, invalid("does not point to an image")
+	}
+	if resp.ContentLength > maxCoverBytes {
+		return nil, invalid(fmt.Sprintf("must be at most %d MB", maxCoverBytes>>20))
+	}
+
+	cover, err := n.storeCover(ctx, newCoverBase(), resp.Body)
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		return nil, invalid(verrs["image"])
+	}
+	return cover, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.20.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"::1":             false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+	} {
+		if got := isPublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestImportCover(t *testing.T) {
+	ctx := context.Background()
+	png := testPNG(t, 30, 40)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cover.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		case "/fake.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("not really a png"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "novelshelf-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	images, err := newLocalImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Novelshelf{Images: images, coverClient: srv.Client(), logWriter: ioutil.Discard}
+
+	cover, err := n.importCover(ctx, srv.URL+"/cover.png")
+	if err != nil {
+		t.Fatalf("importCover: %v", err)
+	}
+	if len(cover.Names) != len(coverVariants) || cover.ImageURL == "" || cover.ThumbnailURL == "" {
+		t.Errorf("importCover: got %+v, want every variant stored", cover)
+	}
+
+	for _, u := range []string{
+		"ftp://example.com/cover.png",
+		"not a url",
+		srv.URL + "/missing.png",
+		srv.URL + "/page.html",
+		srv.URL + "/fake.png",
+	} {
+		_, err := n.importCover(ctx, u)
+		verrs, ok := err.(ValidationErrors)
+		if !ok || verrs["coverURL"] == "" {
+			t.Errorf("importCover(%q): got error %v, want a ValidationErrors for coverURL", u, err)
+		}
+	}
+
+	// The real client must refuse to fetch from the loopback test server.
+	n.coverClient = newCoverClient()
+	if _, err := n.importCover(ctx, srv.URL+"/cover.png"); err == nil {
+		t.Errorf("importCover from a loopback address: want error")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProcessCover(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, solidImage(3000, 1000, color.RGBA{0x20, 0x40, 0x80, 0xff}), nil); err != nil {
+		t.Fatal(err)
+	}
+	covers, err := processCover(&buf)
+	if err != nil {
+		t.Fatalf("processCover: %v", err)
+	}
+	want := map[string]image.Point{"thumb": {200, 66}, "full": {1200, 400}}
+	if len(covers) != len(want) {
+		t.Fatalf("got %d variants, want %d", len(covers), len(want))
+	}
+	for _, c := range covers {
+		if c.ContentType != "image/jpeg" || c.Ext != ".jpg" {
+			t.Errorf("%s: got %s (%s), want image/jpeg (.jpg)", c.Variant.Name, c.ContentType, c.Ext)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(c.Data))
+		if err != nil {
+			t.Fatalf("%s: %v", c.Variant.Name, err)
+		}
+		if got := (image.Point{cfg.Width, cfg.Height}); got != want[c.Variant.Name] {
+			t.Errorf("%s: got size %v, want %v", c.Variant.Name, got, want[c.Variant.Name])
+		}
+	}
+}
+
+func TestProcessCoverKeepsTransparency(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, solidImage(10, 10, color.NRGBA{0xff, 0, 0, 0x80})); err != nil {
+		t.Fatal(err)
+	}
+	covers, err := processCover(&buf)
+	if err != nil {
+		t.Fatalf("processCover: %v", err)
+	}
+	for _, c := range covers {
+		if c.ContentType != "image/png" {
+			t.Errorf("%s: got %s, want image/png", c.Variant.Name, c.ContentType)
+		}
+	}
+}
+
+func TestProcessCoverRejects(t *testing.T) {
+	var header bytes.Buffer
+	png.Encode(&header, solidImage(1, 1, color.Black))
+	truncated := header.Bytes()[:len(header.Bytes())-20]
+
+	for name, data := range map[string][]byte{
+		"text":      []byte("not really a png"),
+		"html":      []byte("<html><body>hello</body></html>"),
+		"truncated": truncated,
+		"too large": append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, maxCoverBytes)...),
+	} {
+		_, err := processCover(bytes.NewReader(data))
+		verrs, ok := err.(ValidationErrors)
+		if !ok || verrs["image"] == "" {
+			t.Errorf("%s: got error %v, want a ValidationErrors for image", name, err)
+		}
+	}
+}
+
+func TestProcessCoverOrientation(t *testing.T) {
+	// A 40x20 image, red on the left and blue on the right, tagged as
+	// needing a quarter turn clockwise to display upright.
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, image.Rect(0, 0, 20, 20), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(20, 0, 40, 20), image.NewUniform(color.RGBA{0, 0, 0xff, 0xff}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	data := withOrientation(buf.Bytes(), 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("jpegOrientation = %d, want 6", got)
+	}
+
+	covers, err := processCover(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("processCover: %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(covers[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds().Size(), (image.Point{20, 40}); got != want {
+		t.Fatalf("got size %v, want %v", got, want)
+	}
+	if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+		t.Errorf("top of rotated image is not red: %v", img.At(10, 5))
+	}
+	if bytes.Contains(covers[0].Data, []byte("Exif")) {
+		t.Errorf("processed cover still contains EXIF data")
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.White)
+	for o, want := range map[int]struct {
+		size  image.Point
+		white image.Point
+	}{
+		1: {image.Point{2, 1}, image.Point{0, 0}},
+		2: {image.Point{2, 1}, image.Point{1, 0}},
+		3: {image.Point{2, 1}, image.Point{1, 0}},
+		4: {image.Point{2, 1}, image.Point{0, 0}},
+		5: {image.Point{1, 2}, image.Point{0, 0}},
+		6: {image.Point{1, 2}, image.Point{0, 0}},
+		7: {image.Point{1, 2}, image.Point{0, 1}},
+		8: {image.Point{1, 2}, image.Point{0, 1}},
+	} {
+		got := applyOrientation(src, o)
+		if got.Bounds().Size() != want.size {
+			t.Errorf("orientation %d: got size %v, want %v", o, got.Bounds().Size(), want.size)
+			continue
+		}
+		if r, _, _, _ := got.At(want.white.X, want.white.Y).RGBA(); r != 0xffff {
+			t.Errorf("orientation %d: pixel %v is not white", o, want.white)
+		}
+	}
+}
+
+func solidImage(w, h int, c color.Color) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// withOrientation inserts an EXIF segment with the given orientation after
+// the start-of-image marker of the JPEG data b.
+func withOrientation(b []byte, orientation int) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))                        // offset of IFD0
+	binary.Write(&tiff, binary.BigEndian, uint16(1))                        // one entry
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})              // Orientation, SHORT
+	binary.Write(&tiff, binary.BigEndian, uint32(1))                        // count
+	binary.Write(&tiff, binary.BigEndian, []uint16{uint16(orientation), 0}) // value
+	binary.Write(&tiff, binary.BigEndian, uint32(0))                        // no next IFD
+
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(b[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(seg)+2))
+	out.Write(seg)
+	out.Write(b[2:])
+	return out.Bytes()
+}
+
+func TestReleaseCovers(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "novelshelf-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	images, err := newLocalImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Novelshelf{DB: newMemoryDB(), Images: images, logWriter: ioutil.Discard}
+	const (
+		shared   = "6ba7b810-9dad-11d1-80b4-00c04fd430c8-full.jpg"
+		trashed  = "6ba7b811-9dad-11d1-80b4-00c04fd430c8-full.jpg"
+		released = "6ba7b812-9dad-11d1-80b4-00c04fd430c8-full.jpg"
+	)
+	for _, name := range []string{shared, trashed, released} {
+		if err := images.Put(ctx, name, strings.NewReader("x"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another user's novel refers to the same cover, and so does a novel
+	// in the trash.
+	if _, err := n.DB.AddNovel(ctx, &Novel{Title: "門", ImageURL: images.URL(shared)}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := n.DB.AddNovel(ctx, &Novel{Title: "行人", ImageURL: images.URL(trashed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DB.DeleteNovel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	n.releaseCovers(ctx, &Novel{ImageURL: images.URL(shared), ThumbnailURL: images.URL(trashed)}, nil)
+	n.releaseCovers(ctx, &Novel{ImageURL: images.URL(released)}, nil)
+	for name, want := range map[string]bool{shared: true, trashed: true, released: false} {
+		rc, _, err := images.Get(ctx, name)
+		if err == nil {
+			rc.Close()
+		}
+		if got := err == nil; got != want {
+			t.Errorf("%s kept: got %v, want %v (err %v)", name, got, want, err)
+		}
+	}
+}
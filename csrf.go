@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// newCSRF returns the middleware that checks CSRF tokens, with its cookie
+// signed by a key derived from key like the session cookie. Requests that
+// fail the check are passed to errorHandler.
+func newCSRF(key string, secure bool, errorHandler http.Handler) func(http.Handler) http.Handler {
+	authKey := securecookie.GenerateRandomKey(32)
+	if key != "" {
+		k := sha256.Sum256([]byte("novelshelf csrf:" + key))
+		authKey = k[:]
+	}
+	return csrf.Protect(authKey,
+		csrf.Path("/"),
+		csrf.MaxAge(sessionMaxAge),
+		csrf.Secure(secure),
+		csrf.SameSite(csrf.SameSiteLaxMode),
+		csrf.ErrorHandler(errorHandler),
+	)
+}
+
+// apiMediaTypes are the types of request bodies the API accepts. None of
+// them can be sent by a form.
+var apiMediaTypes = map[string]bool{
+	"application/json":             true,
+	"application/merge-patch+json": true,
+	"text/csv":                     true,
+	"application/x-ndjson":         true,
+}
+
+// csrfMiddleware rejects POST and PUT requests to pages that do not carry
+// the CSRF token issued with the form they were sent from; see the
+// csrfField template function.
+//
+// The API is exempt from tokens. Instead it only accepts the bodies in
+// apiMediaTypes, which browsers do not send to another site without a CORS
+// preflight, and Novelshelf never allows one.
+func (n *Novelshelf) csrfMiddleware(next http.Handler) http.Handler {
+	protected := n.csrf(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.ContentLength != 0 && !apiMediaTypes[t] {
+				writeAPIError(w, http.StatusUnsupportedMediaType, "request body must be JSON, or CSV or JSON Lines for imports", nil)
+				return
+			}
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
+
+// csrfErrorHandler explains a failed CSRF check. It is most often seen by
+// someone submitting a form they opened before their session expired.
+func (n *Novelshelf) csrfErrorHandler(w http.ResponseWriter, r *http.Request) *appError {
+	err := fmt.Errorf("csrf: %v: %w", csrf.FailureReason(r), ErrForbidden)
+	return n.appErrorf(r, err, "this form has expired or was sent from another site; go back, reload the page and try again")
+}
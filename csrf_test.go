@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	bodyContains(t, wt, "/novels/add", `name="gorilla.csrf.Token"`)
+	bodyContains(t, wt, "/login", `name="gorilla.csrf.Token"`)
+
+	// A client with wt's session but without its transport sends no token,
+	// as a form posted from another site would.
+	bare := &http.Client{Jar: wt.Client.Jar}
+	post := func(path, token string) (*http.Response, string) {
+		t.Helper()
+		form := url.Values{"title": {"forged"}}
+		if token != "" {
+			form.Set("gorilla.csrf.Token", token)
+		}
+		resp, err := bare.PostForm(serv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+	for _, tc := range []struct {
+		path, token string
+	}{
+		{"/novels", ""},
+		{"/novels", "bm90IGEgdG9rZW4"},
+		{"/login", ""},
+		{"/logout", ""},
+	} {
+		resp, body := post(tc.path, tc.token)
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "expired") {
+			t.Errorf("POST %s with token %q: got status %d, want %d", tc.path, tc.token, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	bodyContains(t, wt, "/", "Log out")
+
+	// The API needs no token, but only takes JSON.
+	resp, err := bare.Post(serv.URL+"/api/v1/novels", "text/plain", strings.NewReader(`{"title": "forged"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("API POST with text/plain: got status %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+	resp, err = bare.Post(serv.URL+"/api/v1/novels", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("API POST with JSON: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"context"
 	"fmt"
 	"google.golang.org/api/iterator"
-	"log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
 )
 
 type firestoreDB struct {
@@ -13,6 +15,8 @@ type firestoreDB struct {
 }
 
 var _ NovelDatabase = &firestoreDB{}
+var _ UserDatabase = &firestoreDB{}
+var _ HistoryDatabase = &firestoreDB{}
 
 func newFirestoreDB(client *firestore.Client) (*firestoreDB, error) {
 	ctx := context.Background()
@@ -42,42 +46,521 @@ func (db *firestoreDB) ListNovels(ctx context.Context) ([]*Novel, error) {
 			return nil, fmt.Errorf("firestoredb: could not list novels: %v", err)
 		}
 		n := &Novel{}
-		doc.DataTo(n)
-		log.Printf("Novel %q ID: %q", n.Title, n.ID)
+		if err := doc.DataTo(n); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not decode novel %q: %v", doc.Ref.ID, err)
+		}
 		novels = append(novels, n)
 	}
 	return novels, nil
 }
 
+// ListNovelsPage lists one page of novels. Filtering by author, owner or
+// year combined with a sort order needs a composite index on the filtered
+// and sorted fields; Firestore reports the index to create in the error.
+func (db *firestoreDB) ListNovelsPage(ctx context.Context, opts ListOptions) (*NovelPage, error) {
+	opts = opts.normalize()
+	c, err := decodeCursor(opts)
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: %v", err)
+	}
+
+	dir := firestore.Asc
+	if opts.Descending {
+		dir = firestore.Desc
+	}
+	q := db.client.Collection("novels").Query
+	if opts.Author != "" {
+		q = q.Where("Author", "==", opts.Author)
+	}
+	if opts.CreatedBy != "" {
+		q = q.Where("CreatedBy", "==", opts.CreatedBy)
+	}
+	if lo, hi := opts.publishedRange(); lo != "" {
+		q = q.Where("PublishedDate", ">=", lo).Where("PublishedDate", "<", hi)
+	}
+	q = q.OrderBy(opts.Sort.firestoreField(), dir).OrderBy(firestore.DocumentID, dir)
+
+	// One extra document is fetched to find out whether there is another
+	// page beyond this one.
+	switch {
+	case c == nil:
+		q = q.Limit(opts.PageSize + 1)
+	default:
+		key, err := c.firestoreValue()
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: %v", err)
+		}
+		if c.Before {
+			q = q.EndBefore(key, c.ID).LimitToLast(opts.PageSize + 1)
+		} else {
+			q = q.StartAfter(key, c.ID).Limit(opts.PageSize + 1)
+		}
+	}
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list novels: %v", err)
+	}
+	novels := make([]*Novel, 0, len(docs))
+	for _, doc := range docs {
+		n := &Novel{}
+		if err := doc.DataTo(n); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not decode novel %q: %v", doc.Ref.ID, err)
+		}
+		n.ID = doc.Ref.ID
+		novels = append(novels, n)
+	}
+
+	more := len(novels) > opts.PageSize
+	page := &NovelPage{}
+	if c != nil && c.Before {
+		if more {
+			novels = novels[1:]
+		}
+		page.Novels = novels
+		if len(novels) > 0 {
+			if more {
+				page.PrevCursor = cursorBefore(opts, novels[0])
+			}
+			page.NextCursor = cursorAfter(opts, novels[len(novels)-1])
+		}
+		return page, nil
+	}
+	if more {
+		novels = novels[:opts.PageSize]
+	}
+	page.Novels = novels
+	if len(novels) > 0 {
+		if c != nil {
+			page.PrevCursor = cursorBefore(opts, novels[0])
+		}
+		if more {
+			page.NextCursor = cursorAfter(opts, novels[len(novels)-1])
+		}
+	}
+	return page, nil
+}
+
 func (db *firestoreDB) GetNovel(ctx context.Context, id string) (*Novel, error) {
 	ds, err := db.client.Collection("novels").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("firestoredb: Get %q: %w", id, ErrNotFound)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("firestoredb: Get: %v", err)
 	}
 	n := &Novel{}
-	ds.DataTo(n)
+	if err := ds.DataTo(n); err != nil {
+		return nil, fmt.Errorf("firestoredb: could not decode novel %q: %v", id, err)
+	}
 	return n, nil
 }
 
 func (db *firestoreDB) AddNovel(ctx context.Context, n *Novel) (id string, err error) {
 	ref := db.client.Collection("novels").NewDoc()
 	n.ID = ref.ID
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = time.Now()
+	}
+	if n.Version == 0 {
+		n.Version = 1
+	}
 	if _, err := ref.Create(ctx, n); err != nil {
 		return "", fmt.Errorf("create: %v", err)
 	}
 	return ref.ID, nil
 }
 
+// AddNovels adds novels in batched writes of up to maxNovelBatch novels.
+func (db *firestoreDB) AddNovels(ctx context.Context, novels []*Novel) ([]string, error) {
+	var ids []string
+	for start := 0; start < len(novels); start += maxNovelBatch {
+		end := start + maxNovelBatch
+		if end > len(novels) {
+			end = len(novels)
+		}
+		batch := db.client.Batch()
+		for _, n := range novels[start:end] {
+			ref := db.client.Collection("novels").NewDoc()
+			n.ID = ref.ID
+			if n.CreatedAt.IsZero() {
+				n.CreatedAt = time.Now()
+			}
+			if n.Version == 0 {
+				n.Version = 1
+			}
+			batch.Create(ref, n)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return ids, fmt.Errorf("firestoredb: could not add novels: %v", err)
+		}
+		for _, n := range novels[start:end] {
+			ids = append(ids, n.ID)
+		}
+	}
+	return ids, nil
+}
+
+// PutNovels sets the documents of novels in the "trash" collection if they
+// are deleted and in "novels" if not, and deletes them from the other
+// collection. As that takes two writes per novel, a batch holds half as
+// many novels as in AddNovels.
+func (db *firestoreDB) PutNovels(ctx context.Context, novels []*Novel) error {
+	const size = maxNovelBatch / 2
+	for start := 0; start < len(novels); start += size {
+		end := start + size
+		if end > len(novels) {
+			end = len(novels)
+		}
+		batch := db.client.Batch()
+		for _, n := range novels[start:end] {
+			if n.ID == "" {
+				return fmt.Errorf("firestoredb: novel %q has no ID", n.Title)
+			}
+			to, from := "novels", "trash"
+			if n.DeletedAt != nil {
+				to, from = from, to
+			}
+			batch.Set(db.client.Collection(to).Doc(n.ID), n)
+			batch.Delete(db.client.Collection(from).Doc(n.ID))
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("firestoredb: could not put novels: %v", err)
+		}
+	}
+	return nil
+}
+
+// DeleteNovel moves the novel to the "trash" collection, so that queries
+// of the "novels" collection, including those written before the trash
+// existed, need no filter to leave it out.
 func (db *firestoreDB) DeleteNovel(ctx context.Context, id string) error {
-	if _, err := db.client.Collection("novels").Doc(id).Delete(ctx); err != nil {
-		return fmt.Errorf("firestore: delete: %v", err)
+	err := db.moveNovel(ctx, id, "novels", "trash", func(n *Novel) {
+		now := time.Now()
+		n.DeletedAt = &now
+	})
+	if err != nil {
+		return fmt.Errorf("firestore: delete: %w", err)
+	}
+	return nil
+}
+
+// moveNovel moves novel id from collection from to collection to, changed
+// by change.
+func (db *firestoreDB) moveNovel(ctx context.Context, id, from, to string, change func(n *Novel)) error {
+	src := db.client.Collection(from).Doc(id)
+	dst := db.client.Collection(to).Doc(id)
+	return db.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		ds, err := t.Get(src)
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("%q: %w", id, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		n := &Novel{}
+		if err := ds.DataTo(n); err != nil {
+			return err
+		}
+		change(n)
+		if err := t.Set(dst, n); err != nil {
+			return err
+		}
+		return t.Delete(src)
+	})
+}
+
+func (db *firestoreDB) ListTrash(ctx context.Context) ([]*Novel, error) {
+	docs, err := db.client.Collection("trash").OrderBy("DeletedAt", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list trash: %v", err)
+	}
+	novels := make([]*Novel, 0, len(docs))
+	for _, doc := range docs {
+		n := &Novel{}
+		if err := doc.DataTo(n); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not decode novel %q: %v", doc.Ref.ID, err)
+		}
+		novels = append(novels, n)
+	}
+	return novels, nil
+}
+
+func (db *firestoreDB) GetTrashedNovel(ctx context.Context, id string) (*Novel, error) {
+	ds, err := db.client.Collection("trash").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("firestoredb: get trashed %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: get trashed: %v", err)
+	}
+	n := &Novel{}
+	if err := ds.DataTo(n); err != nil {
+		return nil, fmt.Errorf("firestoredb: get trashed: %v", err)
+	}
+	return n, nil
+}
+
+func (db *firestoreDB) RestoreNovel(ctx context.Context, id string) (*Novel, error) {
+	err := db.moveNovel(ctx, id, "trash", "novels", func(n *Novel) {
+		n.DeletedAt = nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("firestore: restore: %w", err)
+	}
+	return db.GetNovel(ctx, id)
+}
+
+func (db *firestoreDB) PurgeNovel(ctx context.Context, id string) error {
+	_, err := db.client.Collection("trash").Doc(id).Delete(ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("firestore: purge %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("firestore: purge: %v", err)
 	}
 	return nil
 }
 
 func (db *firestoreDB) UpdateNovel(ctx context.Context, n *Novel) error {
-	if _, err := db.client.Collection("novels").Doc(n.ID).Set(ctx, n); err != nil {
-		return fmt.Errorf("firestore: set: %v", err)
+	ref := db.client.Collection("novels").Doc(n.ID)
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		ds, err := t.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("%q: %w", n.ID, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		cur := &Novel{}
+		if err := ds.DataTo(cur); err != nil {
+			return err
+		}
+		if cur.Version != n.Version {
+			return fmt.Errorf("%q is at version %d, not %d: %w", n.ID, cur.Version, n.Version, ErrConflict)
+		}
+		// The transaction may be retried, so n is only changed once it
+		// has committed.
+		next := *n
+		next.Version++
+		return t.Set(ref, &next)
+	})
+	if err != nil {
+		return fmt.Errorf("firestore: update: %w", err)
 	}
+	n.Version++
 	return nil
 }
+
+// PatchNovel updates only the paths of the patched fields, so that fields
+// written by others in the meantime are kept.
+func (db *firestoreDB) PatchNovel(ctx context.Context, id string, p NovelPatch) (*Novel, error) {
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("firestore: patch: %v", err)
+	}
+	ref := db.client.Collection("novels").Doc(id)
+	var saved *Novel
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		ds, err := t.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("%q: %w", id, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		cur := &Novel{}
+		if err := ds.DataTo(cur); err != nil {
+			return err
+		}
+		if p.Version != 0 && cur.Version != p.Version {
+			return fmt.Errorf("%q is at version %d, not %d: %w", id, cur.Version, p.Version, ErrConflict)
+		}
+		updates := []firestore.Update{{Path: "Version", Value: cur.Version + 1}}
+		for _, name := range p.names() {
+			f, _ := lookupNovelField(name)
+			updates = append(updates, firestore.Update{Path: f.goName, Value: p.Fields[name]})
+		}
+		p.apply(cur)
+		cur.Version++
+		saved = cur
+		return t.Update(ref, updates)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("firestore: patch: %w", err)
+	}
+	return saved, nil
+}
+
+func (db *firestoreDB) GetUser(ctx context.Context, id string) (*User, error) {
+	ds, err := db.client.Collection("users").Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("firestoredb: get user %q: %w", id, ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: get user: %v", err)
+	}
+	u := &User{}
+	if err := ds.DataTo(u); err != nil {
+		return nil, fmt.Errorf("firestoredb: get user: %v", err)
+	}
+	u.ID = ds.Ref.ID
+	return u, nil
+}
+
+// findUser returns the first user matched by q.
+func (db *firestoreDB) findUser(ctx context.Context, q firestore.Query, desc string) (*User, error) {
+	docs, err := q.Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: find user %s: %v", desc, err)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("firestoredb: user %s: %w", desc, ErrUserNotFound)
+	}
+	u := &User{}
+	if err := docs[0].DataTo(u); err != nil {
+		return nil, fmt.Errorf("firestoredb: find user %s: %v", desc, err)
+	}
+	u.ID = docs[0].Ref.ID
+	return u, nil
+}
+
+func (db *firestoreDB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	email = normalizeEmail(email)
+	return db.findUser(ctx, db.client.Collection("users").Where("Email", "==", email), fmt.Sprintf("with email %q", email))
+}
+
+func (db *firestoreDB) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("firestoredb: user with empty subject: %w", ErrUserNotFound)
+	}
+	q := db.client.Collection("users").Where("Provider", "==", provider).Where("Subject", "==", subject)
+	return db.findUser(ctx, q, fmt.Sprintf("%q at %q", subject, provider))
+}
+
+// checkUserUnique returns ErrUserExists if a user other than u has u's
+// email address or identity.
+func (db *firestoreDB) checkUserUnique(t *firestore.Transaction, u *User) error {
+	users := db.client.Collection("users")
+	queries := []firestore.Query{users.Where("Email", "==", u.Email)}
+	if u.Subject != "" {
+		queries = append(queries, users.Where("Provider", "==", u.Provider).Where("Subject", "==", u.Subject))
+	}
+	for _, q := range queries {
+		docs, err := t.Documents(q).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, d := range docs {
+			if d.Ref.ID != u.ID {
+				return fmt.Errorf("firestoredb: %q: %w", u.Email, ErrUserExists)
+			}
+		}
+	}
+	return nil
+}
+
+func (db *firestoreDB) AddUser(ctx context.Context, u *User) (string, error) {
+	u.Email = normalizeEmail(u.Email)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	ref := db.client.Collection("users").NewDoc()
+	u.ID = ref.ID
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		if err := db.checkUserUnique(t, u); err != nil {
+			return err
+		}
+		return t.Create(ref, u)
+	})
+	if err != nil {
+		return "", fmt.Errorf("firestoredb: add user: %w", err)
+	}
+	return u.ID, nil
+}
+
+func (db *firestoreDB) UpdateUser(ctx context.Context, u *User) error {
+	u.Email = normalizeEmail(u.Email)
+	ref := db.client.Collection("users").Doc(u.ID)
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		if _, err := t.Get(ref); status.Code(err) == codes.NotFound {
+			return fmt.Errorf("%q: %w", u.ID, ErrUserNotFound)
+		} else if err != nil {
+			return err
+		}
+		if err := db.checkUserUnique(t, u); err != nil {
+			return err
+		}
+		return t.Set(ref, u)
+	})
+	if err != nil {
+		return fmt.Errorf("firestoredb: update user: %w", err)
+	}
+	return nil
+}
+
+func (db *firestoreDB) ListUsers(ctx context.Context) ([]*User, error) {
+	docs, err := db.client.Collection("users").OrderBy("Email", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list users: %v", err)
+	}
+	users := make([]*User, 0, len(docs))
+	for _, doc := range docs {
+		u := &User{}
+		if err := doc.DataTo(u); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not decode user %q: %v", doc.Ref.ID, err)
+		}
+		u.ID = doc.Ref.ID
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// revisions returns the collection of the revisions of a novel, which is
+// kept when the novel's document is deleted.
+func (db *firestoreDB) revisions(novelID string) *firestore.CollectionRef {
+	return db.client.Collection("novels").Doc(novelID).Collection("revisions")
+}
+
+func (db *firestoreDB) AddRevision(ctx context.Context, rev *Revision) error {
+	ref := db.revisions(rev.NovelID).NewDoc()
+	rev.ID = ref.ID
+	if rev.At.IsZero() {
+		rev.At = time.Now()
+	}
+	if _, err := ref.Create(ctx, rev); err != nil {
+		return fmt.Errorf("firestoredb: could not add revision: %v", err)
+	}
+	return nil
+}
+
+func (db *firestoreDB) ListRevisions(ctx context.Context, novelID string) ([]*Revision, error) {
+	docs, err := db.revisions(novelID).OrderBy("At", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list revisions: %v", err)
+	}
+	revs := make([]*Revision, 0, len(docs))
+	for _, doc := range docs {
+		rev := &Revision{}
+		if err := doc.DataTo(rev); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not decode revision %q: %v", doc.Ref.ID, err)
+		}
+		rev.ID = doc.Ref.ID
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+func (db *firestoreDB) GetRevision(ctx context.Context, novelID, id string) (*Revision, error) {
+	ds, err := db.revisions(novelID).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("firestoredb: revision %q of novel %q: %w", id, novelID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: get revision: %v", err)
+	}
+	rev := &Revision{}
+	if err := ds.DataTo(rev); err != nil {
+		return nil, fmt.Errorf("firestoredb: get revision: %v", err)
+	}
+	rev.ID = ds.Ref.ID
+	return rev, nil
+}
@@ -6,20 +6,33 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
 var _ NovelDatabase = &memoryDB{}
+var _ UserDatabase = &memoryDB{}
+var _ HistoryDatabase = &memoryDB{}
 
 type memoryDB struct {
 	mu     sync.Mutex
 	nextID int64
 	novels map[string]*Novel
+
+	nextUserID int64
+	users      map[string]*User
+
+	nextRevisionID int64
+	revisions      map[string][]*Revision // by novel ID, oldest first
 }
 
 func newMemoryDB() *memoryDB {
 	return &memoryDB{
-		novels: make(map[string]*Novel),
-		nextID: 1,
+		novels:         make(map[string]*Novel),
+		nextID:         1,
+		users:          make(map[string]*User),
+		nextUserID:     1,
+		revisions:      make(map[string][]*Revision),
+		nextRevisionID: 1,
 	}
 }
 
@@ -36,7 +49,9 @@ func (db *memoryDB) ListNovels(ctx context.Context) ([]*Novel, error) {
 
 	var novels []*Novel
 	for _, n := range db.novels {
-		novels = append(novels, n)
+		if n.DeletedAt == nil {
+			novels = append(novels, n)
+		}
 	}
 	sort.Slice(novels, func(i, j int) bool {
 		return novels[i].Title < novels[j].Title
@@ -44,13 +59,63 @@ func (db *memoryDB) ListNovels(ctx context.Context) ([]*Novel, error) {
 	return novels, nil
 }
 
+func (db *memoryDB) ListNovelsPage(ctx context.Context, opts ListOptions) (*NovelPage, error) {
+	opts = opts.normalize()
+	c, err := decodeCursor(opts)
+	if err != nil {
+		return nil, fmt.Errorf("memorydb: %v", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var novels []*Novel
+	for _, n := range db.novels {
+		if n.DeletedAt == nil && opts.matches(n) {
+			novels = append(novels, n)
+		}
+	}
+	sort.Slice(novels, func(i, j int) bool {
+		return compareNovels(opts, novels[i], novels[j]) < 0
+	})
+
+	// start and end delimit the page within the sorted slice.
+	start, end := 0, len(novels)
+	switch {
+	case c == nil:
+	case c.Before:
+		end = sort.Search(len(novels), func(i int) bool { return c.compare(opts, novels[i]) >= 0 })
+		start = end - opts.PageSize
+		if start < 0 {
+			start = 0
+		}
+	default:
+		start = sort.Search(len(novels), func(i int) bool { return c.compare(opts, novels[i]) > 0 })
+	}
+	if c == nil || !c.Before {
+		end = start + opts.PageSize
+		if end > len(novels) {
+			end = len(novels)
+		}
+	}
+
+	page := &NovelPage{Novels: novels[start:end]}
+	if start > 0 && start < end {
+		page.PrevCursor = cursorBefore(opts, novels[start])
+	}
+	if end < len(novels) && start < end {
+		page.NextCursor = cursorAfter(opts, novels[end-1])
+	}
+	return page, nil
+}
+
 func (db *memoryDB) GetNovel(_ context.Context, id string) (*Novel, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	novel, ok := db.novels[id]
-	if !ok {
-		return nil, fmt.Errorf("memorydb: novel not found with ID %q", id)
+	if !ok || novel.DeletedAt != nil {
+		return nil, fmt.Errorf("memorydb: novel with ID %q: %w", id, ErrNotFound)
 	}
 	return novel, nil
 }
@@ -58,13 +123,52 @@ func (db *memoryDB) GetNovel(_ context.Context, id string) (*Novel, error) {
 func (db *memoryDB) AddNovel(ctx context.Context, n *Novel) (id string, err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	return db.addNovel(n), nil
+}
+
+func (db *memoryDB) AddNovels(ctx context.Context, novels []*Novel) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ids := make([]string, len(novels))
+	for i, n := range novels {
+		ids[i] = db.addNovel(n)
+	}
+	return ids, nil
+}
+
+func (db *memoryDB) PutNovels(ctx context.Context, novels []*Novel) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, n := range novels {
+		if n.ID == "" {
+			return fmt.Errorf("memorydb: novel %q has no ID", n.Title)
+		}
+	}
+	for _, n := range novels {
+		c := *n
+		db.novels[n.ID] = &c
+		// Keep new IDs clear of the numeric IDs of the copies.
+		if id, err := strconv.ParseInt(n.ID, 10, 64); err == nil && id >= db.nextID {
+			db.nextID = id + 1
+		}
+	}
+	return nil
+}
 
+// addNovel stores n under a new ID. The caller must hold db.mu.
+func (db *memoryDB) addNovel(n *Novel) string {
 	n.ID = strconv.FormatInt(db.nextID, 10)
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = time.Now()
+	}
+	if n.Version == 0 {
+		n.Version = 1
+	}
 	db.novels[n.ID] = n
 
 	db.nextID++
 
-	return n.ID, nil
+	return n.ID
 }
 
 func (db *memoryDB) DeleteNovel(ctx context.Context, id string) error {
@@ -75,8 +179,67 @@ func (db *memoryDB) DeleteNovel(ctx context.Context, id string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if _, ok := db.novels[id]; !ok {
-		return fmt.Errorf("memorydb: could not delete novel with ID %q, does not exist", id)
+	old, ok := db.novels[id]
+	if !ok || old.DeletedAt != nil {
+		return fmt.Errorf("memorydb: could not delete novel with ID %q: %w", id, ErrNotFound)
+	}
+	n := *old
+	now := time.Now()
+	n.DeletedAt = &now
+	db.novels[id] = &n
+	return nil
+}
+
+func (db *memoryDB) ListTrash(ctx context.Context) ([]*Novel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var novels []*Novel
+	for _, n := range db.novels {
+		if n.DeletedAt != nil {
+			c := *n
+			novels = append(novels, &c)
+		}
+	}
+	sort.Slice(novels, func(i, j int) bool {
+		return novels[i].DeletedAt.After(*novels[j].DeletedAt)
+	})
+	return novels, nil
+}
+
+func (db *memoryDB) GetTrashedNovel(ctx context.Context, id string) (*Novel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n, ok := db.novels[id]
+	if !ok || n.DeletedAt == nil {
+		return nil, fmt.Errorf("memorydb: trashed novel with ID %q: %w", id, ErrNotFound)
+	}
+	c := *n
+	return &c, nil
+}
+
+func (db *memoryDB) RestoreNovel(ctx context.Context, id string) (*Novel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, ok := db.novels[id]
+	if !ok || old.DeletedAt == nil {
+		return nil, fmt.Errorf("memorydb: could not restore novel with ID %q: %w", id, ErrNotFound)
+	}
+	n := *old
+	n.DeletedAt = nil
+	db.novels[id] = &n
+	c := n
+	return &c, nil
+}
+
+func (db *memoryDB) PurgeNovel(ctx context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if n, ok := db.novels[id]; !ok || n.DeletedAt == nil {
+		return fmt.Errorf("memorydb: could not purge novel with ID %q: %w", id, ErrNotFound)
 	}
 	delete(db.novels, id)
 	return nil
@@ -89,6 +252,163 @@ func (db *memoryDB) UpdateNovel(ctx context.Context, n *Novel) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	old, ok := db.novels[n.ID]
+	if !ok || old.DeletedAt != nil {
+		return fmt.Errorf("memorydb: could not update novel with ID %q: %w", n.ID, ErrNotFound)
+	}
+	if old.Version != n.Version {
+		return fmt.Errorf("memorydb: novel %q is at version %d, not %d: %w", n.ID, old.Version, n.Version, ErrConflict)
+	}
+	n.Version++
 	db.novels[n.ID] = n
 	return nil
 }
+
+// PatchNovel merges the patched fields into a copy of the stored novel.
+func (db *memoryDB) PatchNovel(ctx context.Context, id string, p NovelPatch) (*Novel, error) {
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("memorydb: %v", err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, ok := db.novels[id]
+	if !ok || old.DeletedAt != nil {
+		return nil, fmt.Errorf("memorydb: could not patch novel with ID %q: %w", id, ErrNotFound)
+	}
+	if p.Version != 0 && old.Version != p.Version {
+		return nil, fmt.Errorf("memorydb: novel %q is at version %d, not %d: %w", id, old.Version, p.Version, ErrConflict)
+	}
+	n := *old
+	p.apply(&n)
+	n.Version++
+	db.novels[id] = &n
+	c := n
+	return &c, nil
+}
+
+// findUser returns the first user f accepts. The caller must hold db.mu.
+func (db *memoryDB) findUser(f func(u *User) bool) (*User, bool) {
+	for _, u := range db.users {
+		if f(u) {
+			c := *u
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+func (db *memoryDB) GetUser(ctx context.Context, id string) (*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.users[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: user with ID %q: %w", id, ErrUserNotFound)
+	}
+	c := *u
+	return &c, nil
+}
+
+func (db *memoryDB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	email = normalizeEmail(email)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.findUser(func(u *User) bool { return u.Email == email })
+	if !ok {
+		return nil, fmt.Errorf("memorydb: user with email %q: %w", email, ErrUserNotFound)
+	}
+	return u, nil
+}
+
+func (db *memoryDB) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.findUser(func(u *User) bool { return subject != "" && u.Provider == provider && u.Subject == subject })
+	if !ok {
+		return nil, fmt.Errorf("memorydb: user %q at %q: %w", subject, provider, ErrUserNotFound)
+	}
+	return u, nil
+}
+
+func (db *memoryDB) AddUser(ctx context.Context, u *User) (string, error) {
+	u.Email = normalizeEmail(u.Email)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, taken := db.findUser(func(o *User) bool { return o.Email == u.Email || sameIdentity(o, u) }); taken {
+		return "", fmt.Errorf("memorydb: %q: %w", u.Email, ErrUserExists)
+	}
+	u.ID = strconv.FormatInt(db.nextUserID, 10)
+	db.nextUserID++
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	c := *u
+	db.users[u.ID] = &c
+	return u.ID, nil
+}
+
+func (db *memoryDB) UpdateUser(ctx context.Context, u *User) error {
+	u.Email = normalizeEmail(u.Email)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[u.ID]; !ok {
+		return fmt.Errorf("memorydb: user with ID %q: %w", u.ID, ErrUserNotFound)
+	}
+	if _, taken := db.findUser(func(o *User) bool { return o.ID != u.ID && (o.Email == u.Email || sameIdentity(o, u)) }); taken {
+		return fmt.Errorf("memorydb: %q: %w", u.Email, ErrUserExists)
+	}
+	c := *u
+	db.users[u.ID] = &c
+	return nil
+}
+
+func (db *memoryDB) ListUsers(ctx context.Context) ([]*User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	users := make([]*User, 0, len(db.users))
+	for _, u := range db.users {
+		c := *u
+		users = append(users, &c)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+	return users, nil
+}
+
+func (db *memoryDB) AddRevision(ctx context.Context, rev *Revision) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rev.ID = strconv.FormatInt(db.nextRevisionID, 10)
+	db.nextRevisionID++
+	if rev.At.IsZero() {
+		rev.At = time.Now()
+	}
+	c := *rev
+	db.revisions[rev.NovelID] = append(db.revisions[rev.NovelID], &c)
+	return nil
+}
+
+func (db *memoryDB) ListRevisions(ctx context.Context, novelID string) ([]*Revision, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	revs := db.revisions[novelID]
+	list := make([]*Revision, 0, len(revs))
+	for i := len(revs) - 1; i >= 0; i-- {
+		c := *revs[i]
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (db *memoryDB) GetRevision(ctx context.Context, novelID, id string) (*Revision, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, rev := range db.revisions[novelID] {
+		if rev.ID == id {
+			c := *rev
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("memorydb: revision %q of novel %q: %w", id, novelID, ErrNotFound)
+}
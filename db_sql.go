@@ -0,0 +1,820 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlMigrations are applied in order by newSQLDB; the schema version is the
+// number of migrations applied. Append to this list to change the schema,
+// never edit an entry that has shipped. Statements must work in both SQLite
+// and PostgreSQL.
+var sqlMigrations = []string{
+	`CREATE TABLE novels (
+		id             TEXT PRIMARY KEY,
+		title          TEXT NOT NULL,
+		author         TEXT NOT NULL DEFAULT '',
+		published_date TEXT NOT NULL DEFAULT '',
+		image_url      TEXT NOT NULL DEFAULT '',
+		description    TEXT NOT NULL DEFAULT '',
+		created_at     TIMESTAMP NOT NULL,
+		isbn10         TEXT NOT NULL DEFAULT '',
+		isbn13         TEXT NOT NULL DEFAULT '',
+		publisher      TEXT NOT NULL DEFAULT '',
+		page_count     INTEGER NOT NULL DEFAULT 0,
+		language       TEXT NOT NULL DEFAULT '',
+		genres         TEXT NOT NULL DEFAULT '[]',
+		series         TEXT NOT NULL DEFAULT '',
+		volume         INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX novels_title ON novels (title, id)`,
+	`CREATE INDEX novels_author ON novels (author, id)`,
+	`CREATE INDEX novels_published_date ON novels (published_date, id)`,
+	`CREATE INDEX novels_created_at ON novels (created_at, id)`,
+	`ALTER TABLE novels ADD COLUMN thumbnail_url TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE users (
+		id            TEXT PRIMARY KEY,
+		email         TEXT NOT NULL UNIQUE,
+		name          TEXT NOT NULL DEFAULT '',
+		password_hash TEXT NOT NULL DEFAULT '',
+		provider      TEXT NOT NULL DEFAULT '',
+		subject       TEXT NOT NULL DEFAULT '',
+		created_at    TIMESTAMP NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX users_identity ON users (provider, subject) WHERE subject <> ''`,
+	`ALTER TABLE novels ADD COLUMN created_by TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX novels_created_by ON novels (created_by, id)`,
+	`ALTER TABLE users ADD COLUMN admin BOOLEAN NOT NULL DEFAULT FALSE`,
+	// role supersedes the admin column, which is no longer read. Existing
+	// users keep what they could do before roles.
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'editor'`,
+	`UPDATE users SET role = 'admin' WHERE admin`,
+	`ALTER TABLE novels ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	// Revisions have no foreign key on novels so that they outlive them.
+	`CREATE TABLE revisions (
+		id         TEXT PRIMARY KEY,
+		novel_id   TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		action     TEXT NOT NULL,
+		user_id    TEXT NOT NULL DEFAULT '',
+		user_name  TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		changes    TEXT NOT NULL DEFAULT '[]',
+		novel      TEXT NOT NULL
+	)`,
+	`CREATE INDEX revisions_novel_id ON revisions (novel_id, created_at)`,
+	// deleted_at is set while a novel is in the trash. It is not one of
+	// novelColumns: queries of live novels require it to be NULL.
+	`ALTER TABLE novels ADD COLUMN deleted_at TIMESTAMP`,
+	`CREATE INDEX novels_deleted_at ON novels (deleted_at)`,
+}
+
+// novelColumns lists the columns of the novels table in the order
+// scanNovel and novelArgs use.
+const novelColumns = `id, title, author, published_date, image_url, description, created_at,
+	isbn10, isbn13, publisher, page_count, language, genres, series, volume, thumbnail_url, created_by, version`
+
+// sqlDB is a NovelDatabase backed by SQLite or PostgreSQL through
+// database/sql.
+type sqlDB struct {
+	db     *sql.DB
+	driver string
+}
+
+var _ NovelDatabase = &sqlDB{}
+var _ UserDatabase = &sqlDB{}
+var _ HistoryDatabase = &sqlDB{}
+
+// newSQLDB opens the database at dsn with driver "sqlite3" or "postgres"
+// and brings its schema up to date.
+func newSQLDB(driver, dsn string) (*sqlDB, error) {
+	switch driver {
+	case "sqlite3", "postgres":
+	default:
+		return nil, fmt.Errorf("sqldb: unsupported driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not open: %v", err)
+	}
+	if driver == "sqlite3" {
+		// SQLite allows a single writer; serializing access through one
+		// connection avoids "database is locked" errors.
+		db.SetMaxOpenConns(1)
+	}
+	s := &sqlDB{db: db, driver: driver}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the migrations in sqlMigrations that have not been
+// applied yet, each in its own transaction.
+func (s *sqlDB) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("sqldb: could not create schema_migrations: %v", err)
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("sqldb: could not read schema version: %v", err)
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("sqldb: migration %d: %v", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqldb: migration %d: %v", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqldb: migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("sqldb: migration %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// rebind rewrites the ? placeholders in q to the driver's syntax.
+func (s *sqlDB) rebind(q string) string {
+	if s.driver != "postgres" {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlDB) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanNovel scans a row of novelColumns, followed by the columns scanned
+// into extra, if any.
+func scanNovel(row rowScanner, extra ...interface{}) (*Novel, error) {
+	n := &Novel{}
+	var genres string
+	dest := []interface{}{&n.ID, &n.Title, &n.Author, &n.PublishedDate, &n.ImageURL, &n.Description, &n.CreatedAt,
+		&n.ISBN10, &n.ISBN13, &n.Publisher, &n.PageCount, &n.Language, &genres, &n.Series, &n.Volume, &n.ThumbnailURL, &n.CreatedBy, &n.Version}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(genres), &n.Genres); err != nil {
+		return nil, fmt.Errorf("could not decode genres of %q: %v", n.ID, err)
+	}
+	return n, nil
+}
+
+// scanTrashedNovel scans a row of novelColumns followed by deleted_at.
+func scanTrashedNovel(row rowScanner) (*Novel, error) {
+	var deletedAt time.Time
+	n, err := scanNovel(row, &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	n.DeletedAt = &deletedAt
+	return n, nil
+}
+
+// novelArgs returns the column values of n in novelColumns order.
+func novelArgs(n *Novel) ([]interface{}, error) {
+	genres := n.Genres
+	if genres == nil {
+		genres = []string{}
+	}
+	b, err := json.Marshal(genres)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{n.ID, n.Title, n.Author, string(n.PublishedDate), n.ImageURL, n.Description, n.CreatedAt.UTC(),
+		n.ISBN10, n.ISBN13, n.Publisher, n.PageCount, n.Language, string(b), n.Series, n.Volume, n.ThumbnailURL, n.CreatedBy, n.Version}, nil
+}
+
+func (s *sqlDB) ListNovels(ctx context.Context) ([]*Novel, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+novelColumns+` FROM novels WHERE deleted_at IS NULL ORDER BY title, id`)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not list novels: %v", err)
+	}
+	defer rows.Close()
+	novels := make([]*Novel, 0)
+	for rows.Next() {
+		n, err := scanNovel(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not list novels: %v", err)
+		}
+		novels = append(novels, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not list novels: %v", err)
+	}
+	return novels, nil
+}
+
+// sqlColumn returns the column f is stored in.
+func (f SortField) sqlColumn() string {
+	switch f {
+	case SortByAuthor:
+		return "author"
+	case SortByPublished:
+		return "published_date"
+	case SortByCreated:
+		return "created_at"
+	}
+	return "title"
+}
+
+func (s *sqlDB) ListNovelsPage(ctx context.Context, opts ListOptions) (*NovelPage, error) {
+	opts = opts.normalize()
+	c, err := decodeCursor(opts)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: %v", err)
+	}
+
+	where := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if opts.Author != "" {
+		where = append(where, "author = ?")
+		args = append(args, opts.Author)
+	}
+	if opts.CreatedBy != "" {
+		where = append(where, "created_by = ?")
+		args = append(args, opts.CreatedBy)
+	}
+	if lo, hi := opts.publishedRange(); lo != "" {
+		where = append(where, "published_date >= ? AND published_date < ?")
+		args = append(args, lo, hi)
+	}
+
+	// Pages before the cursor are read in reverse order and flipped
+	// afterwards, so that LIMIT keeps the rows nearest the cursor.
+	col := opts.Sort.sqlColumn()
+	reverse := c != nil && c.Before
+	desc := opts.Descending != reverse
+	if c != nil {
+		key, err := c.sqlValue()
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: %v", err)
+		}
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", col, op, col, op))
+		args = append(args, key, key, c.ID)
+	}
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+
+	q := `SELECT ` + novelColumns + ` FROM novels WHERE ` + strings.Join(where, " AND ")
+	// One extra row is fetched to find out whether there is another page
+	// beyond this one.
+	q += fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT %d`, col, dir, dir, opts.PageSize+1)
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(q), args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not list novels: %v", err)
+	}
+	defer rows.Close()
+	var novels []*Novel
+	for rows.Next() {
+		n, err := scanNovel(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not list novels: %v", err)
+		}
+		novels = append(novels, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not list novels: %v", err)
+	}
+
+	more := len(novels) > opts.PageSize
+	if more {
+		novels = novels[:opts.PageSize]
+	}
+	if reverse {
+		for i, j := 0, len(novels)-1; i < j; i, j = i+1, j-1 {
+			novels[i], novels[j] = novels[j], novels[i]
+		}
+	}
+	page := &NovelPage{Novels: novels}
+	if len(novels) == 0 {
+		return page, nil
+	}
+	if (reverse && more) || (!reverse && c != nil) {
+		page.PrevCursor = cursorBefore(opts, novels[0])
+	}
+	if reverse || more {
+		page.NextCursor = cursorAfter(opts, novels[len(novels)-1])
+	}
+	return page, nil
+}
+
+// sqlValue converts the cursor key back to the type of its sort column.
+func (c *pageCursor) sqlValue() (interface{}, error) {
+	if c.Sort != SortByCreated {
+		return c.Key, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor time %q", c.Key)
+	}
+	return t.UTC(), nil
+}
+
+func (s *sqlDB) GetNovel(ctx context.Context, id string) (*Novel, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+novelColumns+` FROM novels WHERE id = ? AND deleted_at IS NULL`), id)
+	n, err := scanNovel(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sqldb: novel with ID %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not get novel %q: %v", id, err)
+	}
+	return n, nil
+}
+
+// insertNovel is the statement that adds a row of novelArgs.
+const insertNovel = `INSERT INTO novels (` + novelColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// newNovelArgs assigns n a new ID and returns the values to insert it
+// with.
+func newNovelArgs(n *Novel) ([]interface{}, error) {
+	n.ID = uuid.Must(uuid.NewV4()).String()
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = time.Now()
+	}
+	if n.Version == 0 {
+		n.Version = 1
+	}
+	return novelArgs(n)
+}
+
+func (s *sqlDB) AddNovel(ctx context.Context, n *Novel) (id string, err error) {
+	args, err := newNovelArgs(n)
+	if err != nil {
+		return "", fmt.Errorf("sqldb: could not encode novel: %v", err)
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(insertNovel), args...); err != nil {
+		return "", fmt.Errorf("sqldb: could not add novel: %v", err)
+	}
+	return n.ID, nil
+}
+
+// AddNovels adds all novels in a single transaction.
+func (s *sqlDB) AddNovels(ctx context.Context, novels []*Novel) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not add novels: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, s.rebind(insertNovel))
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not add novels: %v", err)
+	}
+	defer stmt.Close()
+	ids := make([]string, len(novels))
+	for i, n := range novels {
+		args, err := newNovelArgs(n)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not encode novel: %v", err)
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return nil, fmt.Errorf("sqldb: could not add novel %q: %v", n.Title, err)
+		}
+		ids[i] = n.ID
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not add novels: %v", err)
+	}
+	return ids, nil
+}
+
+// putNovel is the statement that adds a row of novelArgs followed by
+// deleted_at.
+const putNovel = `INSERT INTO novels (` + novelColumns + `, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// PutNovels replaces the rows of novels in a single transaction.
+func (s *sqlDB) PutNovels(ctx context.Context, novels []*Novel) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not put novels: %v", err)
+	}
+	defer tx.Rollback()
+	del, err := tx.PrepareContext(ctx, s.rebind(`DELETE FROM novels WHERE id = ?`))
+	if err != nil {
+		return fmt.Errorf("sqldb: could not put novels: %v", err)
+	}
+	defer del.Close()
+	ins, err := tx.PrepareContext(ctx, s.rebind(putNovel))
+	if err != nil {
+		return fmt.Errorf("sqldb: could not put novels: %v", err)
+	}
+	defer ins.Close()
+	for _, n := range novels {
+		if n.ID == "" {
+			return fmt.Errorf("sqldb: novel %q has no ID", n.Title)
+		}
+		args, err := novelArgs(n)
+		if err != nil {
+			return fmt.Errorf("sqldb: could not encode novel %q: %v", n.ID, err)
+		}
+		var deletedAt interface{}
+		if n.DeletedAt != nil {
+			deletedAt = n.DeletedAt.UTC()
+		}
+		if _, err := del.ExecContext(ctx, n.ID); err != nil {
+			return fmt.Errorf("sqldb: could not put novel %q: %v", n.ID, err)
+		}
+		if _, err := ins.ExecContext(ctx, append(args, deletedAt)...); err != nil {
+			return fmt.Errorf("sqldb: could not put novel %q: %v", n.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqldb: could not put novels: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlDB) DeleteNovel(ctx context.Context, id string) error {
+	q := `UPDATE novels SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`
+	res, err := s.db.ExecContext(ctx, s.rebind(q), time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not delete novel %q: %v", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("sqldb: could not delete novel %q: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+func (s *sqlDB) ListTrash(ctx context.Context) ([]*Novel, error) {
+	q := `SELECT ` + novelColumns + `, deleted_at FROM novels WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not list trash: %v", err)
+	}
+	defer rows.Close()
+	novels := make([]*Novel, 0)
+	for rows.Next() {
+		n, err := scanTrashedNovel(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not list trash: %v", err)
+		}
+		novels = append(novels, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not list trash: %v", err)
+	}
+	return novels, nil
+}
+
+func (s *sqlDB) GetTrashedNovel(ctx context.Context, id string) (*Novel, error) {
+	q := `SELECT ` + novelColumns + `, deleted_at FROM novels WHERE id = ? AND deleted_at IS NOT NULL`
+	n, err := scanTrashedNovel(s.db.QueryRowContext(ctx, s.rebind(q), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sqldb: trashed novel with ID %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not get trashed novel %q: %v", id, err)
+	}
+	return n, nil
+}
+
+func (s *sqlDB) RestoreNovel(ctx context.Context, id string) (*Novel, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE novels SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`), id)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not restore novel %q: %v", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("sqldb: could not restore novel %q: %w", id, ErrNotFound)
+	}
+	return s.GetNovel(ctx, id)
+}
+
+func (s *sqlDB) PurgeNovel(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM novels WHERE id = ? AND deleted_at IS NOT NULL`), id)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not purge novel %q: %v", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("sqldb: could not purge novel %q: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+func (s *sqlDB) UpdateNovel(ctx context.Context, n *Novel) error {
+	if n.ID == "" {
+		return fmt.Errorf("sqldb: novel with unassigned ID passed into UpdateNovel")
+	}
+	next := *n
+	next.Version++
+	args, err := novelArgs(&next)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not encode novel: %v", err)
+	}
+	q := `UPDATE novels SET title = ?, author = ?, published_date = ?, image_url = ?, description = ?, created_at = ?,
+		isbn10 = ?, isbn13 = ?, publisher = ?, page_count = ?, language = ?, genres = ?, series = ?, volume = ?, thumbnail_url = ?,
+		created_by = ?, version = ? WHERE id = ? AND version = ? AND deleted_at IS NULL`
+	res, err := s.db.ExecContext(ctx, s.rebind(q), append(args[1:], n.ID, n.Version)...)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not update novel %q: %v", n.ID, err)
+	}
+	if c, err := res.RowsAffected(); err == nil && c == 0 {
+		return s.updateFailure(ctx, s.db, n.ID, n.Version)
+	}
+	n.Version++
+	return nil
+}
+
+// PatchNovel sets only the columns of the patched fields.
+func (s *sqlDB) PatchNovel(ctx context.Context, id string, p NovelPatch) (*Novel, error) {
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("sqldb: %v", err)
+	}
+	set := []string{"version = version + 1"}
+	var args []interface{}
+	for _, name := range p.names() {
+		f, _ := lookupNovelField(name)
+		v, err := sqlFieldValue(p.Fields[name])
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not encode %s: %v", name, err)
+		}
+		set = append(set, f.column+" = ?")
+		args = append(args, v)
+	}
+	q := `UPDATE novels SET ` + strings.Join(set, ", ") + ` WHERE id = ? AND deleted_at IS NULL`
+	args = append(args, id)
+	if p.Version != 0 {
+		q += ` AND version = ?`
+		args = append(args, p.Version)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not patch novel %q: %v", id, err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, s.rebind(q), args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not patch novel %q: %v", id, err)
+	}
+	if c, err := res.RowsAffected(); err == nil && c == 0 {
+		return nil, s.updateFailure(ctx, tx, id, p.Version)
+	}
+	n, err := scanNovel(tx.QueryRowContext(ctx, s.rebind(`SELECT `+novelColumns+` FROM novels WHERE id = ?`), id))
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not get patched novel %q: %v", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not patch novel %q: %v", id, err)
+	}
+	return n, nil
+}
+
+// sqlFieldValue converts the value of a Novel field to its column value.
+func sqlFieldValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case PartialDate:
+		return string(v), nil
+	case []string:
+		if v == nil {
+			v = []string{}
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return v, nil
+}
+
+// rowQueryer is implemented by *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// updateFailure explains why an update of novel id at version changed no
+// rows: either the novel is gone or its version has moved on.
+func (s *sqlDB) updateFailure(ctx context.Context, q rowQueryer, id string, version int) error {
+	var cur int
+	err := q.QueryRowContext(ctx, s.rebind(`SELECT version FROM novels WHERE id = ? AND deleted_at IS NULL`), id).Scan(&cur)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("sqldb: could not update novel %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("sqldb: could not update novel %q: %v", id, err)
+	}
+	return fmt.Errorf("sqldb: novel %q is at version %d, not %d: %w", id, cur, version, ErrConflict)
+}
+
+// userColumns lists the columns of the users table in the order scanUser
+// and userArgs use.
+const userColumns = `id, email, name, password_hash, provider, subject, created_at, role`
+
+func scanUser(row rowScanner) (*User, error) {
+	u := &User{}
+	err := row.Scan(&u.ID, &u.Email, &u.Name, &u.PasswordHash, &u.Provider, &u.Subject, &u.CreatedAt, &u.Role)
+	return u, err
+}
+
+func userArgs(u *User) []interface{} {
+	return []interface{}{u.ID, u.Email, u.Name, u.PasswordHash, u.Provider, u.Subject, u.CreatedAt.UTC(), string(u.Role)}
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation
+// in either driver.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
+
+// getUser returns the single user matched by the WHERE clause where.
+func (s *sqlDB) getUser(ctx context.Context, desc, where string, args ...interface{}) (*User, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+userColumns+` FROM users WHERE `+where), args...)
+	u, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sqldb: user %s: %w", desc, ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not get user %s: %v", desc, err)
+	}
+	return u, nil
+}
+
+func (s *sqlDB) GetUser(ctx context.Context, id string) (*User, error) {
+	return s.getUser(ctx, fmt.Sprintf("with ID %q", id), `id = ?`, id)
+}
+
+func (s *sqlDB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	email = normalizeEmail(email)
+	return s.getUser(ctx, fmt.Sprintf("with email %q", email), `email = ?`, email)
+}
+
+func (s *sqlDB) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	return s.getUser(ctx, fmt.Sprintf("%q at %q", subject, provider), `provider = ? AND subject = ? AND subject <> ''`, provider, subject)
+}
+
+func (s *sqlDB) AddUser(ctx context.Context, u *User) (string, error) {
+	u.ID = uuid.Must(uuid.NewV4()).String()
+	u.Email = normalizeEmail(u.Email)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	q := `INSERT INTO users (` + userColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, s.rebind(q), userArgs(u)...)
+	if isUniqueViolation(err) {
+		return "", fmt.Errorf("sqldb: %q: %w", u.Email, ErrUserExists)
+	}
+	if err != nil {
+		return "", fmt.Errorf("sqldb: could not add user: %v", err)
+	}
+	return u.ID, nil
+}
+
+func (s *sqlDB) UpdateUser(ctx context.Context, u *User) error {
+	u.Email = normalizeEmail(u.Email)
+	q := `UPDATE users SET email = ?, name = ?, password_hash = ?, provider = ?, subject = ?, created_at = ?, role = ? WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.rebind(q), append(userArgs(u)[1:], u.ID)...)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("sqldb: %q: %w", u.Email, ErrUserExists)
+	}
+	if err != nil {
+		return fmt.Errorf("sqldb: could not update user %q: %v", u.ID, err)
+	}
+	if c, err := res.RowsAffected(); err == nil && c == 0 {
+		return fmt.Errorf("sqldb: could not update user %q: %w", u.ID, ErrUserNotFound)
+	}
+	return nil
+}
+
+func (s *sqlDB) ListUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY email`)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not list users: %v", err)
+	}
+	defer rows.Close()
+	users := make([]*User, 0)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not list users: %v", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not list users: %v", err)
+	}
+	return users, nil
+}
+
+// revisionColumns lists the columns of the revisions table in the order
+// scanRevision uses.
+const revisionColumns = `id, novel_id, version, action, user_id, user_name, created_at, changes, novel`
+
+func scanRevision(row rowScanner) (*Revision, error) {
+	rev := &Revision{}
+	var changes, novel string
+	err := row.Scan(&rev.ID, &rev.NovelID, &rev.Version, &rev.Action, &rev.UserID, &rev.UserName, &rev.At, &changes, &novel)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(changes), &rev.Changes); err != nil {
+		return nil, fmt.Errorf("could not decode changes of revision %q: %v", rev.ID, err)
+	}
+	if err := json.Unmarshal([]byte(novel), &rev.Novel); err != nil {
+		return nil, fmt.Errorf("could not decode novel of revision %q: %v", rev.ID, err)
+	}
+	return rev, nil
+}
+
+func (s *sqlDB) AddRevision(ctx context.Context, rev *Revision) error {
+	rev.ID = uuid.Must(uuid.NewV4()).String()
+	if rev.At.IsZero() {
+		rev.At = time.Now()
+	}
+	changes := rev.Changes
+	if changes == nil {
+		changes = []fieldChange{}
+	}
+	cb, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not encode revision: %v", err)
+	}
+	nb, err := json.Marshal(rev.Novel)
+	if err != nil {
+		return fmt.Errorf("sqldb: could not encode revision: %v", err)
+	}
+	q := `INSERT INTO revisions (` + revisionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = s.db.ExecContext(ctx, s.rebind(q), rev.ID, rev.NovelID, rev.Version, string(rev.Action), rev.UserID, rev.UserName,
+		rev.At.UTC(), string(cb), string(nb))
+	if err != nil {
+		return fmt.Errorf("sqldb: could not add revision: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlDB) ListRevisions(ctx context.Context, novelID string) ([]*Revision, error) {
+	q := `SELECT ` + revisionColumns + ` FROM revisions WHERE novel_id = ? ORDER BY created_at DESC, version DESC`
+	rows, err := s.db.QueryContext(ctx, s.rebind(q), novelID)
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not list revisions: %v", err)
+	}
+	defer rows.Close()
+	revs := []*Revision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: could not list revisions: %v", err)
+		}
+		revs = append(revs, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqldb: could not list revisions: %v", err)
+	}
+	return revs, nil
+}
+
+func (s *sqlDB) GetRevision(ctx context.Context, novelID, id string) (*Revision, error) {
+	q := `SELECT ` + revisionColumns + ` FROM revisions WHERE novel_id = ? AND id = ?`
+	rev, err := scanRevision(s.db.QueryRowContext(ctx, s.rebind(q), novelID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("sqldb: revision %q of novel %q: %w", id, novelID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqldb: could not get revision %q: %v", id, err)
+	}
+	return rev, nil
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,9 +17,16 @@ func testDB(t *testing.T, db NovelDatabase) {
 	t.Helper()
 	ctx := context.Background()
 	n := &Novel{
-		Title:       "testy mc test face",
-		Author:      fmt.Sprintf("t-%d", time.Now().Unix()),
-		Description: "desc",
+		Title:         "testy mc test face",
+		Author:        fmt.Sprintf("t-%d", time.Now().Unix()),
+		Description:   "desc",
+		PublishedDate: "1905-01",
+		ISBN13:        "9784101010137",
+		PageCount:     300,
+		Genres:        []string{"小説", "猫"},
+		Series:        "漱石全集",
+		Volume:        1,
+		CreatedBy:     "reader",
 	}
 
 	id, err := db.AddNovel(ctx, n)
@@ -31,16 +42,715 @@ func testDB(t *testing.T, db NovelDatabase) {
 	if got, want := gotNovel.Description, n.Description; got != want {
 		t.Error(err)
 	}
+	if got, want := gotNovel.PublishedDate.Year(), 1905; got != want {
+		t.Errorf("PublishedDate.Year(): got %d, want %d", got, want)
+	}
+	if got, want := gotNovel.GenreList(), n.GenreList(); got != want {
+		t.Errorf("Genres: got %q, want %q", got, want)
+	}
+	if gotNovel.CreatedBy != n.CreatedBy {
+		t.Errorf("CreatedBy: got %q, want %q", gotNovel.CreatedBy, n.CreatedBy)
+	}
+	if gotNovel.ISBN13 != n.ISBN13 || gotNovel.PageCount != n.PageCount || gotNovel.Series != n.Series || gotNovel.Volume != n.Volume {
+		t.Errorf("metadata: got %+v, want %+v", gotNovel, n)
+	}
+	if n.Version != 2 || gotNovel.Version != 2 {
+		t.Errorf("Version after one update: got %d, stored %d, want 2", n.Version, gotNovel.Version)
+	}
+	stale := *gotNovel
+	stale.Version = 1
+	stale.Description = "stale desc"
+	if err := db.UpdateNovel(ctx, &stale); !errors.Is(err, ErrConflict) {
+		t.Errorf("UpdateNovel with a stale version: got err %v, want ErrConflict", err)
+	}
+	if gotNovel, err := db.GetNovel(ctx, id); err != nil || gotNovel.Description != n.Description {
+		t.Errorf("after a conflicting update: got %+v, %v, want description %q", gotNovel, err, n.Description)
+	}
 	if err := db.DeleteNovel(ctx, id); err != nil {
 		t.Error(err)
 	}
-	if _, err := db.GetNovel(ctx, id); err == nil {
-		t.Error("want non-nil err")
+	if _, err := db.GetNovel(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNovel after delete: got err %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteNovel(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteNovel after delete: got err %v, want ErrNotFound", err)
+	}
+	if err := db.UpdateNovel(ctx, n); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateNovel after delete: got err %v, want ErrNotFound", err)
+	}
+}
+
+func testDBPaging(t *testing.T, db NovelDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	var ids []string
+	for _, title := range []string{"a", "b", "c", "d", "e"} {
+		id, err := db.AddNovel(ctx, &Novel{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteNovel(ctx, id)
+		}
+	}()
+
+	titles := func(p *NovelPage) string {
+		var s string
+		for _, n := range p.Novels {
+			s += n.Title
+		}
+		return s
+	}
+
+	page, err := db.ListNovelsPage(ctx, ListOptions{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := titles(page), "ab"; got != want {
+		t.Errorf("first page: got %q, want %q", got, want)
+	}
+	if page.PrevCursor != "" {
+		t.Errorf("first page: got prev cursor %q, want none", page.PrevCursor)
+	}
+	page, err = db.ListNovelsPage(ctx, ListOptions{PageSize: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := titles(page), "cd"; got != want {
+		t.Errorf("second page: got %q, want %q", got, want)
+	}
+	last, err := db.ListNovelsPage(ctx, ListOptions{PageSize: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := titles(last), "e"; got != want {
+		t.Errorf("last page: got %q, want %q", got, want)
+	}
+	if last.NextCursor != "" {
+		t.Errorf("last page: got next cursor %q, want none", last.NextCursor)
+	}
+	page, err = db.ListNovelsPage(ctx, ListOptions{PageSize: 2, Cursor: page.PrevCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := titles(page), "ab"; got != want {
+		t.Errorf("previous page: got %q, want %q", got, want)
+	}
+
+	if _, err := db.ListNovelsPage(ctx, ListOptions{Cursor: "not a cursor"}); err == nil {
+		t.Error("invalid cursor: want non-nil err")
+	}
+}
+
+func testDBPatch(t *testing.T, db NovelDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	id, err := db.AddNovel(ctx, &Novel{Title: "草枕", Author: "夏目漱石", Genres: []string{"小説"}, PageCount: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteNovel(ctx, id)
+
+	got, err := db.PatchNovel(ctx, id, NovelPatch{Fields: map[string]interface{}{
+		"publishedDate": PartialDate("1906-09"),
+		"genres":        []string{"小説", "純文学"},
+		"pageCount":     0,
+	}})
+	if err != nil {
+		t.Fatalf("PatchNovel: %v", err)
+	}
+	if got.Title != "草枕" || got.Author != "夏目漱石" || got.PublishedDate != "1906-09" || got.GenreList() != "小説, 純文学" || got.PageCount != 0 || got.Version != 2 {
+		t.Errorf("PatchNovel: got %+v", got)
+	}
+	if stored, err := db.GetNovel(ctx, id); err != nil || stored.Title != "草枕" || stored.PublishedDate != "1906-09" || stored.Version != 2 {
+		t.Errorf("GetNovel after PatchNovel: got %+v, %v", stored, err)
+	}
+
+	if _, err := db.PatchNovel(ctx, id, NovelPatch{Version: 1, Fields: map[string]interface{}{"title": "stale"}}); !errors.Is(err, ErrConflict) {
+		t.Errorf("PatchNovel with a stale version: got err %v, want ErrConflict", err)
+	}
+	if got, err := db.PatchNovel(ctx, id, NovelPatch{Version: 2, Fields: map[string]interface{}{"title": "くさまくら"}}); err != nil || got.Title != "くさまくら" || got.Version != 3 {
+		t.Errorf("PatchNovel at the current version: got %+v, %v", got, err)
+	}
+	for _, fields := range []map[string]interface{}{
+		{"createdBy": "someone"},
+		{"pageCount": "many"},
+	} {
+		if _, err := db.PatchNovel(ctx, id, NovelPatch{Fields: fields}); err == nil {
+			t.Errorf("PatchNovel(%v): got no error", fields)
+		}
+	}
+	if _, err := db.PatchNovel(ctx, "doesnotexist", NovelPatch{Fields: map[string]interface{}{"title": "x"}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("PatchNovel(doesnotexist): got err %v, want ErrNotFound", err)
+	}
+}
+
+func testDBAddNovels(t *testing.T, db NovelDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	novels := []*Novel{{Title: "三四郎", Genres: []string{"小説"}}, {Title: "それから"}, {Title: "門"}}
+	ids, err := db.AddNovels(ctx, novels)
+	if err != nil {
+		t.Fatalf("AddNovels: %v", err)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteNovel(ctx, id)
+		}
+	}()
+	if len(ids) != len(novels) {
+		t.Fatalf("AddNovels: got %d IDs, want %d", len(ids), len(novels))
+	}
+	for i, id := range ids {
+		if novels[i].ID != id {
+			t.Errorf("AddNovels: novel %d has ID %q, want %q", i, novels[i].ID, id)
+		}
+		got, err := db.GetNovel(ctx, id)
+		if err != nil || got.Title != novels[i].Title || got.Version != 1 || got.CreatedAt.IsZero() {
+			t.Errorf("GetNovel(%q) after AddNovels: got %+v, %v", id, got, err)
+		}
+	}
+}
+
+func testDBPutNovels(t *testing.T, db NovelDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	created := time.Date(1908, 9, 1, 0, 0, 0, 0, time.UTC)
+	deleted := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	novels := []*Novel{
+		{ID: "put-1", Title: "三四郎", CreatedAt: created, Version: 4, Genres: []string{"小説"}},
+		{ID: "put-2", Title: "それから", CreatedAt: created, Version: 2, DeletedAt: &deleted},
+	}
+	if err := db.PutNovels(ctx, novels); err != nil {
+		t.Fatalf("PutNovels: %v", err)
+	}
+	defer func() {
+		for _, novel := range novels {
+			db.DeleteNovel(ctx, novel.ID)
+			db.PurgeNovel(ctx, novel.ID)
+		}
+	}()
+	got, err := db.GetNovel(ctx, "put-1")
+	if err != nil || got.Title != "三四郎" || got.Version != 4 || !got.CreatedAt.Equal(created) || got.GenreList() != "小説" {
+		t.Errorf("GetNovel after PutNovels: got %+v, %v", got, err)
+	}
+	got, err = db.GetTrashedNovel(ctx, "put-2")
+	if err != nil || got.Title != "それから" || got.DeletedAt == nil || !got.DeletedAt.Equal(deleted) {
+		t.Errorf("GetTrashedNovel after PutNovels: got %+v, %v", got, err)
+	}
+
+	// Putting them again replaces them, moving them in and out of the
+	// trash.
+	novels[0].DeletedAt, novels[1].DeletedAt = &deleted, nil
+	novels[1].Title = "門"
+	if err := db.PutNovels(ctx, novels); err != nil {
+		t.Fatalf("PutNovels again: %v", err)
+	}
+	if _, err := db.GetNovel(ctx, "put-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNovel of a novel put in the trash: got err %v, want ErrNotFound", err)
+	}
+	if got, err := db.GetNovel(ctx, "put-2"); err != nil || got.Title != "門" {
+		t.Errorf("GetNovel of a novel put out of the trash: got %+v, %v", got, err)
+	}
+	trash, err := db.ListTrash(ctx)
+	if err != nil {
+		t.Fatalf("ListTrash: %v", err)
+	}
+	for _, novel := range trash {
+		if novel.ID == "put-2" {
+			t.Errorf("ListTrash after PutNovels: got novel put-2, which was put out of the trash")
+		}
+	}
+	if err := db.PutNovels(ctx, []*Novel{{Title: "no ID"}}); err == nil {
+		t.Error("PutNovels of a novel without an ID: want error")
+	}
+}
+
+func testDBTrash(t *testing.T, db NovelDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	var ids []string
+	for _, title := range []string{"門", "行人"} {
+		id, err := db.AddNovel(ctx, &Novel{Title: title, Author: "trash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	kept, gone := ids[0], ids[1]
+	for _, id := range ids {
+		if err := db.DeleteNovel(ctx, id); err != nil {
+			t.Fatalf("DeleteNovel: %v", err)
+		}
+		// Deletion times must differ for the trash to be ordered.
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteNovel(ctx, id)
+			db.PurgeNovel(ctx, id)
+		}
+	}()
+
+	if _, err := db.GetNovel(ctx, kept); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNovel of trashed novel: got err %v, want ErrNotFound", err)
+	}
+	if page, err := db.ListNovelsPage(ctx, ListOptions{Author: "trash"}); err != nil || len(page.Novels) != 0 {
+		t.Errorf("ListNovelsPage: got %v, %v, want no trashed novels", page, err)
+	}
+	novels, err := db.ListNovels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range novels {
+		if n.ID == kept || n.ID == gone {
+			t.Errorf("ListNovels: got trashed novel %q", n.ID)
+		}
+	}
+	if err := db.UpdateNovel(ctx, &Novel{ID: kept, Title: "x", Version: 1}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateNovel of trashed novel: got err %v, want ErrNotFound", err)
+	}
+	if _, err := db.PatchNovel(ctx, kept, NovelPatch{Fields: map[string]interface{}{"title": "x"}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("PatchNovel of trashed novel: got err %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteNovel(ctx, kept); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteNovel of trashed novel: got err %v, want ErrNotFound", err)
+	}
+
+	trash, err := db.ListTrash(ctx)
+	if err != nil {
+		t.Fatalf("ListTrash: %v", err)
+	}
+	var got []string
+	for _, n := range trash {
+		if n.ID == kept || n.ID == gone {
+			got = append(got, n.ID)
+			if n.DeletedAt == nil {
+				t.Errorf("ListTrash: novel %q has no DeletedAt", n.ID)
+			}
+		}
+	}
+	if len(got) != 2 || got[0] != gone || got[1] != kept {
+		t.Errorf("ListTrash: got %v, want [%s %s]", got, gone, kept)
+	}
+	if n, err := db.GetTrashedNovel(ctx, kept); err != nil || n.Title != "門" || n.DeletedAt == nil {
+		t.Errorf("GetTrashedNovel: got %+v, %v", n, err)
+	}
+
+	n, err := db.RestoreNovel(ctx, kept)
+	if err != nil || n.Title != "門" || n.DeletedAt != nil {
+		t.Errorf("RestoreNovel: got %+v, %v", n, err)
+	}
+	if n, err := db.GetNovel(ctx, kept); err != nil || n.DeletedAt != nil {
+		t.Errorf("GetNovel after RestoreNovel: got %+v, %v", n, err)
+	}
+	if _, err := db.GetTrashedNovel(ctx, kept); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTrashedNovel after RestoreNovel: got err %v, want ErrNotFound", err)
+	}
+	if _, err := db.RestoreNovel(ctx, kept); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RestoreNovel of live novel: got err %v, want ErrNotFound", err)
+	}
+	if err := db.PurgeNovel(ctx, kept); !errors.Is(err, ErrNotFound) {
+		t.Errorf("PurgeNovel of live novel: got err %v, want ErrNotFound", err)
+	}
+
+	if err := db.PurgeNovel(ctx, gone); err != nil {
+		t.Fatalf("PurgeNovel: %v", err)
+	}
+	if _, err := db.GetTrashedNovel(ctx, gone); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTrashedNovel after PurgeNovel: got err %v, want ErrNotFound", err)
+	}
+	if _, err := db.RestoreNovel(ctx, gone); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RestoreNovel after PurgeNovel: got err %v, want ErrNotFound", err)
+	}
+}
+
+func testDBListOptions(t *testing.T, db NovelDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	var ids []string
+	for _, n := range []*Novel{
+		{Title: "b", Author: "soseki", PublishedDate: "1906", CreatedBy: "u1"},
+		{Title: "a", Author: "ogai", PublishedDate: "1911-09", CreatedBy: "u2"},
+		{Title: "d", Author: "soseki", PublishedDate: "1914-04-20", CreatedBy: "u1"},
+		{Title: "c", Author: "akutagawa", PublishedDate: "1915", CreatedBy: "u1"},
+	} {
+		id, err := db.AddNovel(ctx, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteNovel(ctx, id)
+		}
+	}()
+
+	// b and d have the same author, so sorting by author puts them in ID
+	// order, which only the memory database assigns in insertion order.
+	soseki, sosekiDesc := "bd", "db"
+	if ids[2] < ids[0] {
+		soseki, sosekiDesc = sosekiDesc, soseki
+	}
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want string
+	}{
+		{"default", ListOptions{}, "abcd"},
+		{"title desc", ListOptions{Descending: true}, "dcba"},
+		{"author", ListOptions{Sort: SortByAuthor}, "ca" + soseki},
+		{"author desc", ListOptions{Sort: SortByAuthor, Descending: true}, sosekiDesc + "ac"},
+		{"published desc", ListOptions{Sort: SortByPublished, Descending: true}, "cdab"},
+		{"created", ListOptions{Sort: SortByCreated}, "badc"},
+		{"by author", ListOptions{Author: "soseki"}, "bd"},
+		{"year range", ListOptions{MinYear: 1911, MaxYear: 1914}, "ad"},
+		{"from year", ListOptions{MinYear: 1912}, "cd"},
+		{"to year", ListOptions{MaxYear: 1906}, "b"},
+		{"shelf", ListOptions{CreatedBy: "u1"}, "bcd"},
+		{"shelf by author", ListOptions{CreatedBy: "u1", Author: "soseki", Descending: true}, "db"},
+	}
+	for _, tc := range tests {
+		var got string
+		opts := tc.opts
+		opts.PageSize = 3
+		for {
+			page, err := db.ListNovelsPage(ctx, opts)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			for _, n := range page.Novels {
+				got += n.Title
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func testHistoryDB(t *testing.T, db HistoryDatabase) {
+	t.Helper()
+	ctx := context.Background()
+	novelID := fmt.Sprintf("history-%d", time.Now().UnixNano())
+	for v, title := range []string{"一", "二"} {
+		rev := &Revision{
+			NovelID:  novelID,
+			Version:  v + 1,
+			Action:   RevisionUpdate,
+			UserID:   "u1",
+			UserName: "editor@example.com",
+			Changes:  []fieldChange{{Field: "title", Label: "Title", New: title}},
+			Novel:    &Novel{ID: novelID, Title: title, Genres: []string{"小説"}},
+		}
+		if err := db.AddRevision(ctx, rev); err != nil {
+			t.Fatalf("AddRevision: %v", err)
+		}
+		if rev.ID == "" || rev.At.IsZero() {
+			t.Errorf("AddRevision: got ID %q, At %v, want them set", rev.ID, rev.At)
+		}
+	}
+	revs, err := db.ListRevisions(ctx, novelID)
+	if err != nil {
+		t.Fatalf("ListRevisions: %v", err)
+	}
+	if len(revs) != 2 || revs[0].Novel.Title != "二" || revs[1].Novel.Title != "一" {
+		t.Fatalf("ListRevisions: got %+v, want the two revisions newest first", revs)
+	}
+	got, err := db.GetRevision(ctx, novelID, revs[1].ID)
+	if err != nil {
+		t.Fatalf("GetRevision: %v", err)
+	}
+	if got.Version != 1 || got.Action != RevisionUpdate || got.UserName != "editor@example.com" ||
+		len(got.Changes) != 1 || got.Changes[0].New != "一" || got.Novel.GenreList() != "小説" {
+		t.Errorf("GetRevision: got %+v", got)
+	}
+	if _, err := db.GetRevision(ctx, novelID, "doesnotexist"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRevision(doesnotexist): got err %v, want ErrNotFound", err)
+	}
+	if revs, err := db.ListRevisions(ctx, "doesnotexist"); err != nil || len(revs) != 0 {
+		t.Errorf("ListRevisions(doesnotexist): got %v, %v, want none", revs, err)
+	}
+}
+
+func testUserDB(t *testing.T, db UserDatabase) {
+	ctx := context.Background()
+	// Databases may persist between runs, so use fresh addresses.
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	email := "Reader" + suffix + "@Example.com"
+
+	u := &User{Email: email, Name: "Reader", PasswordHash: "hash"}
+	id, err := db.AddUser(ctx, u)
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if u.ID != id || u.CreatedAt.IsZero() {
+		t.Errorf("AddUser: got ID %q and CreatedAt %v, want %q and now", u.ID, u.CreatedAt, id)
+	}
+	got, err := db.GetUserByEmail(ctx, strings.ToUpper(email))
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if got.ID != id || got.Email != strings.ToLower(email) || got.PasswordHash != "hash" {
+		t.Errorf("GetUserByEmail: got %+v", got)
+	}
+	if _, err := db.AddUser(ctx, &User{Email: email}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("AddUser with taken email: got %v, want ErrUserExists", err)
+	}
+
+	got.Provider, got.Subject = "https://issuer.example.com", "sub"+suffix
+	got.Role = RoleAdmin
+	if err := db.UpdateUser(ctx, got); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	byIdentity, err := db.GetUserByIdentity(ctx, got.Provider, got.Subject)
+	if err != nil {
+		t.Fatalf("GetUserByIdentity: %v", err)
+	}
+	if byIdentity.ID != id || byIdentity.Role != RoleAdmin {
+		t.Errorf("GetUserByIdentity: got %+v, want admin user %q", byIdentity, id)
+	}
+	other := &User{Email: "other" + suffix + "@example.com", Provider: got.Provider, Subject: got.Subject}
+	if _, err := db.AddUser(ctx, other); !errors.Is(err, ErrUserExists) {
+		t.Errorf("AddUser with taken identity: got %v, want ErrUserExists", err)
+	}
+
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	listed := false
+	for i, u := range users {
+		listed = listed || u.ID == id
+		if i > 0 && users[i-1].Email > u.Email {
+			t.Errorf("ListUsers: %q listed before %q", users[i-1].Email, u.Email)
+		}
+	}
+	if !listed {
+		t.Errorf("ListUsers: user %q not listed", id)
+	}
+
+	if _, err := db.GetUser(ctx, "doesnotexist"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUser(doesnotexist): got %v, want ErrUserNotFound", err)
+	}
+	if _, err := db.GetUserByIdentity(ctx, "", ""); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUserByIdentity with empty subject: got %v, want ErrUserNotFound", err)
+	}
+	if err := db.UpdateUser(ctx, &User{ID: "doesnotexist", Email: "x" + suffix + "@example.com"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("UpdateUser(doesnotexist): got %v, want ErrUserNotFound", err)
 	}
 }
 
 func TestMemoryDB(t *testing.T) {
 	testDB(t, newMemoryDB())
+	testDBPaging(t, newMemoryDB())
+	testDBListOptions(t, newMemoryDB())
+	testDBPatch(t, newMemoryDB())
+	testDBTrash(t, newMemoryDB())
+	testDBAddNovels(t, newMemoryDB())
+	testDBPutNovels(t, newMemoryDB())
+	testUserDB(t, newMemoryDB())
+	testHistoryDB(t, newMemoryDB())
+}
+
+func TestListNovelsByCreatedSubsecond(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDB()
+	at := time.Date(1906, 4, 1, 0, 0, 0, 0, time.UTC)
+	// Formatted with time.RFC3339Nano, ".1Z" would sort after ".12Z".
+	if err := db.PutNovels(ctx, []*Novel{
+		{ID: "1", Title: "b", CreatedAt: at.Add(120 * time.Millisecond)},
+		{ID: "2", Title: "a", CreatedAt: at.Add(100 * time.Millisecond)},
+		{ID: "3", Title: "c", CreatedAt: at.Add(time.Second)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	opts := ListOptions{Sort: SortByCreated, PageSize: 1}
+	for {
+		page, err := db.ListNovelsPage(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range page.Novels {
+			got += n.Title
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if got != "abc" {
+		t.Errorf("got %q, want %q", got, "abc")
+	}
+}
+
+func TestSearchDB(t *testing.T) {
+	ctx := context.Background()
+	db, err := newSearchDB(ctx, newMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+
+	n := &Novel{Title: "坊っちゃん", Author: "夏目漱石"}
+	id, err := db.AddNovel(ctx, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := func(q string) bool {
+		t.Helper()
+		novels, err := db.SearchNovels(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(novels) == 1 && novels[0].ID == id
+	}
+	if !found("漱石") {
+		t.Errorf("SearchNovels(漱石): want novel %q", id)
+	}
+	n.Author = "Natsume Soseki"
+	if err := db.UpdateNovel(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	if found("漱石") {
+		t.Error("SearchNovels(漱石) after update: want no match")
+	}
+	if !found("soseki") {
+		t.Errorf("SearchNovels(soseki) after update: want novel %q", id)
+	}
+	if _, err := db.PatchNovel(ctx, id, NovelPatch{Fields: map[string]interface{}{"description": "親譲りの無鉄砲"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !found("無鉄砲") || !found("soseki") {
+		t.Errorf("SearchNovels after patch: want novel %q for the new description and the old author", id)
+	}
+	if err := db.DeleteNovel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if found("soseki") {
+		t.Error("SearchNovels(soseki) after delete: want no match")
+	}
+	if _, err := db.RestoreNovel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if !found("soseki") {
+		t.Errorf("SearchNovels(soseki) after restore: want novel %q", id)
+	}
+
+	// A novel deleted behind the index's back, as by another instance, is
+	// left out of results rather than failing the search.
+	if err := db.NovelDatabase.DeleteNovel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if found("soseki") {
+		t.Error("SearchNovels(soseki) after an unindexed delete: want no match")
+	}
+	if db.index.Len() != 0 {
+		t.Errorf("index after an unindexed delete: got %d novels, want 0", db.index.Len())
+	}
+
+	// Writes made elsewhere are picked up by refresh.
+	other, err := db.NovelDatabase.AddNovel(ctx, &Novel{Title: "こころ"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(q string) []*Novel {
+		t.Helper()
+		novels, err := db.SearchNovels(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return novels
+	}
+	if got := search("こころ"); len(got) != 0 {
+		t.Errorf("SearchNovels(こころ) before refresh: got %d novels, want none", len(got))
+	}
+	if changed, err := db.refresh(ctx); err != nil || changed != 1 {
+		t.Errorf("refresh: got %d changes, %v, want 1", changed, err)
+	}
+	if got := search("こころ"); len(got) != 1 || got[0].ID != other {
+		t.Errorf("SearchNovels(こころ) after refresh: got %+v, want novel %q", got, other)
+	}
+	if _, err := db.NovelDatabase.PatchNovel(ctx, other, NovelPatch{Fields: map[string]interface{}{"author": "夏目漱石"}}); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := db.refresh(ctx); err != nil || changed != 1 {
+		t.Errorf("refresh after a patch: got %d changes, %v, want 1", changed, err)
+	}
+	if got := search("漱石"); len(got) != 1 || got[0].ID != other {
+		t.Errorf("SearchNovels(漱石) after refresh: got %+v, want novel %q", got, other)
+	}
+	if changed, err := db.refresh(ctx); err != nil || changed != 0 {
+		t.Errorf("refresh without writes: got %d changes, %v, want 0", changed, err)
+	}
+}
+
+func TestSQLiteDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "novelshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "novels.db")
+	db, err := newSQLDB("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("newSQLDB: %v", err)
+	}
+	testDB(t, db)
+	testDBPaging(t, db)
+	testDBListOptions(t, db)
+	testDBPatch(t, db)
+	testDBTrash(t, db)
+	testDBAddNovels(t, db)
+	testDBPutNovels(t, db)
+	testUserDB(t, db)
+	testHistoryDB(t, db)
+
+	// Reopening runs the migrations again, which must be a no-op.
+	id, err := db.AddNovel(context.Background(), &Novel{Title: "persisted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+	db, err = newSQLDB("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("newSQLDB reopen: %v", err)
+	}
+	defer db.Close(context.Background())
+	if _, err := db.GetNovel(context.Background(), id); err != nil {
+		t.Errorf("GetNovel after reopen: %v", err)
+	}
+}
+
+func TestPostgresDB(t *testing.T) {
+	dsn := os.Getenv("GOLANG_SAMPLES_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skipf("GOLANG_SAMPLES_POSTGRES_DSN not set")
+	}
+	db, err := newSQLDB("postgres", dsn)
+	if err != nil {
+		t.Fatalf("newSQLDB: %v", err)
+	}
+	defer db.Close(context.Background())
+	testDB(t, db)
+	testDBPaging(t, db)
+	testDBListOptions(t, db)
+	testDBPatch(t, db)
+	testDBTrash(t, db)
+	testDBAddNovels(t, db)
+	testDBPutNovels(t, db)
+	testUserDB(t, db)
+	testHistoryDB(t, db)
 }
 
 func TestFireStoreDB(t *testing.T) {
@@ -60,4 +770,12 @@ func TestFireStoreDB(t *testing.T) {
 		t.Fatalf("newFirestoreDB: %v", err)
 	}
 	testDB(t, db)
+	testDBPaging(t, db)
+	testDBListOptions(t, db)
+	testDBPatch(t, db)
+	testDBTrash(t, db)
+	testDBAddNovels(t, db)
+	testDBPutNovels(t, db)
+	testUserDB(t, db)
+	testHistoryDB(t, db)
 }
@@ -0,0 +1,26 @@
+package main
+
+// fieldChange is a field whose value differs between two versions of a
+// novel. Old and New are the values as they are entered in the edit form.
+type fieldChange struct {
+	Field string // name of the field in forms and JSON
+	Label string
+	Old   string
+	New   string
+}
+
+// diffNovels returns the fields users can change whose values differ
+// between old and cur, in form order.
+func diffNovels(old, cur *Novel) []fieldChange {
+	var changes []fieldChange
+	for _, f := range novelFields {
+		if f.label == "" {
+			continue
+		}
+		o, c := f.formValue(old), f.formValue(cur)
+		if o != c {
+			changes = append(changes, fieldChange{Field: f.name, Label: f.label, Old: o, New: c})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffNovels(t *testing.T) {
+	old := &Novel{Title: "こころ", Author: "夏目漱石", PageCount: 300, Genres: []string{"小説"}}
+	cur := &Novel{Title: "こころ", Author: "夏目 漱石", Genres: []string{"小説", "純文学"}, Version: 2}
+
+	want := []fieldChange{
+		{Field: "author", Label: "Author", Old: "夏目漱石", New: "夏目 漱石"},
+		{Field: "pageCount", Label: "Pages", Old: "300", New: ""},
+		{Field: "genres", Label: "Genres", Old: "小説", New: "小説, 純文学"},
+	}
+	if got := diffNovels(old, cur); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffNovels() = %+v, want %+v", got, want)
+	}
+	if got := diffNovels(old, old); got != nil {
+		t.Errorf("diffNovels(n, n) = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// exportHandler downloads every novel on the shelf. With format=csv the
+// file has the columns of novelFields, with values written as in the edit
+// form, so that it can be imported again; with format=json it is an array
+// of novels as the API returns them.
+func (n *Novelshelf) exportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	var write func(io.Writer, []*Novel) error
+	var contentType string
+	switch format {
+	case "csv":
+		write, contentType = writeNovelsCSV, "text/csv; charset=utf-8"
+	case "json":
+		write, contentType = writeNovelsJSON, "application/json; charset=utf-8"
+	default:
+		return n.badRequestf(r, errors.New("unknown export format"), "cannot export to %q; use csv or json", format)
+	}
+	novels, err := n.DB.ListNovels(r.Context())
+	if err != nil {
+		return n.appErrorf(r, err, "could not list novels: %v", err)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="novels-%s.%s"`, time.Now().Format("20060102"), format))
+	if err := write(w, novels); err != nil {
+		// The response has started, so the error can only be logged.
+		fmt.Fprintf(n.logWriter, "could not export novels: %v\n", err)
+	}
+	return nil
+}
+
+// writeNovelsCSV writes novels in the CSV format readImport reads.
+func writeNovelsCSV(w io.Writer, novels []*Novel) error {
+	cw := csv.NewWriter(w)
+	record := make([]string, len(novelFields))
+	for i, f := range novelFields {
+		record[i] = f.name
+	}
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+	for _, novel := range novels {
+		for i, f := range novelFields {
+			record[i] = f.formValue(novel)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeNovelsJSON(w io.Writer, novels []*Novel) error {
+	if novels == nil {
+		novels = []*Novel{}
+	}
+	return json.NewEncoder(w).Encode(novels)
+}
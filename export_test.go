@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	n.DB = testDBs["memory"]
+	id, err := n.DB.AddNovel(ctx, &Novel{Title: "道草", Author: "夏目漱石", PageCount: 320, Genres: []string{"小説", "自伝"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.DB.DeleteNovel(ctx, id)
+
+	resp, body := doRequest(t, wt.Client, "GET", "/novels/export?format=csv")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") || !strings.Contains(resp.Header.Get("Content-Disposition"), ".csv") {
+		t.Fatalf("CSV export: got status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	// The CSV export can be imported again.
+	rows, err := readImport(strings.NewReader(body), importCSV)
+	if err != nil {
+		t.Fatalf("readImport of the CSV export: %v", err)
+	}
+	found := false
+	for _, row := range rows {
+		if row.novel != nil && row.novel.Title == "道草" {
+			found = true
+			if validateNovel(row.novel) != nil || row.novel.Author != "夏目漱石" || row.novel.PageCount != 320 || row.novel.GenreList() != "小説, 自伝" {
+				t.Errorf("CSV export: got %+v", row.novel)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("CSV export: novel %q missing from %q", id, body)
+	}
+
+	resp, body = doRequest(t, wt.Client, "GET", "/novels/export?format=json")
+	var novels []*Novel
+	if err := json.Unmarshal([]byte(body), &novels); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("JSON export: got status %d, %v", resp.StatusCode, err)
+	}
+	found = false
+	for _, novel := range novels {
+		found = found || novel.ID == id
+	}
+	if !found {
+		t.Errorf("JSON export: novel %q missing", id)
+	}
+
+	if resp, _ := doRequest(t, wt.Client, "GET", "/novels/export?format=xml"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("XML export: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
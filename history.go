@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RevisionAction is the kind of change a Revision records.
+type RevisionAction string
+
+const (
+	RevisionAdd     RevisionAction = "add"
+	RevisionUpdate  RevisionAction = "update"
+	RevisionDelete  RevisionAction = "delete"  // moved to the trash
+	RevisionRestore RevisionAction = "restore" // taken out of the trash
+	RevisionPurge   RevisionAction = "purge"
+)
+
+// Revision records one change to a novel: who made it, when, and how the
+// fields changed.
+type Revision struct {
+	ID       string         `json:"id"`
+	NovelID  string         `json:"novelID"`
+	Version  int            `json:"version"` // version of the novel the change produced, or deleted
+	Action   RevisionAction `json:"action"`
+	UserID   string         `json:"userID,omitempty"` // empty for changes not made by a signed-in user
+	UserName string         `json:"userName,omitempty"`
+	At       time.Time      `json:"at"`
+	Changes  []fieldChange  `json:"changes,omitempty"`
+	Novel    *Novel         `json:"novel"` // the novel after the change, or before it was deleted
+}
+
+// HistoryDatabase stores the revisions of novels. Revisions outlive the
+// novels they belong to.
+type HistoryDatabase interface {
+	AddRevision(ctx context.Context, rev *Revision) error
+	// ListRevisions returns the revisions of a novel, newest first.
+	ListRevisions(ctx context.Context, novelID string) ([]*Revision, error)
+	// GetRevision returns ErrNotFound if novelID has no revision id.
+	GetRevision(ctx context.Context, novelID, id string) (*Revision, error)
+}
+
+// unwrapDB returns the database underneath the wrappers around db.
+func unwrapDB(db NovelDatabase) NovelDatabase {
+	for {
+		switch w := db.(type) {
+		case *searchDB:
+			db = w.NovelDatabase
+		case *historyDB:
+			db = w.NovelDatabase
+		default:
+			return db
+		}
+	}
+}
+
+// historyOf returns the HistoryDatabase that shares storage with db, if
+// any.
+func historyOf(db NovelDatabase) (HistoryDatabase, bool) {
+	h, ok := unwrapDB(db).(HistoryDatabase)
+	return h, ok
+}
+
+// historyDB wraps a NovelDatabase to record every change made through it
+// as a Revision, attributed to the user signed in to the context of the
+// call.
+type historyDB struct {
+	NovelDatabase
+	history HistoryDatabase
+}
+
+var _ NovelDatabase = &historyDB{}
+
+func newHistoryDB(db NovelDatabase) (*historyDB, error) {
+	h, ok := historyOf(db)
+	if !ok {
+		return nil, fmt.Errorf("historydb: %T cannot store history", db)
+	}
+	return &historyDB{NovelDatabase: db, history: h}, nil
+}
+
+// record adds a revision of novel made by the user in ctx. The change has
+// already been saved, so a revision that cannot be recorded is only logged
+// rather than failing the change.
+func (h *historyDB) record(ctx context.Context, action RevisionAction, prev, novel *Novel) {
+	snapshot := *novel
+	rev := &Revision{
+		NovelID: novel.ID,
+		Version: novel.Version,
+		Action:  action,
+		Novel:   &snapshot,
+	}
+	if action == RevisionAdd || action == RevisionUpdate {
+		rev.Changes = diffNovels(prev, novel)
+	}
+	if u := userFromContext(ctx); u != nil {
+		rev.UserID = u.ID
+		rev.UserName = u.Name
+		if rev.UserName == "" {
+			rev.UserName = u.Email
+		}
+	}
+	if err := h.history.AddRevision(ctx, rev); err != nil {
+		log.Printf("historydb: could not record revision of novel %q: %v", novel.ID, err)
+	}
+}
+
+// current returns a copy of the stored novel id, which stays as it is
+// while the stored one changes.
+func (h *historyDB) current(ctx context.Context, id string) (*Novel, error) {
+	n, err := h.NovelDatabase.GetNovel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c := *n
+	return &c, nil
+}
+
+func (h *historyDB) AddNovel(ctx context.Context, n *Novel) (string, error) {
+	id, err := h.NovelDatabase.AddNovel(ctx, n)
+	if err != nil {
+		return "", err
+	}
+	n.ID = id
+	h.record(ctx, RevisionAdd, &Novel{}, n)
+	return id, nil
+}
+
+func (h *historyDB) AddNovels(ctx context.Context, novels []*Novel) ([]string, error) {
+	ids, err := h.NovelDatabase.AddNovels(ctx, novels)
+	for _, n := range novels[:len(ids)] {
+		h.record(ctx, RevisionAdd, &Novel{}, n)
+	}
+	return ids, err
+}
+
+func (h *historyDB) UpdateNovel(ctx context.Context, n *Novel) error {
+	prev, err := h.current(ctx, n.ID)
+	if err != nil {
+		return err
+	}
+	if err := h.NovelDatabase.UpdateNovel(ctx, n); err != nil {
+		return err
+	}
+	h.record(ctx, RevisionUpdate, prev, n)
+	return nil
+}
+
+func (h *historyDB) PatchNovel(ctx context.Context, id string, p NovelPatch) (*Novel, error) {
+	prev, err := h.current(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := h.NovelDatabase.PatchNovel(ctx, id, p)
+	if err != nil {
+		return nil, err
+	}
+	h.record(ctx, RevisionUpdate, prev, n)
+	return n, nil
+}
+
+func (h *historyDB) DeleteNovel(ctx context.Context, id string) error {
+	prev, err := h.current(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := h.NovelDatabase.DeleteNovel(ctx, id); err != nil {
+		return err
+	}
+	h.record(ctx, RevisionDelete, prev, prev)
+	return nil
+}
+
+func (h *historyDB) RestoreNovel(ctx context.Context, id string) (*Novel, error) {
+	n, err := h.NovelDatabase.RestoreNovel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	h.record(ctx, RevisionRestore, n, n)
+	return n, nil
+}
+
+func (h *historyDB) PurgeNovel(ctx context.Context, id string) error {
+	prev, err := h.NovelDatabase.GetTrashedNovel(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := h.NovelDatabase.PurgeNovel(ctx, id); err != nil {
+		return err
+	}
+	h.record(ctx, RevisionPurge, prev, prev)
+	return nil
+}
+
+// historyData is passed to history.html.
+type historyData struct {
+	Novel     *Novel
+	Revisions []*Revision
+	CanEdit   bool
+}
+
+// historyHandler lists the revisions of a novel.
+func (n *Novelshelf) historyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	novel, err := n.DB.GetNovel(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	revs, err := n.History.ListRevisions(r.Context(), novel.ID)
+	if err != nil {
+		return n.appErrorf(r, err, "could not list revisions: %v", err)
+	}
+	return historyTmpl.Execute(n, w, r, historyData{
+		Novel:     novel,
+		Revisions: revs,
+		CanEdit:   userFromContext(r.Context()).CanEdit(novel),
+	})
+}
+
+// restoreHandler sets the fields of a novel back to their values in one
+// of its revisions. The restore is itself recorded as a new revision. A
+// cover that has since been deleted from the image store is not restored.
+func (n *Novelshelf) restoreHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	novel, err := n.DB.GetNovel(ctx, vars["id"])
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	if err := authorize(r, novel); err != nil {
+		return n.appErrorf(r, err, "you may only restore novels on your own shelf")
+	}
+	rev, err := n.History.GetRevision(ctx, novel.ID, vars["rev"])
+	if err != nil {
+		return n.appErrorf(r, err, "could not find revision: %v", err)
+	}
+	if rev.Action != RevisionAdd && rev.Action != RevisionUpdate {
+		return n.badRequestf(r, fmt.Errorf("restore of a %s", rev.Action), "only added or changed versions can be restored here")
+	}
+	errs := ValidationErrors{}
+	version := formInt(r, "version", errs)
+	if len(errs) > 0 {
+		return n.appErrorf(r, errs, "%v", errs)
+	}
+
+	restored := *rev.Novel
+	if !n.coverExists(ctx, restored.ImageURL) || !n.coverExists(ctx, restored.ThumbnailURL) {
+		restored.ImageURL = novel.ImageURL
+		restored.ThumbnailURL = novel.ThumbnailURL
+	}
+	var names []string
+	for _, f := range novelFields {
+		names = append(names, f.name)
+	}
+	saved, err := n.DB.PatchNovel(ctx, novel.ID, newNovelPatch(&restored, version, names...))
+	if errors.Is(err, ErrConflict) {
+		return n.appErrorf(r, err, "the novel has changed since you opened its history; reload the history and try again")
+	}
+	if err != nil {
+		return n.appErrorf(r, err, "could not restore novel: %v", err)
+	}
+	n.releaseCovers(ctx, novel, saved)
+	http.Redirect(w, r, fmt.Sprintf("/novels/%s", novel.ID), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHistoryDBRecords(t *testing.T) {
+	db, err := newHistoryDB(newMemoryDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor := &User{ID: "7", Email: "editor@example.com"}
+	ctx := context.WithValue(context.Background(), userContextKey, editor)
+
+	n := &Novel{Title: "三四郎"}
+	id, err := db.AddNovel(ctx, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memory database keeps n itself, so the update is made on a copy.
+	update := *n
+	update.Author = "夏目漱石"
+	if err := db.UpdateNovel(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+	// Changes made without a signed-in user, such as by commands, are
+	// recorded too.
+	if _, err := db.PatchNovel(context.Background(), id, NovelPatch{Fields: map[string]interface{}{"pageCount": 320}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteNovel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := db.history.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		action  RevisionAction
+		version int
+		user    string
+		changed string
+	}{
+		{RevisionDelete, 3, "editor@example.com", ""},
+		{RevisionUpdate, 3, "", "pageCount"},
+		{RevisionUpdate, 2, "editor@example.com", "author"},
+		{RevisionAdd, 1, "editor@example.com", "title"},
+	}
+	if len(revs) != len(want) {
+		t.Fatalf("got %d revisions, want %d", len(revs), len(want))
+	}
+	for i, w := range want {
+		rev := revs[i]
+		var changed []string
+		for _, c := range rev.Changes {
+			changed = append(changed, c.Field)
+		}
+		if rev.Action != w.action || rev.Version != w.version || rev.UserName != w.user || strings.Join(changed, ",") != w.changed {
+			t.Errorf("revision %d: got %s of version %d by %q changing %v, want %s of version %d by %q changing %s",
+				i, rev.Action, rev.Version, rev.UserName, changed, w.action, w.version, w.user, w.changed)
+		}
+	}
+	if revs[2].Changes[0].Old != "" || revs[2].Changes[0].New != "夏目漱石" {
+		t.Errorf("author change: got %+v", revs[2].Changes[0])
+	}
+}
+
+func TestHistoryAndRestore(t *testing.T) {
+	n.DB = testDBs["memory"]
+	ctx := context.Background()
+	resp, err := wt.PostForm("/novels", url.Values{"title": {"それから"}, "author": {"夏目漱石"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	novelPath := resp.Request.URL.Path
+	id := strings.TrimPrefix(novelPath, "/novels/")
+	defer n.DB.DeleteNovel(ctx, id)
+
+	// A bad edit.
+	resp, err = wt.PostForm(novelPath, url.Values{"title": {"vandalized"}, "version": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	historyPath := novelPath + "/history"
+	bodyContains(t, wt, novelPath, historyPath)
+	bodyContains(t, wt, historyPath, "<td>vandalized</td>")
+	bodyContains(t, wt, historyPath, "Restore this version")
+
+	revs, err := n.History.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].UserID != testUser.ID {
+		t.Fatalf("got revisions %+v, want an add and an update by %s", revs, testUser.ID)
+	}
+	restorePath := historyPath + "/" + revs[1].ID + ":restore"
+
+	// Restoring from a stale history page fails rather than overwriting
+	// the change made since.
+	resp, err = wt.PostForm(restorePath, url.Values{"version": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("stale restore: got status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	resp, err = wt.PostForm(restorePath, url.Values{"version": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != novelPath {
+		t.Errorf("restore: got status %d at %s, want %d at %s", resp.StatusCode, resp.Request.URL.Path, http.StatusOK, novelPath)
+	}
+	got, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "それから" || got.Author != "夏目漱石" || got.Version != 3 {
+		t.Errorf("after restore: got %+v", got)
+	}
+
+	// Viewers see neither the history nor a link to it.
+	_, viewer := addTestUser(t, "history-viewer@example.com", RoleViewer)
+	if _, body := doRequest(t, viewer, "GET", novelPath); strings.Contains(body, historyPath) {
+		t.Errorf("viewer: novel page links to the history")
+	}
+	if resp, _ := doRequest(t, viewer, "GET", historyPath); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer: got status %d for the history, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	// Other editors see the history but cannot restore.
+	_, other := addTestUser(t, "history-editor@example.com", RoleEditor)
+	if _, body := doRequest(t, other, "GET", historyPath); !strings.Contains(body, "Version 2") || strings.Contains(body, "Restore this version") {
+		t.Errorf("other editor: want the history without restore buttons")
+	}
+	if resp, _ := doRequest(t, other, "POST", restorePath); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other editor: got status %d for a restore, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
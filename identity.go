@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Identity is a user as vouched for by an IdentityProvider.
+type Identity struct {
+	Provider      string // e.g. the OIDC issuer URL
+	Subject       string // stable ID of the user at Provider
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdentityProvider signs users in through an OAuth2 authorization code
+// flow.
+type IdentityProvider interface {
+	// Name is shown on the sign-in button.
+	Name() string
+	// AuthCodeURL returns the URL to send the user to to sign in.
+	AuthCodeURL(state, nonce string) string
+	// Exchange redeems the code the provider redirected back with and
+	// returns who signed in. nonce is the one passed to AuthCodeURL.
+	Exchange(ctx context.Context, code, nonce string) (*Identity, error)
+}
+
+// oidcProvider is an IdentityProvider for any OpenID Connect provider,
+// such as Google.
+type oidcProvider struct {
+	name     string
+	issuer   string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var _ IdentityProvider = &oidcProvider{}
+
+// newOIDCProvider discovers the OpenID Connect provider at issuer.
+func newOIDCProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL string) (*oidcProvider, error) {
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: could not discover %s: %v", issuer, err)
+	}
+	name := issuer
+	if u, err := url.Parse(issuer); err == nil && u.Host != "" {
+		name = strings.TrimPrefix(u.Host, "accounts.")
+	}
+	return &oidcProvider{
+		name:   name,
+		issuer: issuer,
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+func (p *oidcProvider) AuthCodeURL(state, nonce string) string {
+	return p.config.AuthCodeURL(state, oidc.Nonce(nonce))
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	tok, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: could not exchange code: %v", err)
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("oidc: no id_token in token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id_token: %v", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("oidc: could not read claims: %v", err)
+	}
+	if claims.Email == "" {
+		return nil, errors.New("oidc: the provider did not share an email address")
+	}
+	return &Identity{
+		Provider:      p.issuer,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// localProviderPath is where localProvider serves its sign-in form.
+const localProviderPath = "/auth/local"
+
+// localProvider is a stand-in IdentityProvider for development and tests:
+// its sign-in form lets anyone sign in as any email address. It must never
+// be enabled where the app is reachable by others.
+type localProvider struct {
+	codes *securecookie.SecureCookie
+}
+
+var _ IdentityProvider = &localProvider{}
+
+func newLocalProvider() *localProvider {
+	codes := securecookie.New(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32))
+	codes.MaxAge(int((5 * time.Minute).Seconds()))
+	return &localProvider{codes: codes}
+}
+
+func (p *localProvider) Name() string {
+	return "local test accounts"
+}
+
+func (p *localProvider) AuthCodeURL(state, nonce string) string {
+	return localProviderPath + "?" + url.Values{"state": {state}, "nonce": {nonce}}.Encode()
+}
+
+// localCode is the content of an authorization code issued by
+// localProvider.
+type localCode struct {
+	Email string
+	Name  string
+	Nonce string
+}
+
+func (p *localProvider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	var c localCode
+	if err := p.codes.Decode("code", code, &c); err != nil {
+		return nil, fmt.Errorf("localprovider: invalid code: %v", err)
+	}
+	if c.Nonce != nonce {
+		return nil, errors.New("localprovider: nonce mismatch")
+	}
+	// Nothing vouches for the address, so it is not marked verified and
+	// is never linked to an existing account.
+	return &Identity{
+		Provider: "local",
+		Subject:  c.Email,
+		Email:    c.Email,
+		Name:     c.Name,
+	}, nil
+}
+
+// localLoginData is passed to local_login.html.
+type localLoginData struct {
+	State string
+	Nonce string
+}
+
+func (p *localProvider) formHandler(n *Novelshelf) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		return localLoginTmpl.Execute(n, w, r, localLoginData{State: r.FormValue("state"), Nonce: r.FormValue("nonce")})
+	}
+}
+
+// signInHandler issues a code for the submitted email address and
+// redirects to the callback, as a real provider would after signing in.
+func (p *localProvider) signInHandler(n *Novelshelf) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		email := normalizeEmail(r.FormValue("email"))
+		if !strings.Contains(email, "@") {
+			return n.badRequestf(r, errors.New("invalid email"), "enter an email address")
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			name = email[:strings.Index(email, "@")]
+		}
+		code, err := p.codes.Encode("code", localCode{Email: email, Name: name, Nonce: r.FormValue("nonce")})
+		if err != nil {
+			return n.appErrorf(r, err, "could not issue code: %v", err)
+		}
+		q := url.Values{"state": {r.FormValue("state")}, "code": {code}}
+		http.Redirect(w, r, "/auth/callback?"+q.Encode(), http.StatusFound)
+		return nil
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// coverNamePattern matches the names covers are uploaded under: a UUID,
+// optionally followed by the variant name, and an extension. Garbage
+// collection only considers images with such names, so that a shared
+// bucket can hold other objects too.
+var coverNamePattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}(-[a-z]+)?(\.[0-9A-Za-z]+)?$`)
+
+// defaultGCMinAge is how old an unreferenced cover must be before it is
+// collected. Covers are stored before the novel referring to them is
+// saved, so a very recent cover may belong to a save still in progress.
+const defaultGCMinAge = 24 * time.Hour
+
+// collectImageGarbage deletes the covers in n.Images that no novel, not
+// even one in the trash, refers to and that were last updated more than
+// minAge ago. With dryRun it only reports them. It returns the names of
+// the unreferenced covers.
+func (n *Novelshelf) collectImageGarbage(ctx context.Context, minAge time.Duration, dryRun bool) ([]string, error) {
+	if n.Images == nil {
+		return nil, errors.New("imagegc: image storage is not configured")
+	}
+	referenced, err := n.referencedCovers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("imagegc: %v", err)
+	}
+
+	images, err := n.Images.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("imagegc: could not list images: %v", err)
+	}
+	cutoff := time.Now().Add(-minAge)
+	var garbage []string
+	for _, img := range images {
+		if referenced[img.Name] || !coverNamePattern.MatchString(img.Name) || img.Updated.After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := n.Images.Delete(ctx, img.Name); err != nil && !errors.Is(err, ErrImageNotFound) {
+				return garbage, fmt.Errorf("imagegc: %v", err)
+			}
+		}
+		garbage = append(garbage, img.Name)
+	}
+	return garbage, nil
+}
+
+// referencedCovers returns the names of the covers in n.Images that a
+// novel, in the trash or not, refers to.
+func (n *Novelshelf) referencedCovers(ctx context.Context) (map[string]bool, error) {
+	novels, err := n.DB.ListNovels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list novels: %v", err)
+	}
+	trash, err := n.DB.ListTrash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list trash: %v", err)
+	}
+	referenced := make(map[string]bool)
+	for _, novel := range append(novels, trash...) {
+		for _, u := range coverURLs(novel) {
+			if name, ok := n.Images.Name(u); ok {
+				referenced[name] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// gcCommand implements "novelshelf gc", which deletes cover images no
+// novel refers to.
+func (n *Novelshelf) gcCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "only list the images that would be deleted")
+	minAge := fs.Duration("min-age", defaultGCMinAge, "only delete images older than this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("gc: unexpected arguments %q", fs.Args())
+	}
+
+	garbage, err := n.collectImageGarbage(ctx, *minAge, *dryRun)
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	for _, name := range garbage {
+		fmt.Fprintf(out, "%s %s\n", verb, name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d unreferenced images\n", len(garbage))
+	return nil
+}
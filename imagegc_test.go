@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectImageGarbage(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "novelshelf-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	images, err := newLocalImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Novelshelf{DB: newMemoryDB(), Images: images, logWriter: ioutil.Discard}
+
+	const (
+		kept     = "6ba7b810-9dad-11d1-80b4-00c04fd430c8-full.jpg"
+		orphaned = "6ba7b811-9dad-11d1-80b4-00c04fd430c8-thumb.jpg"
+		other    = "robots.txt"
+	)
+	for _, name := range []string{kept, orphaned, other} {
+		if err := images.Put(ctx, name, strings.NewReader("x"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := n.DB.AddNovel(ctx, &Novel{Title: "kept", ImageURL: images.URL(kept)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if garbage, err := n.collectImageGarbage(ctx, time.Hour, false); err != nil || len(garbage) != 0 {
+		t.Errorf("collectImageGarbage with recent images: got %v, %v, want nothing", garbage, err)
+	}
+	var out bytes.Buffer
+	if err := n.gcCommand(ctx, []string{"-dry-run", "-min-age=0"}, &out); err != nil {
+		t.Fatalf("gc -dry-run: %v", err)
+	}
+	if got, want := out.String(), "would delete "+orphaned+"\n1 unreferenced images\n"; got != want {
+		t.Errorf("gc -dry-run printed %q, want %q", got, want)
+	}
+	if _, _, err := images.Get(ctx, orphaned); err != nil {
+		t.Errorf("gc -dry-run deleted %s: %v", orphaned, err)
+	}
+
+	garbage, err := n.collectImageGarbage(ctx, 0, false)
+	if err != nil {
+		t.Fatalf("collectImageGarbage: %v", err)
+	}
+	if len(garbage) != 1 || garbage[0] != orphaned {
+		t.Errorf("collectImageGarbage: got %v, want [%s]", garbage, orphaned)
+	}
+	left, err := images.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, img := range left {
+		names = append(names, img.Name)
+	}
+	if got, want := strings.Join(names, " "), kept+" "+other; got != want {
+		t.Errorf("images left: got %s, want %s", got, want)
+	}
+}
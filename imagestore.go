@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrImageNotFound is returned by ImageStore implementations when the
+// requested image does not exist.
+var ErrImageNotFound = errors.New("image not found")
+
+// ImageStore stores cover images under flat names such as
+// "6ba7b810-9dad-11d1-80b4-00c04fd430c8.jpg".
+type ImageStore interface {
+	// Put stores the contents of r as name, replacing any existing image.
+	Put(ctx context.Context, name string, r io.Reader, contentType string) error
+	// Get opens the image stored as name. The caller must close it.
+	Get(ctx context.Context, name string) (rc io.ReadCloser, contentType string, err error)
+	// Delete removes the image stored as name.
+	Delete(ctx context.Context, name string) error
+	// URL returns the URL the image stored as name is served from.
+	URL(name string) string
+	// Name returns the name of the image served from url, or false if url
+	// does not point into this store.
+	Name(url string) (name string, ok bool)
+	// List returns every image in the store.
+	List(ctx context.Context) ([]ImageInfo, error)
+}
+
+// ImageInfo describes a stored image.
+type ImageInfo struct {
+	Name    string
+	Updated time.Time
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"io"
+	"strings"
+)
+
+// gcsImageStore is an ImageStore backed by a publicly readable Cloud
+// Storage bucket.
+type gcsImageStore struct {
+	bucket     *storage.BucketHandle
+	bucketName string
+}
+
+var _ ImageStore = &gcsImageStore{}
+
+func newGCSImageStore(ctx context.Context, bucketName string) (*gcsImageStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	return &gcsImageStore{bucket: client.Bucket(bucketName), bucketName: bucketName}, nil
+}
+
+func (s *gcsImageStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	if _, err := s.bucket.Attrs(ctx); err != nil {
+		if err == storage.ErrBucketNotExist {
+			return fmt.Errorf("gcsimagestore: bucket %q does not exist", s.bucketName)
+		}
+		return fmt.Errorf("gcsimagestore: could not get bucket: %v", err)
+	}
+
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	w.ContentType = contentType
+	w.CacheControl = "public, max-age=86400"
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("gcsimagestore: could not write %q: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("gcsimagestore: could not write %q: %v", name, err)
+	}
+	return nil
+}
+
+func (s *gcsImageStore) Get(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, "", fmt.Errorf("gcsimagestore: %q: %w", name, ErrImageNotFound)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("gcsimagestore: could not read %q: %v", name, err)
+	}
+	return r, r.Attrs.ContentType, nil
+}
+
+func (s *gcsImageStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return fmt.Errorf("gcsimagestore: %q: %w", name, ErrImageNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("gcsimagestore: could not delete %q: %v", name, err)
+	}
+	return nil
+}
+
+const gcsPublicURL = "https://storage.googleapis.com/%s/%s"
+
+func (s *gcsImageStore) URL(name string) string {
+	return fmt.Sprintf(gcsPublicURL, s.bucketName, name)
+}
+
+func (s *gcsImageStore) Name(url string) (string, bool) {
+	prefix := fmt.Sprintf(gcsPublicURL, s.bucketName, "")
+	if !strings.HasPrefix(url, prefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(url, prefix)
+	return name, name != "" && !strings.Contains(name, "/")
+}
+
+func (s *gcsImageStore) List(ctx context.Context) ([]ImageInfo, error) {
+	var images []ImageInfo
+	it := s.bucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return images, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gcsimagestore: could not list objects: %v", err)
+		}
+		images = append(images, ImageInfo{Name: attrs.Name, Updated: attrs.Updated})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// localImagesPath is the URL path localImageStore serves images under.
+const localImagesPath = "/images/"
+
+// localImageStore is an ImageStore that keeps images in a directory on
+// local disk and serves them from the app itself, for development and
+// single-machine deployments. The content type of an image is derived
+// from the extension of its name.
+type localImageStore struct {
+	dir string
+}
+
+var _ ImageStore = &localImageStore{}
+var _ http.Handler = &localImageStore{}
+
+func newLocalImageStore(dir string) (*localImageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("localimagestore: %v", err)
+	}
+	return &localImageStore{dir: dir}, nil
+}
+
+// path returns the file name is stored in, rejecting names that would
+// escape the store's directory.
+func (s *localImageStore) path(name string) (string, error) {
+	if name == "" || name != path.Base(name) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("localimagestore: invalid image name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *localImageStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a failed upload never leaves
+	// a truncated image behind.
+	f, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return fmt.Errorf("localimagestore: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("localimagestore: could not write %q: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("localimagestore: could not write %q: %v", name, err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("localimagestore: could not write %q: %v", name, err)
+	}
+	return nil
+}
+
+func (s *localImageStore) Get(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("localimagestore: %q: %w", name, ErrImageNotFound)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("localimagestore: could not read %q: %v", name, err)
+	}
+	return f, mime.TypeByExtension(path.Ext(name)), nil
+}
+
+func (s *localImageStore) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("localimagestore: %q: %w", name, ErrImageNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("localimagestore: could not delete %q: %v", name, err)
+	}
+	return nil
+}
+
+func (s *localImageStore) URL(name string) string {
+	return localImagesPath + name
+}
+
+func (s *localImageStore) Name(url string) (string, bool) {
+	if !strings.HasPrefix(url, localImagesPath) {
+		return "", false
+	}
+	name := strings.TrimPrefix(url, localImagesPath)
+	if _, err := s.path(name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// List returns the images in the store's directory, skipping temporary
+// files of uploads in progress.
+func (s *localImageStore) List(ctx context.Context) ([]ImageInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("localimagestore: %v", err)
+	}
+	var images []ImageInfo
+	for _, fi := range infos {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		images = append(images, ImageInfo{Name: fi.Name(), Updated: fi.ModTime()})
+	}
+	return images, nil
+}
+
+// ServeHTTP serves the image named by the last element of the request
+// path.
+func (s *localImageStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := s.path(strings.TrimPrefix(r.URL.Path, localImagesPath))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, p)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLocalImageStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "novelshelf-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newLocalImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(ctx, "cover.png", strings.NewReader("png bytes"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, contentType, err := s.Get(ctx, "cover.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "png bytes"; got != want {
+		t.Errorf("Get: got %q, want %q", got, want)
+	}
+	if got, want := contentType, "image/png"; got != want {
+		t.Errorf("Get: got content type %q, want %q", got, want)
+	}
+
+	if got, want := s.URL("cover.png"), "/images/cover.png"; got != want {
+		t.Errorf("URL: got %q, want %q", got, want)
+	}
+	if name, ok := s.Name("/images/cover.png"); !ok || name != "cover.png" {
+		t.Errorf("Name: got %q, %v, want %q, true", name, ok, "cover.png")
+	}
+	for _, url := range []string{"https://example.com/images/cover.png", "/images/../cover.png", "/images/"} {
+		if name, ok := s.Name(url); ok {
+			t.Errorf("Name(%q): got %q, want not ok", url, name)
+		}
+	}
+	images, err := s.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(images) != 1 || images[0].Name != "cover.png" || images[0].Updated.IsZero() {
+		t.Errorf("List: got %+v, want cover.png", images)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/images/cover.png", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP: got status %d, want %d", got, want)
+	}
+	if got, want := rec.Body.String(), "png bytes"; got != want {
+		t.Errorf("ServeHTTP: got body %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"../cover.png", "a/b.png", ".hidden", ""} {
+		if err := s.Put(ctx, name, strings.NewReader("x"), "image/png"); err == nil {
+			t.Errorf("Put(%q): want error", name)
+		}
+	}
+
+	if err := s.Delete(ctx, "cover.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := s.Get(ctx, "cover.png"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Get after delete: got err %v, want ErrImageNotFound", err)
+	}
+	if err := s.Delete(ctx, "cover.png"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Delete after delete: got err %v, want ErrImageNotFound", err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxImportSize caps the size of an import, and of a single line of a
+// JSON Lines import.
+const maxImportSize = 16 << 20
+
+// importFormat is a file format novels can be imported from.
+type importFormat string
+
+const (
+	// importCSV has a header row naming the columns, by the names or
+	// labels of novelFields, and then a novel per row. Values are written
+	// as in the edit form.
+	importCSV importFormat = "csv"
+	// importJSONL has a novel per line, written as in the API.
+	importJSONL importFormat = "jsonl"
+)
+
+// importFormatOf returns the import format of a request body with the
+// given Content-Type.
+func importFormatOf(contentType string) (importFormat, bool) {
+	t, _, _ := mime.ParseMediaType(contentType)
+	switch t {
+	case "text/csv":
+		return importCSV, true
+	case "application/x-ndjson":
+		return importJSONL, true
+	}
+	return "", false
+}
+
+// importRowError reports what is wrong with a row of an import. Rows are
+// numbered from 1 as a spreadsheet numbers them, so the first novel of a
+// CSV import is in row 2, after the header, and the first novel of a JSON
+// Lines import is in row 1.
+type importRowError struct {
+	Row     int              `json:"row"`
+	Message string           `json:"message,omitempty"`
+	Fields  ValidationErrors `json:"fields,omitempty"`
+}
+
+func (e importRowError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("row %d: %s", e.Row, e.Message)
+	}
+	return fmt.Sprintf("row %d: %v", e.Row, e.Fields)
+}
+
+// importResult reports the outcome of an import.
+type importResult struct {
+	DryRun bool             `json:"dryRun"`
+	Rows   int              `json:"rows"`  // number of novels read
+	Added  []string         `json:"added"` // IDs of the novels added
+	Errors []importRowError `json:"errors,omitempty"`
+}
+
+// importRow is a novel read from an import, together with any problems
+// found in it.
+type importRow struct {
+	novel *Novel // nil if the row could not be read
+	err   importRowError
+}
+
+// readImport reads the novels in r. Problems with single rows are
+// reported on the rows; an error is returned only if r cannot be read at
+// all, such as a CSV file with an unknown column.
+func readImport(r io.Reader, format importFormat) ([]importRow, error) {
+	switch format {
+	case importCSV:
+		return readCSVImport(r)
+	case importJSONL:
+		return readJSONLImport(r)
+	}
+	return nil, fmt.Errorf("import: unknown format %q", format)
+}
+
+// importColumn returns the novel field a CSV column header names.
+func importColumn(header string) (novelField, bool) {
+	header = strings.TrimSpace(header)
+	for _, f := range novelFields {
+		if strings.EqualFold(header, f.name) || (f.label != "" && strings.EqualFold(header, f.label)) {
+			return f, true
+		}
+	}
+	return novelField{}, false
+}
+
+func readCSVImport(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("import: the CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("import: %v", err)
+	}
+	// Spreadsheets often save CSV files with a byte order mark.
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	columns := make([]novelField, len(header))
+	seen := make(map[string]bool)
+	for i, h := range header {
+		f, ok := importColumn(h)
+		if !ok {
+			return nil, fmt.Errorf("import: unknown column %q", h)
+		}
+		if seen[f.name] {
+			return nil, fmt.Errorf("import: column %q appears twice", h)
+		}
+		seen[f.name] = true
+		columns[i] = f
+	}
+
+	var rows []importRow
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("import: %v", err)
+		}
+		ir := importRow{err: importRowError{Row: row}}
+		if len(record) != len(columns) {
+			ir.err.Message = fmt.Sprintf("has %d columns, want %d", len(record), len(columns))
+			rows = append(rows, ir)
+			continue
+		}
+		p := NovelPatch{Fields: make(map[string]interface{})}
+		for i, f := range columns {
+			v, err := f.parseFormValue(record[i])
+			if err != nil {
+				if ir.err.Fields == nil {
+					ir.err.Fields = ValidationErrors{}
+				}
+				ir.err.Fields[f.name] = err.Error()
+				continue
+			}
+			p.Fields[f.name] = v
+		}
+		ir.novel = &Novel{}
+		p.apply(ir.novel)
+		rows = append(rows, ir)
+	}
+}
+
+func readJSONLImport(r io.Reader) ([]importRow, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxImportSize)
+	var rows []importRow
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		ir := importRow{err: importRowError{Row: line}}
+		novel := &Novel{}
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(novel); err != nil {
+			ir.err.Message = err.Error()
+		} else {
+			ir.novel = novel
+		}
+		rows = append(rows, ir)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("import: %v", err)
+	}
+	return rows, nil
+}
+
+// importNovels validates the novels read from an import and, unless
+// dryRun is set, adds them to the shelf of the user with ID owner. Nothing
+// is added unless every row is valid. The novels are added in batches; if
+// adding one fails, the result lists the novels added before.
+func (n *Novelshelf) importNovels(ctx context.Context, rows []importRow, owner string, dryRun bool) (*importResult, error) {
+	res := &importResult{DryRun: dryRun, Rows: len(rows), Added: []string{}}
+	var novels []*Novel
+	for _, row := range rows {
+		if row.novel != nil {
+			for f, msg := range validateNovel(row.novel) {
+				if row.err.Fields == nil {
+					row.err.Fields = ValidationErrors{}
+				}
+				// A value that could not be parsed has been left out, so
+				// its parse error explains the problem better.
+				if _, ok := row.err.Fields[f]; !ok {
+					row.err.Fields[f] = msg
+				}
+			}
+		}
+		if row.err.Message != "" || len(row.err.Fields) > 0 {
+			res.Errors = append(res.Errors, row.err)
+			continue
+		}
+		novel := row.novel
+		novel.ID = ""
+		novel.CreatedAt = time.Time{}
+		novel.CreatedBy = owner
+		novel.Version = 0
+		novel.DeletedAt = nil
+		novels = append(novels, novel)
+	}
+	if dryRun || len(res.Errors) > 0 {
+		return res, nil
+	}
+	for start := 0; start < len(novels); start += maxNovelBatch {
+		end := start + maxNovelBatch
+		if end > len(novels) {
+			end = len(novels)
+		}
+		ids, err := n.DB.AddNovels(ctx, novels[start:end])
+		res.Added = append(res.Added, ids...)
+		if err != nil {
+			return res, fmt.Errorf("import: could not add novels: %v", err)
+		}
+	}
+	return res, nil
+}
+
+// apiImportHandler adds the novels in a CSV (text/csv) or JSON Lines
+// (application/x-ndjson) body to the shelf of the signed-in user. With
+// dryRun=true it only validates them. If any row is invalid nothing is
+// added and the rows' errors are returned with status 400.
+func (n *Novelshelf) apiImportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	format, ok := importFormatOf(r.Header.Get("Content-Type"))
+	if !ok {
+		e := n.badRequestf(r, errors.New("unsupported import type"), "imports must be text/csv or application/x-ndjson")
+		e.Code = http.StatusUnsupportedMediaType
+		return e
+	}
+	rows, err := readImport(http.MaxBytesReader(w, r.Body, maxImportSize), format)
+	if err != nil {
+		return n.badRequestf(r, err, "%v", err)
+	}
+	if len(rows) == 0 {
+		return n.badRequestf(r, errors.New("empty import"), "the import contains no novels")
+	}
+	var owner string
+	if u := userFromContext(r.Context()); u != nil {
+		owner = u.ID
+	}
+	res, err := n.importNovels(r.Context(), rows, owner, r.FormValue("dryRun") == "true")
+	if err != nil {
+		return n.appErrorf(r, err, "%v; %d novels were added", err, len(res.Added))
+	}
+	switch {
+	case len(res.Errors) > 0:
+		return n.writeJSON(w, r, http.StatusBadRequest, res)
+	case res.DryRun:
+		return n.writeJSON(w, r, http.StatusOK, res)
+	}
+	return n.writeJSON(w, r, http.StatusCreated, res)
+}
+
+// importCommand implements "novelshelf import", which adds the novels in
+// a CSV or JSON Lines file. The file "-" is standard input.
+func (n *Novelshelf) importCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(out)
+	format := fs.String("format", "", "csv or jsonl; by default taken from the file extension")
+	dryRun := fs.Bool("dry-run", false, "only check the file")
+	ownerEmail := fs.String("owner", "", "email address of the user whose shelf the novels are put on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("import: give one file to import")
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			*format = string(importCSV)
+		case ".jsonl", ".ndjson":
+			*format = string(importJSONL)
+		default:
+			return fmt.Errorf("import: cannot tell the format of %s; use -format", path)
+		}
+	}
+	var owner string
+	if *ownerEmail != "" {
+		u, err := n.Users.GetUserByEmail(ctx, *ownerEmail)
+		if err != nil {
+			return fmt.Errorf("import: owner: %w", err)
+		}
+		owner = u.ID
+	}
+
+	in := commandInput
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("import: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	rows, err := readImport(in, importFormat(*format))
+	if err != nil {
+		return err
+	}
+	res, err := n.importNovels(ctx, rows, owner, *dryRun)
+	for _, e := range res.Errors {
+		fmt.Fprintln(out, e)
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(out, "%d of %d novels added\n", len(res.Added), res.Rows)
+		return err
+	case len(res.Errors) > 0:
+		return fmt.Errorf("import: %d of %d rows are invalid; nothing was added", len(res.Errors), res.Rows)
+	case res.DryRun:
+		fmt.Fprintf(out, "%d novels are ready to import\n", res.Rows)
+	default:
+		fmt.Fprintf(out, "%d novels added\n", len(res.Added))
+	}
+	return nil
+}
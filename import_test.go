@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadImport(t *testing.T) {
+	csvFile := "\ufefftitle,Author,Date published,Pages,genres\n" +
+		"吾輩は猫である,夏目漱石,1905,\"470\",\"小説, 風刺\"\n" +
+		"nameless,,,many,\n" +
+		"short\n"
+	rows, err := readImport(strings.NewReader(csvFile), importCSV)
+	if err != nil {
+		t.Fatalf("CSV: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("CSV: got %d rows, want 3", len(rows))
+	}
+	if got := rows[0].novel; got == nil || got.Title != "吾輩は猫である" || got.Author != "夏目漱石" || got.PublishedDate != "1905" || got.PageCount != 470 || validateNovel(got) != nil || got.GenreList() != "小説, 風刺" {
+		t.Errorf("CSV row 2: got %+v", got)
+	}
+	if rows[1].err.Row != 3 || rows[1].err.Fields["pageCount"] == "" {
+		t.Errorf("CSV row 3: got error %+v, want a pageCount error", rows[1].err)
+	}
+	if rows[2].novel != nil || rows[2].err.Row != 4 || rows[2].err.Message == "" {
+		t.Errorf("CSV row 4: got %+v, want a column count error", rows[2])
+	}
+	for _, bad := range []string{"", "title,rating\nx,5\n", "title,Title\nx,y\n"} {
+		if _, err := readImport(strings.NewReader(bad), importCSV); err == nil {
+			t.Errorf("CSV %q: want error", bad)
+		}
+	}
+
+	jsonl := `{"title": "こころ", "author": "夏目漱石", "genres": ["小説"]}` + "\n\n" +
+		`{"title": "rated", "rating": 5}` + "\n" +
+		`not json` + "\n"
+	rows, err = readImport(strings.NewReader(jsonl), importJSONL)
+	if err != nil {
+		t.Fatalf("JSON Lines: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("JSON Lines: got %d rows, want 3", len(rows))
+	}
+	if got := rows[0].novel; got == nil || got.Title != "こころ" || got.GenreList() != "小説" {
+		t.Errorf("JSON Lines line 1: got %+v", got)
+	}
+	if rows[1].err.Row != 3 || rows[1].err.Message == "" || rows[2].err.Row != 4 || rows[2].err.Message == "" {
+		t.Errorf("JSON Lines: got errors %+v and %+v, want errors in lines 3 and 4", rows[1].err, rows[2].err)
+	}
+}
+
+func TestAPIImport(t *testing.T) {
+	ctx := context.Background()
+	n.DB = testDBs["memory"]
+
+	post := func(contentType, query, body string) (*http.Response, *importResult) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", serv.URL+"/api/v1/novels:import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := wt.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res importResult
+		json.NewDecoder(resp.Body).Decode(&res)
+		return resp, &res
+	}
+
+	const valid = "title,author\n坑夫,夏目漱石\n虞美人草,夏目漱石\n"
+	resp, res := post("text/csv", "?dryRun=true", valid)
+	if resp.StatusCode != http.StatusOK || !res.DryRun || res.Rows != 2 || len(res.Added) != 0 {
+		t.Errorf("dry run: got status %d, %+v", resp.StatusCode, res)
+	}
+	if page, _ := n.DB.ListNovelsPage(ctx, ListOptions{Author: "夏目漱石"}); len(page.Novels) != 0 {
+		t.Errorf("dry run: added %d novels", len(page.Novels))
+	}
+
+	resp, res = post("text/csv", "", valid+",nobody\n")
+	if resp.StatusCode != http.StatusBadRequest || len(res.Added) != 0 || len(res.Errors) != 1 || res.Errors[0].Row != 4 || res.Errors[0].Fields["title"] == "" {
+		t.Errorf("invalid row: got status %d, %+v", resp.StatusCode, res)
+	}
+
+	resp, res = post("text/csv", "", valid)
+	if resp.StatusCode != http.StatusCreated || len(res.Added) != 2 {
+		t.Fatalf("import: got status %d, %+v", resp.StatusCode, res)
+	}
+	for _, id := range res.Added {
+		defer n.DB.DeleteNovel(ctx, id)
+		novel, err := n.DB.GetNovel(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if novel.Author != "夏目漱石" || novel.CreatedBy != testUser.ID {
+			t.Errorf("imported novel: got %+v, want it on the shelf of %s", novel, testUser.ID)
+		}
+	}
+
+	resp, res = post("application/x-ndjson", "", `{"title": "それから", "id": "taken", "version": 7}`)
+	if resp.StatusCode != http.StatusCreated || len(res.Added) != 1 {
+		t.Fatalf("JSON Lines import: got status %d, %+v", resp.StatusCode, res)
+	}
+	defer n.DB.DeleteNovel(ctx, res.Added[0])
+	if novel, err := n.DB.GetNovel(ctx, res.Added[0]); err != nil || novel.ID == "taken" || novel.Version != 1 {
+		t.Errorf("JSON Lines import: got %+v, %v, want a new novel", novel, err)
+	}
+
+	if resp, _ := post("application/json", "", `{"title": "x"}`); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("JSON import: got status %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+	if resp, _ := post("text/csv", "", "title\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty import: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDB()
+	shelf := &Novelshelf{DB: db, Users: db, logWriter: ioutil.Discard}
+	owner := &User{Email: "importer@example.com", Role: RoleEditor}
+	if _, err := db.AddUser(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	defer func(r io.Reader) { commandInput = r }(commandInput)
+
+	var out bytes.Buffer
+	commandInput = strings.NewReader(`{"title": "門"}` + "\n" + `{"title": ""}` + "\n")
+	if err := shelf.importCommand(ctx, []string{"-format", "jsonl", "-"}, &out); err == nil || !strings.Contains(out.String(), "row 2: ") {
+		t.Errorf("import with an invalid row: got %v, output %q", err, out.String())
+	}
+	if novels, _ := db.ListNovels(ctx); len(novels) != 0 {
+		t.Errorf("import with an invalid row: added %d novels", len(novels))
+	}
+
+	commandInput = strings.NewReader(`{"title": "門"}` + "\n")
+	if err := shelf.importCommand(ctx, []string{"-format", "jsonl", "-owner", owner.Email, "-"}, &out); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	novels, _ := db.ListNovels(ctx)
+	if len(novels) != 1 || novels[0].Title != "門" || novels[0].CreatedBy != owner.ID {
+		t.Errorf("import: got %+v", novels)
+	}
+	if err := shelf.importCommand(ctx, []string{"novels.xlsx"}, &out); err == nil {
+		t.Error("import of an unknown format: want error")
+	}
+}
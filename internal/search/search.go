@@ -0,0 +1,221 @@
+// Package search implements a small in-memory full-text index.
+//
+// Text is normalized with NFKC and lower-cased, then split into tokens:
+// runs of letters and digits in alphabetic scripts become one token per
+// word, while runs of Han, Hiragana and Katakana characters, which are
+// written without spaces, become overlapping character bigrams. Documents
+// additionally index each of those characters on its own so that
+// single-character queries such as "猫" match. A query matches a document
+// when every query token occurs in it.
+package search
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Field is a piece of document text. Matches in fields with a higher
+// Weight rank higher.
+type Field struct {
+	Text   string
+	Weight float64
+}
+
+// Result is a matching document and its relevance score.
+type Result struct {
+	ID    string
+	Score float64
+}
+
+// Index is an inverted index from tokens to document IDs. It is safe for
+// concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]float64 // token -> doc ID -> weighted term frequency
+	docs     map[string][]string           // doc ID -> distinct tokens
+}
+
+// New returns an empty Index.
+func New() *Index {
+	return &Index{
+		postings: make(map[string]map[string]float64),
+		docs:     make(map[string][]string),
+	}
+}
+
+// Add indexes the document with the given ID, replacing any previous
+// entry for it.
+func (ix *Index) Add(id string, fields ...Field) {
+	tf := make(map[string]float64)
+	for _, f := range fields {
+		for _, tok := range tokenize(f.Text, true) {
+			tf[tok] += f.Weight
+		}
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+	toks := make([]string, 0, len(tf))
+	for tok, w := range tf {
+		p, ok := ix.postings[tok]
+		if !ok {
+			p = make(map[string]float64)
+			ix.postings[tok] = p
+		}
+		p[id] = w
+		toks = append(toks, tok)
+	}
+	ix.docs[id] = toks
+}
+
+// Remove drops the document with the given ID from the index.
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	for _, tok := range ix.docs[id] {
+		p := ix.postings[tok]
+		delete(p, id)
+		if len(p) == 0 {
+			delete(ix.postings, tok)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// Len returns the number of indexed documents.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Search returns the documents matching every token of q, best match
+// first. Scores are the sum of weighted term frequency times inverse
+// document frequency over the query tokens.
+func (ix *Index) Search(q string) []Result {
+	toks := Tokenize(q)
+	if len(toks) == 0 {
+		return nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	scores := make(map[string]float64)
+	for i, tok := range dedupe(toks) {
+		p := ix.postings[tok]
+		if len(p) == 0 {
+			return nil
+		}
+		idf := math.Log(1 + float64(len(ix.docs))/float64(len(p)))
+		if i == 0 {
+			for id, w := range p {
+				scores[id] = w * idf
+			}
+			continue
+		}
+		for id := range scores {
+			w, ok := p[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] += w * idf
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, s := range scores {
+		results = append(results, Result{ID: id, Score: s})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Tokenize splits the query s into normalized search tokens.
+func Tokenize(s string) []string {
+	return tokenize(s, false)
+}
+
+// tokenize splits s into tokens. When unigrams is set, every character of a
+// CJK run is also emitted as a token of its own.
+func tokenize(s string, unigrams bool) []string {
+	s = strings.ToLower(norm.NFKC.String(s))
+
+	var toks []string
+	var run []rune
+	cjk := false
+	flush := func() {
+		switch {
+		case len(run) == 0:
+		case !cjk:
+			toks = append(toks, string(run))
+		case len(run) == 1:
+			toks = append(toks, string(run))
+		default:
+			for i := 0; i+1 < len(run); i++ {
+				toks = append(toks, string(run[i:i+2]))
+			}
+			if unigrams {
+				for _, r := range run {
+					toks = append(toks, string(r))
+				}
+			}
+		}
+		run = run[:0]
+	}
+	for _, r := range s {
+		switch {
+		case isCJK(r):
+			if !cjk {
+				flush()
+				cjk = true
+			}
+			run = append(run, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			if cjk {
+				flush()
+				cjk = false
+			}
+			run = append(run, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return toks
+}
+
+// isCJK reports whether r belongs to a script that is written without
+// spaces between words. The prolonged sound mark is included so that
+// Katakana words such as "データ" stay in one run.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) || r == 'ー' || r == '々'
+}
+
+func dedupe(toks []string) []string {
+	seen := make(map[string]bool, len(toks))
+	out := toks[:0:0]
+	for _, t := range toks {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
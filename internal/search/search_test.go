@@ -0,0 +1,64 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"Hello, World", []string{"hello", "world"}},
+		{"ＧＯ言語", []string{"go", "言語"}},
+		{"吾輩は猫である", []string{"吾輩", "輩は", "は猫", "猫で", "であ", "ある"}},
+		{"猫 と データ", []string{"猫", "と", "デー", "ータ"}},
+		{"  ", nil},
+	}
+	for _, tc := range tests {
+		if got := Tokenize(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	ix := New()
+	ix.Add("1", Field{Text: "吾輩は猫である", Weight: 3}, Field{Text: "夏目漱石", Weight: 2})
+	ix.Add("2", Field{Text: "坊っちゃん", Weight: 3}, Field{Text: "夏目漱石", Weight: 2}, Field{Text: "猫は出てこない", Weight: 1})
+	ix.Add("3", Field{Text: "Norwegian Wood", Weight: 3}, Field{Text: "Haruki Murakami", Weight: 2})
+
+	ids := func(rs []Result) []string {
+		var out []string
+		for _, r := range rs {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+
+	if got, want := ids(ix.Search("猫")), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search(猫) = %v, want %v", got, want)
+	}
+	if got, want := ids(ix.Search("夏目 坊っちゃん")), []string{"2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search(夏目 坊っちゃん) = %v, want %v", got, want)
+	}
+	if got, want := ids(ix.Search("murakami")), []string{"3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search(murakami) = %v, want %v", got, want)
+	}
+	if got := ix.Search("tolstoy"); len(got) != 0 {
+		t.Errorf("Search(tolstoy) = %v, want no results", got)
+	}
+
+	ix.Add("1", Field{Text: "こころ", Weight: 3})
+	if got, want := ids(ix.Search("猫")), []string{"2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after re-add: Search(猫) = %v, want %v", got, want)
+	}
+	ix.Remove("2")
+	if got := ix.Search("猫"); len(got) != 0 {
+		t.Errorf("after remove: Search(猫) = %v, want no results", got)
+	}
+	if got, want := ix.Len(), 2; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
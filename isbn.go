@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+)
+
+// ErrBookNotFound is returned by MetadataProvider implementations when
+// they know no book with the requested ISBN.
+var ErrBookNotFound = errors.New("book not found")
+
+// MetadataProvider looks up bibliographic data for a book by its ISBN.
+type MetadataProvider interface {
+	// LookupISBN returns the metadata for the book with the given ISBN-13.
+	LookupISBN(ctx context.Context, isbn13 string) (*BookMetadata, error)
+}
+
+// BookMetadata is what a MetadataProvider knows about a book: the fields
+// to prefill a Novel with, and the URL of a cover image to import, if any.
+type BookMetadata struct {
+	Novel    *Novel `json:"novel"`
+	CoverURL string `json:"coverURL,omitempty"`
+}
+
+// lookupISBN validates and normalizes isbn, which may be an ISBN-10 or
+// ISBN-13, and looks it up with n.ISBN. The metadata returned has been
+// through validateNovel; fields the provider got wrong are dropped rather
+// than reported.
+func (n *Novelshelf) lookupISBN(ctx context.Context, isbn string) (*BookMetadata, error) {
+	if n.ISBN == nil {
+		return nil, errors.New("ISBN lookup is not configured - set NOVELSHELF_ISBN_PROVIDER")
+	}
+	var isbn10, isbn13 string
+	if len(cleanISBN(isbn)) == 10 {
+		isbn10 = isbn
+	} else {
+		isbn13 = isbn
+	}
+	isbn10, isbn13, errs := normalizeISBNs(isbn10, isbn13)
+	if errs != nil || isbn13 == "" {
+		return nil, ValidationErrors{"isbn": "must be a valid ISBN-10 or ISBN-13"}
+	}
+
+	md, err := n.ISBN.LookupISBN(ctx, isbn13)
+	if err != nil {
+		return nil, err
+	}
+	novel := md.Novel
+	if novel == nil {
+		novel = &Novel{}
+	}
+	novel.ID = ""
+	novel.ImageURL, novel.ThumbnailURL = "", ""
+	novel.ISBN10, novel.ISBN13 = isbn10, isbn13
+	for field := range validateNovel(novel) {
+		switch field {
+		case "title":
+			// Missing titles are left for the user to fill in.
+		case "publishedDate":
+			novel.PublishedDate = ""
+		case "language":
+			novel.Language = ""
+		case "pageCount":
+			novel.PageCount = 0
+		case "genres":
+			novel.Genres = nil
+		}
+	}
+	coverURL := md.CoverURL
+	if coverURL != "" && validateImageURL(coverURL) != nil {
+		coverURL = ""
+	}
+	return &BookMetadata{Novel: novel, CoverURL: coverURL}, nil
+}
+
+func (n *Novelshelf) apiISBNHandler(w http.ResponseWriter, r *http.Request) *appError {
+	md, err := n.lookupISBN(r.Context(), mux.Vars(r)["isbn"])
+	if err != nil {
+		return n.appErrorf(r, err, "could not look up ISBN: %v", err)
+	}
+	return n.writeJSON(w, r, http.StatusOK, md)
+}
+
+// fixtureProvider is a MetadataProvider answering from a fixed set of
+// books, for tests and offline development. Books are keyed by ISBN-13.
+type fixtureProvider struct {
+	books map[string]*BookMetadata
+}
+
+var _ MetadataProvider = &fixtureProvider{}
+
+// newFixtureProvider reads the books of a fixtureProvider from the JSON
+// file at path, an object mapping ISBN-13s to BookMetadata.
+func newFixtureProvider(path string) (*fixtureProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fixtureprovider: %v", err)
+	}
+	books := make(map[string]*BookMetadata)
+	if err := json.Unmarshal(b, &books); err != nil {
+		return nil, fmt.Errorf("fixtureprovider: could not parse %s: %v", path, err)
+	}
+	return &fixtureProvider{books: books}, nil
+}
+
+func (p *fixtureProvider) LookupISBN(ctx context.Context, isbn13 string) (*BookMetadata, error) {
+	md, ok := p.books[isbn13]
+	if !ok {
+		return nil, fmt.Errorf("fixtureprovider: %s: %w", isbn13, ErrBookNotFound)
+	}
+	// Hand out a copy so callers can modify the Novel.
+	novel := Novel{}
+	if md.Novel != nil {
+		novel = *md.Novel
+	}
+	return &BookMetadata{Novel: &novel, CoverURL: md.CoverURL}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// openLibraryURL is the base URL of the Open Library API.
+const openLibraryURL = "https://openlibrary.org"
+
+// openLibraryProvider is a MetadataProvider backed by the Open Library
+// Books API, or any service answering in the same format.
+type openLibraryProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+var _ MetadataProvider = &openLibraryProvider{}
+
+func newOpenLibraryProvider(baseURL string) *openLibraryProvider {
+	if baseURL == "" {
+		baseURL = openLibraryURL
+	}
+	return &openLibraryProvider{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// openLibraryBook is the part of a jscmd=data response the provider uses.
+type openLibraryBook struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle"`
+	Authors  []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	Publishers []struct {
+		Name string `json:"name"`
+	} `json:"publishers"`
+	PublishDate   string `json:"publish_date"`
+	NumberOfPages int    `json:"number_of_pages"`
+	Subjects      []struct {
+		Name string `json:"name"`
+	} `json:"subjects"`
+	Excerpts []struct {
+		Text string `json:"text"`
+	} `json:"excerpts"`
+	Cover struct {
+		Small  string `json:"small"`
+		Medium string `json:"medium"`
+		Large  string `json:"large"`
+	} `json:"cover"`
+}
+
+func (p *openLibraryProvider) LookupISBN(ctx context.Context, isbn13 string) (*BookMetadata, error) {
+	key := "ISBN:" + isbn13
+	q := url.Values{"bibkeys": {key}, "format": {"json"}, "jscmd": {"data"}}
+	req, err := http.NewRequest("GET", p.baseURL+"/api/books?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("openlibrary: %v", err)
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("openlibrary: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openlibrary: lookup of %s: %s", isbn13, resp.Status)
+	}
+	var books map[string]*openLibraryBook
+	if err := json.NewDecoder(resp.Body).Decode(&books); err != nil {
+		return nil, fmt.Errorf("openlibrary: could not decode response: %v", err)
+	}
+	b, ok := books[key]
+	if !ok || b == nil {
+		return nil, fmt.Errorf("openlibrary: %s: %w", isbn13, ErrBookNotFound)
+	}
+
+	novel := &Novel{Title: b.Title, PageCount: b.NumberOfPages}
+	if b.Subtitle != "" {
+		novel.Title += ": " + b.Subtitle
+	}
+	var authors []string
+	for _, a := range b.Authors {
+		authors = append(authors, a.Name)
+	}
+	novel.Author = strings.Join(authors, ", ")
+	if len(b.Publishers) > 0 {
+		novel.Publisher = b.Publishers[0].Name
+	}
+	// Open Library dates are free-form; keep only those we understand.
+	if d, err := ParsePartialDate(strings.TrimSpace(b.PublishDate)); err == nil {
+		novel.PublishedDate = d
+	}
+	for _, s := range b.Subjects {
+		if len(novel.Genres) == maxGenres {
+			break
+		}
+		novel.Genres = append(novel.Genres, s.Name)
+	}
+	if len(b.Excerpts) > 0 {
+		novel.Description = b.Excerpts[0].Text
+	}
+
+	md := &BookMetadata{Novel: novel}
+	for _, u := range []string{b.Cover.Large, b.Cover.Medium, b.Cover.Small} {
+		if u != "" {
+			md.CoverURL = u
+			break
+		}
+	}
+	return md, nil
+}
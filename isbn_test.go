@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFixtureProvider(t *testing.T) {
+	ctx := context.Background()
+	p, err := newFixtureProvider("testdata/isbn.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Novelshelf{ISBN: p, logWriter: ioutil.Discard}
+
+	md, err := n.lookupISBN(ctx, "978-4-10-101013-7")
+	if err != nil {
+		t.Fatalf("lookupISBN: %v", err)
+	}
+	if got, want := md.Novel.Author, "夏目漱石"; got != want {
+		t.Errorf("Author = %q, want %q", got, want)
+	}
+	if got, want := md.Novel.PublishedDate, PartialDate("1952-02"); got != want {
+		t.Errorf("PublishedDate = %q, want %q", got, want)
+	}
+	md.Novel.Title = "changed"
+
+	// ISBN-10s are looked up by their ISBN-13, and invalid fields from the
+	// provider are dropped.
+	md, err = n.lookupISBN(ctx, "080442957X")
+	if err != nil {
+		t.Fatalf("lookupISBN: %v", err)
+	}
+	if md.Novel.Title != "Kokoro" || md.Novel.PublishedDate != "" || md.Novel.ISBN13 != "9780804429573" {
+		t.Errorf("lookupISBN(080442957X): got %+v", md.Novel)
+	}
+
+	if md, _ := p.LookupISBN(ctx, "9784101010137"); md.Novel.Title != "こころ" {
+		t.Errorf("fixture was modified through a lookup result: %+v", md.Novel)
+	}
+	if _, err := n.lookupISBN(ctx, "9784003101018"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("unknown ISBN: got %v, want ErrBookNotFound", err)
+	}
+	if _, err := n.lookupISBN(ctx, "9784101010138"); err == nil {
+		t.Errorf("invalid ISBN: want error")
+	}
+}
+
+func TestOpenLibraryProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/books" || r.FormValue("jscmd") != "data" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.FormValue("bibkeys") != "ISBN:9780804429573" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"ISBN:9780804429573": {
+			"title": "Kokoro",
+			"authors": [{"name": "Natsume Sōseki"}],
+			"publishers": [{"name": "Tuttle"}],
+			"publish_date": "January 1969",
+			"number_of_pages": 248,
+			"subjects": [{"name": "Fiction"}, {"name": "Japanese fiction"}],
+			"cover": {"small": "https://covers.example.com/s.jpg", "large": "https://covers.example.com/l.jpg"}
+		}}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	p := newOpenLibraryProvider(srv.URL + "/")
+	md, err := p.LookupISBN(ctx, "9780804429573")
+	if err != nil {
+		t.Fatalf("LookupISBN: %v", err)
+	}
+	novel := md.Novel
+	if novel.Title != "Kokoro" || novel.Author != "Natsume Sōseki" || novel.Publisher != "Tuttle" ||
+		novel.PublishedDate != "1969-01" || novel.PageCount != 248 || novel.GenreList() != "Fiction, Japanese fiction" {
+		t.Errorf("LookupISBN: got %+v", novel)
+	}
+	if got, want := md.CoverURL, "https://covers.example.com/l.jpg"; got != want {
+		t.Errorf("CoverURL = %q, want %q", got, want)
+	}
+
+	if _, err := p.LookupISBN(ctx, "9784101010137"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("unknown ISBN: got %v, want ErrBookNotFound", err)
+	}
+}
@@ -2,70 +2,105 @@ package main
 
 import (
 	"cloud.google.com/go/errorreporting"
-	"cloud.google.com/go/firestore"
-	"cloud.google.com/go/storage"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	uuid "github.com/satori/go.uuid"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"runtime/debug"
+	"strings"
 )
 
 var (
 	listTmpl   = parseTemplate("list.html")
 	editTmpl   = parseTemplate("edit.html")
 	detailTmpl = parseTemplate("detail.html")
+	errorTmpl  = parseTemplate("error.html")
+
+	loginTmpl      = parseTemplate("login.html")
+	localLoginTmpl = parseTemplate("local_login.html")
+	adminUsersTmpl = parseTemplate("admin_users.html")
+	historyTmpl    = parseTemplate("history.html")
+	trashTmpl      = parseTemplate("trash.html")
 )
 
+// commands are the subcommands of the novelshelf binary, run as
+// "novelshelf <command> [flags]". Without a command it serves the app.
+var commands = map[string]func(n *Novelshelf, ctx context.Context, args []string, out io.Writer) error{
+	"gc":         (*Novelshelf).gcCommand,
+	"adduser":    (*Novelshelf).adduserCommand,
+	"purgetrash": (*Novelshelf).purgeTrashCommand,
+	"import":     (*Novelshelf).importCommand,
+	"backup":     (*Novelshelf).backupCommand,
+	"restore":    (*Novelshelf).restoreCommand,
+	"migrate":    (*Novelshelf).migrateCommand,
+}
+
 func main() {
 	godotenv.Load(".env")
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	if projectID == "" {
-		log.Fatal("GOOGLE_CLOUD_PROJECT must be set")
+	cfg, err := loadConfig(os.Getenv("NOVELSHELF_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
 	}
 	ctx := context.Background()
 
-	client, err := firestore.NewClient(ctx, projectID)
+	rawDB, err := newDatabase(ctx, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(client)
-	db, err := newFirestoreDB(client)
+	db, err := newHistoryDB(rawDB)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(db)
-	//db := newMemoryDB()
+	if len(os.Args) > 1 {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		n, err := NewNovelshelf(cfg, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := cmd(n, ctx, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	sdb, err := newSearchDB(ctx, db)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(db)
-	n, err := NewNovelshelf(projectID, db)
+	n, err := NewNovelshelf(cfg, sdb)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(n)
 	n.registerHandlers()
+	go n.purgeTrashPeriodically(ctx, trashPurgeInterval)
+	if d, _ := cfg.searchRefresh(); d > 0 {
+		go sdb.refreshPeriodically(ctx, d)
+	}
 
-	log.Printf("Listening on localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	log.Printf("Using %s database, %s image store, %s error reporter, %s ISBN provider", cfg.Database, cfg.ImageStore, cfg.ErrorReporter, cfg.ISBNProvider)
+	if cfg.SessionKey == "" {
+		log.Printf("NOVELSHELF_SESSION_KEY is not set; restarting will sign everyone out")
+	}
+	if cfg.AuthProvider == "local" {
+		log.Printf("WARNING: the local auth provider lets anyone sign in as anyone; use it for development only")
+	}
+	log.Printf("Listening on localhost:%s", cfg.Port)
+	if err := http.ListenAndServe(":"+cfg.Port, nil); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// registerHandlers sets up the routes. Every route is open to everyone
+// unless it is wrapped in requireRole.
 func (n *Novelshelf) registerHandlers() {
 	r := mux.NewRouter()
 
@@ -74,59 +109,183 @@ func (n *Novelshelf) registerHandlers() {
 	r.Methods("GET").Path("/novels").
 		Handler(appHandler(n.listHandler))
 	r.Methods("GET").Path("/novels/add").
-		Handler(appHandler(n.addFormHandler))
+		Handler(n.requireRole(RoleEditor, appHandler(n.addFormHandler)))
+	r.Methods("GET").Path("/novels/export").
+		Handler(appHandler(n.exportHandler))
 	r.Methods("GET").Path("/novels/{id:[0-9a-zA-Z_\\-]+}").
 		Handler(appHandler(n.detailHandler))
 	r.Methods("GET").Path("/novels/{id:[0-9a-zA-Z_\\-]+}/edit").
-		Handler(appHandler(n.editFormHandler))
+		Handler(n.requireRole(RoleEditor, appHandler(n.editFormHandler)))
 
 	r.Methods("POST").Path("/novels").
-		Handler(appHandler(n.createHandler))
+		Handler(n.requireRole(RoleEditor, appHandler(n.createHandler)))
 	r.Methods("POST", "PUT").Path("/novels/{id:[0-9a-zA-Z_\\-]+}").
-		Handler(appHandler(n.updateHandler))
+		Handler(n.requireRole(RoleEditor, appHandler(n.updateHandler)))
 	r.Methods("POST").Path("/novels/{id:[0-9a-zA-Z_\\-]+}:delete").
-		Handler(appHandler(n.deleteHandler))
+		Handler(n.requireRole(RoleEditor, appHandler(n.deleteHandler)))
+	r.Methods("GET").Path("/novels/{id:[0-9a-zA-Z_\\-]+}/history").
+		Handler(n.requireRole(RoleEditor, appHandler(n.historyHandler)))
+	r.Methods("POST").Path("/novels/{id:[0-9a-zA-Z_\\-]+}/history/{rev}:restore").
+		Handler(n.requireRole(RoleEditor, appHandler(n.restoreHandler)))
+	r.Methods("GET").Path("/trash").
+		Handler(n.requireRole(RoleEditor, appHandler(n.trashHandler)))
+	r.Methods("POST").Path("/trash/{id:[0-9a-zA-Z_\\-]+}:restore").
+		Handler(n.requireRole(RoleEditor, appHandler(n.trashRestoreHandler)))
+	r.Methods("POST").Path("/trash/{id:[0-9a-zA-Z_\\-]+}:purge").
+		Handler(n.requireRole(RoleEditor, appHandler(n.trashPurgeHandler)))
+
+	r.Methods("GET").Path("/login").
+		Handler(appHandler(n.loginFormHandler))
+	r.Methods("POST").Path("/login").
+		Handler(appHandler(n.loginHandler))
+	r.Methods("POST").Path("/logout").
+		Handler(appHandler(n.logoutHandler))
+	r.Methods("GET").Path("/auth/login").
+		Handler(appHandler(n.providerLoginHandler))
+	r.Methods("GET").Path("/auth/callback").
+		Handler(appHandler(n.providerCallbackHandler))
+	if p, ok := n.identity.(*localProvider); ok {
+		r.Methods("GET").Path(localProviderPath).
+			Handler(p.formHandler(n))
+		r.Methods("POST").Path(localProviderPath).
+			Handler(p.signInHandler(n))
+	}
 
 	r.Methods("GET").Path("/_ah/health").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("ok"))
 		})
 
-	r.Methods("GET").Path("/logs").Handler(appHandler(n.sendLog))
-	r.Methods("GET").Path("/errors").Handler(appHandler(n.sendError))
+	n.registerAPIHandlers(r)
+
+	if h, ok := n.Images.(http.Handler); ok {
+		r.Methods("GET", "HEAD").PathPrefix(localImagesPath).Handler(h)
+	}
+
+	r.Methods("GET").Path("/admin/users").
+		Handler(n.requireRole(RoleAdmin, appHandler(n.adminUsersHandler)))
+	r.Methods("POST").Path("/admin/users/{id}").
+		Handler(n.requireRole(RoleAdmin, appHandler(n.adminSetRoleHandler)))
+	r.Methods("GET").Path("/logs").
+		Handler(n.requireRole(RoleAdmin, appHandler(n.sendLog)))
+	r.Methods("GET").Path("/errors").
+		Handler(n.requireRole(RoleAdmin, appHandler(n.sendError)))
 
-	http.Handle("/", handlers.CombinedLoggingHandler(n.logWriter, r))
+	http.Handle("/", handlers.CombinedLoggingHandler(n.logWriter, n.authMiddleware(n.csrfMiddleware(r))))
 }
 
 func (n *Novelshelf) listHandler(w http.ResponseWriter, r *http.Request) *appError {
-	novels, err := n.DB.ListNovels(context.Background())
+	if q := r.FormValue("q"); q != "" {
+		novels, err := n.searchNovels(r.Context(), q)
+		if err != nil {
+			return n.appErrorf(r, err, "could not search novels: %v", err)
+		}
+		return listTmpl.Execute(n, w, r, listData{NovelPage: &NovelPage{Novels: novels}, Query: q})
+	}
+	opts, err := listOptionsFromRequest(r)
+	if err != nil {
+		return n.badRequestf(r, err, "%v", err)
+	}
+	page, err := n.DB.ListNovelsPage(r.Context(), opts)
 	if err != nil {
 		return n.appErrorf(r, err, "could not list novels: %v", err)
 	}
-	return listTmpl.Execute(n, w, r, novels)
+	return listTmpl.Execute(n, w, r, listData{NovelPage: page, Options: opts})
+}
+
+// listData is passed to list.html. Query is the search query, if any.
+type listData struct {
+	*NovelPage
+	Options ListOptions
+	Query   string
+}
+
+// PageURL returns the link to the page at cursor with the current sort
+// order and filters.
+func (d listData) PageURL(cursor string) string {
+	v := d.Options.query()
+	v.Set("cursor", cursor)
+	return "/novels?" + v.Encode()
+}
+
+// SortURL returns the link that orders the list by field, toggling the
+// direction if the list is already sorted by it.
+func (d listData) SortURL(field string) string {
+	opts := d.Options
+	opts.Descending = opts.Sort == SortField(field) && !opts.Descending
+	opts.Sort = SortField(field)
+	return "/novels?" + opts.query().Encode()
+}
+
+func (n *Novelshelf) searchNovels(ctx context.Context, q string) ([]*Novel, error) {
+	searcher, ok := n.DB.(NovelSearcher)
+	if !ok {
+		return nil, errors.New("search is not supported by this database")
+	}
+	return searcher.SearchNovels(ctx, q)
 }
 
 func (n *Novelshelf) novelFromRequest(r *http.Request) (*Novel, error) {
-	log.Println("novelFromRequest invoked")
 	id := mux.Vars(r)["id"]
-	fmt.Println(id)
-	novel, err := n.DB.GetNovel(context.Background(), id)
+	novel, err := n.DB.GetNovel(r.Context(), id)
 	if err != nil {
-		return nil, fmt.Errorf("could not find book: %v", err)
+		return nil, fmt.Errorf("could not find novel: %w", err)
 	}
 	return novel, nil
 }
 
+// detailData is passed to detail.html. CanEdit is whether the signed-in
+// user may change the novel, and ShowHistory whether they may see its
+// history.
+type detailData struct {
+	*Novel
+	CanEdit     bool
+	ShowHistory bool
+}
+
 func (n *Novelshelf) detailHandler(w http.ResponseWriter, r *http.Request) *appError {
 	novel, err := n.novelFromRequest(r)
 	if err != nil {
 		return n.appErrorf(r, err, "%v", err)
 	}
-	return detailTmpl.Execute(n, w, r, novel)
+	u := userFromContext(r.Context())
+	return detailTmpl.Execute(n, w, r, detailData{Novel: novel, CanEdit: u.CanEdit(novel), ShowHistory: u.HasRole(RoleEditor)})
+}
+
+// editData is passed to edit.html. Novel has an empty ID when adding a
+// novel; Errors holds the messages for fields that failed validation.
+type editData struct {
+	Novel    *Novel
+	Errors   ValidationErrors
+	CoverURL string // cover URL to import, kept when re-rendering the form
+	ISBN     string // ISBN the form was prefilled from, if any
+
+	// Conflict is set when someone else saved the novel while the form was
+	// being edited. Changes then lists how the saved novel differs from
+	// the form.
+	Conflict bool
+	Changes  []fieldChange
 }
 
+// addFormHandler shows the form to add a novel. With an isbn parameter the
+// form is prefilled with the book's metadata and its cover URL.
 func (n *Novelshelf) addFormHandler(w http.ResponseWriter, r *http.Request) *appError {
-	return editTmpl.Execute(n, w, r, nil)
+	isbn := r.FormValue("isbn")
+	if isbn == "" || n.ISBN == nil {
+		return editTmpl.Execute(n, w, r, editData{Novel: &Novel{}})
+	}
+	md, err := n.lookupISBN(r.Context(), isbn)
+	var verrs ValidationErrors
+	switch {
+	case errors.As(err, &verrs):
+		return editTmpl.Execute(n, w, r, editData{Novel: &Novel{}, Errors: verrs, ISBN: isbn})
+	case errors.Is(err, ErrBookNotFound):
+		novel := &Novel{ISBN13: isbn}
+		return editTmpl.Execute(n, w, r, editData{Novel: novel, Errors: ValidationErrors{"isbn": "was not found"}, ISBN: isbn})
+	case err != nil:
+		return n.appErrorf(r, err, "could not look up ISBN: %v", err)
+	}
+	return editTmpl.Execute(n, w, r, editData{Novel: md.Novel, CoverURL: md.CoverURL, ISBN: isbn})
 }
 
 func (n *Novelshelf) editFormHandler(w http.ResponseWriter, r *http.Request) *appError {
@@ -134,73 +293,112 @@ func (n *Novelshelf) editFormHandler(w http.ResponseWriter, r *http.Request) *ap
 	if err != nil {
 		return n.appErrorf(r, err, "%v", err)
 	}
-	return editTmpl.Execute(n, w, r, novel)
+	if err := authorize(r, novel); err != nil {
+		return n.appErrorf(r, err, "you may only edit novels on your own shelf")
+	}
+	return editTmpl.Execute(n, w, r, editData{Novel: novel})
 }
 
-func (n *Novelshelf) novelFromForm(r *http.Request) (*Novel, error) {
-	ctx := r.Context()
-	imageURL, err := n.uploadFileFromForm(ctx, r)
-	if err != nil {
-		return nil, fmt.Errorf("could not upload file: %v", err)
-	}
-	if imageURL == "" {
-		imageURL = r.FormValue("imageURL")
-	}
-	novel := &Novel{
+// invalidFormHandler re-renders the edit form with the user's input and the
+// validation errors for it.
+func (n *Novelshelf) invalidFormHandler(w http.ResponseWriter, r *http.Request, novel *Novel, errs ValidationErrors) *appError {
+	w.WriteHeader(http.StatusBadRequest)
+	return editTmpl.Execute(n, w, r, editData{Novel: novel, Errors: errs, CoverURL: r.FormValue("coverURL")})
+}
+
+// novelFromForm applies the submitted form to a copy of base, the novel
+// being edited or an empty one when adding a novel. Fields missing from the
+// form keep their value in base. It returns the resulting Novel and a patch
+// of the fields the form set. If the input fails validation it returns the
+// Novel as submitted together with the ValidationErrors; the cover image is
+// only uploaded, or imported from the coverURL field, once the rest of the
+// form is valid.
+func (n *Novelshelf) novelFromForm(r *http.Request, base *Novel) (*Novel, NovelPatch, error) {
+	errs := ValidationErrors{}
+	submitted := &Novel{
 		Title:         r.FormValue("title"),
 		Author:        r.FormValue("author"),
-		PublishedDate: r.FormValue("publishedDate"),
-		ImageURL:      imageURL,
+		PublishedDate: PartialDate(r.FormValue("publishedDate")),
+		ImageURL:      r.FormValue("imageURL"),
+		ThumbnailURL:  r.FormValue("thumbnailURL"),
 		Description:   r.FormValue("description"),
+		ISBN10:        r.FormValue("isbn10"),
+		ISBN13:        r.FormValue("isbn13"),
+		Publisher:     r.FormValue("publisher"),
+		PageCount:     formInt(r, "pageCount", errs),
+		Language:      r.FormValue("language"),
+		Genres:        splitGenres(r.FormValue("genres")),
+		Series:        r.FormValue("series"),
+		Volume:        formInt(r, "volume", errs),
 	}
-
-	return novel, nil
-}
-
-func (n *Novelshelf) uploadFileFromForm(ctx context.Context, r *http.Request) (url string, err error) {
-	f, fh, err := r.FormFile("image")
-	if err == http.ErrMissingFile {
-		return "", nil
+	version := formInt(r, "version", errs)
+	var names []string
+	for _, f := range novelFields {
+		if _, ok := r.Form[f.name]; ok {
+			names = append(names, f.name)
+		}
 	}
-	if err != nil {
-		return "", err
+	novel := *base
+	newNovelPatch(submitted, 0, names...).apply(&novel)
+	for f, msg := range validateNovel(&novel) {
+		errs[f] = msg
 	}
-	if n.StorageBucket == nil {
-		return "", fmt.Errorf("strage bucket is missing - check novelshelf.go")
+	if len(errs) > 0 {
+		return &novel, NovelPatch{}, errs
 	}
-	if _, err := n.StorageBucket.Attrs(ctx); err != nil {
-		if err == storage.ErrBucketNotExist {
-			return "", fmt.Errorf("bucket %q does not exist: check novelshelf.go", n.StorageBucketName)
+
+	cover, err := n.uploadCoverFromForm(r)
+	if err == nil && cover == nil && strings.TrimSpace(r.FormValue("coverURL")) != "" {
+		if n.Images == nil {
+			return nil, NovelPatch{}, fmt.Errorf("image storage is not configured - set NOVELSHELF_IMAGE_STORE")
 		}
-		return "", fmt.Errorf("could not get bucket: %v", err)
+		cover, err = n.importCover(r.Context(), r.FormValue("coverURL"))
 	}
-
-	name := uuid.Must(uuid.NewV4()).String() + path.Ext(fh.Filename)
-
-	w := n.StorageBucket.Object(name).NewWriter(ctx)
-	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-	w.ContentType = fh.Header.Get("Content-Type")
-	w.CacheControl = "public, max-age=86400"
-
-	if _, err := io.Copy(w, f); err != nil {
-		return "", err
+	if errors.As(err, &errs) {
+		return &novel, NovelPatch{}, errs
+	}
+	if err != nil {
+		return nil, NovelPatch{}, fmt.Errorf("could not upload file: %v", err)
 	}
-	if err := w.Close(); err != nil {
-		return "", err
+	if cover != nil {
+		novel.ImageURL = cover.ImageURL
+		novel.ThumbnailURL = cover.ThumbnailURL
+		names = append(names, "imageURL", "thumbnailURL")
 	}
+	return &novel, newNovelPatch(&novel, version, names...), nil
+}
 
-	const publicURL = "https://storage.googleapis.com/%s/%s"
-	return fmt.Sprintf(publicURL, n.StorageBucketName, name), nil
+// uploadCoverFromForm processes and stores the image uploaded in the form,
+// if any. It returns nil if no image was uploaded.
+func (n *Novelshelf) uploadCoverFromForm(r *http.Request) (*storedCover, error) {
+	f, _, err := r.FormFile("image")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if n.Images == nil {
+		return nil, fmt.Errorf("image storage is not configured - set NOVELSHELF_IMAGE_STORE")
+	}
+	return n.storeCover(r.Context(), newCoverBase(), f)
 }
 
 func (n *Novelshelf) createHandler(w http.ResponseWriter, r *http.Request) *appError {
 	ctx := r.Context()
-	novel, err := n.novelFromForm(r)
+	novel, _, err := n.novelFromForm(r, &Novel{})
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		return n.invalidFormHandler(w, r, novel, verrs)
+	}
 	if err != nil {
-		return n.appErrorf(r, err, "could not parse book from form: %v", err)
+		return n.appErrorf(r, err, "could not parse novel from form: %v", err)
 	}
+	setOwner(r, novel)
 	id, err := n.DB.AddNovel(ctx, novel)
 	if err != nil {
+		n.releaseCovers(ctx, novel, nil)
 		return n.appErrorf(r, err, "could not save novel: %v", err)
 	}
 	http.Redirect(w, r, fmt.Sprintf("/novels/%s", id), http.StatusFound)
@@ -210,32 +408,79 @@ func (n *Novelshelf) createHandler(w http.ResponseWriter, r *http.Request) *appE
 func (n *Novelshelf) updateHandler(w http.ResponseWriter, r *http.Request) *appError {
 	ctx := r.Context()
 	id := mux.Vars(r)["id"]
-	if id != "" {
+	if id == "" {
 		return n.appErrorf(r, errors.New("no novel with empty ID"), "no novel with empty ID")
 	}
-	if id == "" {
-		return n.appErrorf(r, errors.New("no book with empty ID"), "no book with empty ID")
+	old, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	if err := authorize(r, old); err != nil {
+		return n.appErrorf(r, err, "you may only edit novels on your own shelf")
 	}
 
-	novel, err := n.novelFromForm(r)
+	// Only the fields on the form are saved, so that a form that lacks some
+	// fields does not clear them.
+	novel, patch, err := n.novelFromForm(r, old)
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		return n.invalidFormHandler(w, r, novel, verrs)
+	}
 	if err != nil {
 		return n.appErrorf(r, err, "could not parse novel from form: %v", err)
 	}
-	novel.ID = id
 
-	err = n.DB.UpdateNovel(ctx, novel)
+	saved, err := n.DB.PatchNovel(ctx, id, patch)
+	if errors.Is(err, ErrConflict) {
+		n.releaseCovers(ctx, novel, old)
+		return n.conflictHandler(w, r, novel)
+	}
 	if err != nil {
+		n.releaseCovers(ctx, novel, old)
 		return n.appErrorf(r, err, "could not save novel: %v", err)
 	}
-	http.Redirect(w, r, fmt.Sprintf("/novels/%s", novel.ID), http.StatusFound)
+	n.releaseCovers(ctx, old, saved)
+	http.Redirect(w, r, fmt.Sprintf("/novels/%s", id), http.StatusFound)
 	return nil
 }
 
+// conflictHandler re-renders the edit form after someone else saved the
+// novel while mine was being edited. The form keeps the user's input but
+// now carries the saved version, so that saving again replaces it, and
+// lists the fields the saved novel differs in so that they can be merged
+// first.
+func (n *Novelshelf) conflictHandler(w http.ResponseWriter, r *http.Request, mine *Novel) *appError {
+	saved, err := n.DB.GetNovel(r.Context(), mine.ID)
+	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	mine.Version = saved.Version
+	// A cover uploaded with the form has been released, so the form goes
+	// back to the cover it was opened with.
+	mine.ImageURL = r.FormValue("imageURL")
+	mine.ThumbnailURL = r.FormValue("thumbnailURL")
+	w.WriteHeader(http.StatusConflict)
+	return editTmpl.Execute(n, w, r, editData{
+		Novel:    mine,
+		CoverURL: r.FormValue("coverURL"),
+		Conflict: true,
+		Changes:  diffNovels(mine, saved),
+	})
+}
+
+// deleteHandler moves a novel to the trash. Its covers are kept until it
+// is purged from there.
 func (n *Novelshelf) deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
 	ctx := r.Context()
 	id := mux.Vars(r)["id"]
-	err := n.DB.DeleteNovel(ctx, id)
+	novel, err := n.DB.GetNovel(ctx, id)
 	if err != nil {
+		return n.appErrorf(r, err, "could not find novel: %v", err)
+	}
+	if err := authorize(r, novel); err != nil {
+		return n.appErrorf(r, err, "you may only delete novels on your own shelf")
+	}
+	if err := n.DB.DeleteNovel(ctx, id); err != nil {
 		return n.appErrorf(r, err, "could not delete novel: %v", err)
 	}
 	http.Redirect(w, r, "/novels", http.StatusFound)
@@ -251,7 +496,7 @@ func (n *Novelshelf) sendLog(w http.ResponseWriter, r *http.Request) *appError {
 func (n *Novelshelf) sendError(w http.ResponseWriter, r *http.Request) *appError {
 	msg := `<html>Logging an error. Check<a href="http://console.cloud.google.com/errors">Error Reporting</a> (it may take a minute or two for the error to appear).</html>`
 	err := errors.New("uh oh! an error occurred")
-	return n.appErrorf(r, err, msg)
+	return n.appErrorf(r, err, "%s", msg)
 }
 
 type appHandler func(http.ResponseWriter, *http.Request) *appError
@@ -266,26 +511,73 @@ type appError struct {
 }
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if e := fn(w, r); e != nil {
-		fmt.Fprintf(e.Novel.logWriter, "Handler error (reported to Error Reporting): status code: %d, message: %s,"+
-			"underlying err: %v+\n", e.Code, e.Message, e.Error)
-		w.WriteHeader(e.Code)
-		e.Novel.errorClient.Report(errorreporting.Entry{
-			Error: e.Error,
-			Req:   r,
-			Stack: e.Stack,
-		})
-		e.Novel.errorClient.Flush()
+	e := fn(w, r)
+	if e == nil {
+		return
+	}
+	fmt.Fprintf(e.Novel.logWriter, "Handler error: status code: %d, message: %s, "+
+		"underlying err: %v\n", e.Code, e.Message, e.Error)
+	w.WriteHeader(e.Code)
+	if te := errorTmpl.Execute(e.Novel, w, r, e); te != nil {
+		fmt.Fprintf(e.Novel.logWriter, "could not render error page: %v\n", te.Error)
 	}
+	e.Novel.reportError(r, e)
+}
+
+// reportError sends server errors to Error Reporting, or writes their
+// stack to the log if Error Reporting is not configured. Client errors such
+// as a missing novel or a malformed request are only logged.
+func (n *Novelshelf) reportError(r *http.Request, e *appError) {
+	if e.Code < http.StatusInternalServerError {
+		return
+	}
+	if n.errorClient == nil {
+		fmt.Fprintf(n.logWriter, "%s\n", e.Stack)
+		return
+	}
+	n.errorClient.Report(errorreporting.Entry{
+		Error: e.Error,
+		Req:   r,
+		Stack: e.Stack,
+	})
+	n.errorClient.Flush()
+}
+
+// StatusText returns the text for the HTTP status code of e.
+func (e *appError) StatusText() string {
+	return http.StatusText(e.Code)
+}
+
+// httpStatus maps err to the HTTP status code a handler should respond
+// with.
+func httpStatus(err error) int {
+	var verrs ValidationErrors
+	switch {
+	case errors.As(err, &verrs):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrBookNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrUserExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
 }
 
 func (n *Novelshelf) appErrorf(r *http.Request, err error, format string, v ...interface{}) *appError {
 	return &appError{
 		Error:   err,
 		Message: fmt.Sprintf(format, v...),
-		Code:    500,
+		Code:    httpStatus(err),
 		Req:     r,
 		Novel:   n,
 		Stack:   debug.Stack(),
 	}
 }
+
+func (n *Novelshelf) badRequestf(r *http.Request, err error, format string, v ...interface{}) *appError {
+	e := n.appErrorf(r, err, format, v...)
+	e.Code = http.StatusBadRequest
+	return e
+}
@@ -4,21 +4,37 @@ import (
 	"bytes"
 	"cloud.google.com/go/firestore"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/IkezawaYuki/go-novel-shelf/internal/webtest"
 	"github.com/joho/godotenv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 )
 
 var (
-	wt *webtest.W
-	n  *Novelshelf
+	wt   *webtest.W
+	n    *Novelshelf
+	serv *httptest.Server
+
+	// testUser is the editor wt is signed in as.
+	testUser *User
+	// adminWT is signed in as an admin.
+	adminWT *webtest.W
 
 	testDBs = map[string]NovelDatabase{}
 )
@@ -27,19 +43,35 @@ func TestMain(m *testing.M) {
 	godotenv.Load(".env")
 
 	ctx := context.Background()
-	projectID := os.Getenv("GOLANG_SAMPLES_PROJECT_ID")
-
-	if projectID == "" {
-		log.Println("GOLANG_SAMPLES_PROJECT_ID is not set. Skipping")
-		return
+	// Without a project the handlers are tested offline against the
+	// memory database, with no image storage and errors only logged.
+	imageDir, err := ioutil.TempDir("", "novelshelf-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := &Config{
+		ProjectID:    os.Getenv("GOLANG_SAMPLES_PROJECT_ID"),
+		ImageDir:     imageDir,
+		ISBNProvider: "fixture",
+		ISBNFixtures: "testdata/isbn.json",
+		AuthProvider: "local",
+	}
+	cfg.setDefaults()
+	if cfg.ProjectID == "" {
+		log.Println("GOLANG_SAMPLES_PROJECT_ID is not set. Running offline")
 	}
 
-	memoryDB := newMemoryDB()
-	fmt.Println(memoryDB)
+	hdb, err := newHistoryDB(newMemoryDB())
+	if err != nil {
+		log.Fatalf("newHistoryDB: %v", err)
+	}
+	memoryDB, err := newSearchDB(ctx, hdb)
+	if err != nil {
+		log.Fatalf("newSearchDB: %v", err)
+	}
 	testDBs["memory"] = memoryDB
 	if firestoreProjectID := os.Getenv("GOLANG_SAMPLES_FIRESTORE_PROJECT"); firestoreProjectID != "" {
-		projectID = firestoreProjectID
-		client, err := firestore.NewClient(ctx, projectID)
+		client, err := firestore.NewClient(ctx, firestoreProjectID)
 		if err != nil {
 			log.Fatalf("firestore.NewClient: %v", err)
 		}
@@ -52,28 +84,127 @@ func TestMain(m *testing.M) {
 				}
 			}
 		}
-		db, err := newFirestoreDB(client)
+		fdb, err := newFirestoreDB(client)
 		if err != nil {
 			log.Fatalf("newFirestroeDB: %v", err)
 		}
+		hdb, err := newHistoryDB(fdb)
+		if err != nil {
+			log.Fatalf("newHistoryDB: %v", err)
+		}
+		db, err := newSearchDB(ctx, hdb)
+		if err != nil {
+			log.Fatalf("newSearchDB: %v", err)
+		}
 		testDBs["firestore"] = db
 	} else {
 		log.Println("GOLANG_SAMPLES_FIRESTORE_PROJECT not set. Slipping Firestore database tests")
 	}
 
-	var err error
-	n, err = NewNovelshelf(projectID, memoryDB)
+	n, err = NewNovelshelf(cfg, memoryDB)
 	if err != nil {
 		log.Fatalf("NewNovelshelf: %v", err)
 	}
 	log.SetOutput(ioutil.Discard)
 	n.logWriter = ioutil.Discard
 
-	serv := httptest.NewServer(nil)
+	serv = httptest.NewServer(nil)
 	wt = webtest.New(nil, serv.Listener.Addr().String())
 
 	n.registerHandlers()
-	os.Exit(m.Run())
+
+	// Tests run as a signed-in user unless they make their own client.
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+	testUser = &User{Email: testEmail, Name: "Test Reader", PasswordHash: hash, Role: RoleEditor}
+	if _, err := n.Users.AddUser(ctx, testUser); err != nil {
+		log.Fatalf("AddUser: %v", err)
+	}
+	if wt.Client, err = signedInClient(testEmail, testPassword); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := n.Users.AddUser(ctx, &User{Email: testAdminEmail, PasswordHash: hash, Role: RoleAdmin}); err != nil {
+		log.Fatalf("AddUser: %v", err)
+	}
+	adminWT = webtest.New(nil, serv.Listener.Addr().String())
+	if adminWT.Client, err = signedInClient(testAdminEmail, testPassword); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(imageDir)
+	os.Exit(code)
+}
+
+const (
+	testEmail      = "reader@example.com"
+	testAdminEmail = "admin@example.com"
+	testPassword   = "correct horse battery"
+)
+
+// newTestClient returns a client that keeps cookies and sends CSRF tokens
+// with its forms, like a browser.
+func newTestClient() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	c := &http.Client{Jar: jar}
+	c.Transport = &csrfTransport{client: c}
+	return c
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]+)"`)
+
+// csrfTransport adds a CSRF token to the POST and PUT requests its client
+// makes to the test server's pages, as the forms they stand in for would.
+type csrfTransport struct {
+	client *http.Client
+}
+
+func (t *csrfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" || req.Method == "HEAD" || req.URL.Host != serv.Listener.Addr().String() ||
+		strings.HasPrefix(req.URL.Path, "/api/") || req.Header.Get("X-CSRF-Token") != "" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	resp, err := t.client.Get(serv.URL + "/login")
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	m := csrfFieldPattern.FindSubmatch(b)
+	if m == nil {
+		return nil, fmt.Errorf("no CSRF token on /login")
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("X-CSRF-Token", string(m[1]))
+	// Fetching the token may have set the cookie it is checked against.
+	req.Header.Del("Cookie")
+	for _, c := range t.client.Jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// signedInClient returns a client signed in to the test server with the
+// given password account.
+func signedInClient(email, password string) (*http.Client, error) {
+	c := newTestClient()
+	resp, err := c.PostForm(serv.URL+"/login", url.Values{"email": {email}, "password": {password}})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/novels" {
+		return nil, fmt.Errorf("could not sign in as %s: got status %d at %s", email, resp.StatusCode, resp.Request.URL)
+	}
+	return c, nil
 }
 
 func TestNoNovels(t *testing.T) {
@@ -115,7 +246,8 @@ func TestEditNovel(t *testing.T) {
 			ctx := context.Background()
 			const title = "novel mc novel"
 			id, err := n.DB.AddNovel(ctx, &Novel{
-				Title: title,
+				Title:     title,
+				CreatedBy: testUser.ID,
 			})
 			if err != nil {
 				t.Fatal(err)
@@ -148,6 +280,191 @@ func TestEditNovel(t *testing.T) {
 	}
 }
 
+func TestEditConflict(t *testing.T) {
+	for name, db := range testDBs {
+		t.Run(name, func(t *testing.T) {
+			n.DB = db
+			ctx := context.Background()
+			id, err := n.DB.AddNovel(ctx, &Novel{Title: "conflicted", CreatedBy: testUser.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer n.DB.DeleteNovel(ctx, id)
+			novelPath := fmt.Sprintf("/novels/%s", id)
+			bodyContains(t, wt, novelPath+"/edit", `name="version" value="1"`)
+
+			// Two forms opened at version 1 are saved one after the other.
+			save := func(title, version string) (*http.Response, string) {
+				t.Helper()
+				resp, err := wt.PostForm(novelPath, url.Values{"title": {title}, "version": {version}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, string(b)
+			}
+			if resp, _ := save("theirs", "1"); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != novelPath {
+				t.Fatalf("first save: got status %d at %s, want %d at %s", resp.StatusCode, resp.Request.URL.Path, http.StatusOK, novelPath)
+			}
+			resp, body := save("mine", "1")
+			if resp.StatusCode != http.StatusConflict {
+				t.Fatalf("second save: got status %d, want %d", resp.StatusCode, http.StatusConflict)
+			}
+			for _, want := range []string{"Someone else saved", "<td>mine</td>", "<td>theirs</td>", `name="version" value="2"`} {
+				if !strings.Contains(body, want) {
+					t.Errorf("second save: body does not contain %q", want)
+				}
+			}
+			if got, err := n.DB.GetNovel(ctx, id); err != nil || got.Title != "theirs" {
+				t.Errorf("after conflict: got %+v, %v, want title %q", got, err, "theirs")
+			}
+
+			// Saving the merged form replaces the other change.
+			if resp, _ := save("mine", "2"); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != novelPath {
+				t.Errorf("merged save: got status %d at %s, want %d at %s", resp.StatusCode, resp.Request.URL.Path, http.StatusOK, novelPath)
+			}
+			bodyContains(t, wt, novelPath, "mine")
+		})
+	}
+}
+
+func TestAPIUpdateVersions(t *testing.T) {
+	ctx := context.Background()
+	n.DB = testDBs["memory"]
+	id, err := n.DB.AddNovel(ctx, &Novel{Title: "versioned", CreatedBy: testUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.DB.DeleteNovel(ctx, id)
+	novelPath := serv.URL + "/api/v1/novels/" + id
+
+	resp, err := wt.Client.Get(novelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("ETag"), `"1"`; got != want {
+		t.Errorf("GET: got ETag %s, want %s", got, want)
+	}
+
+	put := func(ifMatch, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", novelPath, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := wt.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for _, tc := range []struct {
+		ifMatch, body string
+		code          int
+		etag          string
+	}{
+		{`"1"`, `{"title": "two"}`, http.StatusOK, `"2"`},
+		{`"1"`, `{"title": "stale"}`, http.StatusPreconditionFailed, ""},
+		{`W/"2"`, `{"title": "weak"}`, http.StatusPreconditionFailed, ""},
+		{"", `{"title": "stale", "version": 1}`, http.StatusConflict, ""},
+		{"", `{"title": "three", "version": 2}`, http.StatusOK, `"3"`},
+		{"*", `{"title": "four", "version": 1}`, http.StatusOK, `"4"`},
+		{"", `{"title": "five"}`, http.StatusOK, `"5"`},
+	} {
+		resp := put(tc.ifMatch, tc.body)
+		if resp.StatusCode != tc.code || resp.Header.Get("ETag") != tc.etag {
+			t.Errorf("PUT If-Match %s %s: got status %d, ETag %s, want %d, %s", tc.ifMatch, tc.body, resp.StatusCode, resp.Header.Get("ETag"), tc.code, tc.etag)
+		}
+	}
+	if got, err := n.DB.GetNovel(ctx, id); err != nil || got.Title != "five" {
+		t.Errorf("after updates: got %+v, %v, want title %q", got, err, "five")
+	}
+}
+
+func TestEditPartialForm(t *testing.T) {
+	ctx := context.Background()
+	n.DB = testDBs["memory"]
+	id, err := n.DB.AddNovel(ctx, &Novel{Title: "partial", Author: "someone", Genres: []string{"小説"}, CreatedBy: testUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.DB.DeleteNovel(ctx, id)
+
+	// A form with only some of the fields leaves the others alone.
+	resp, err := wt.PostForm("/novels/"+id, url.Values{"author": {"someone else"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	got, err := n.DB.GetNovel(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "partial" || got.Author != "someone else" || got.GenreList() != "小説" {
+		t.Errorf("after partial form: got %+v", got)
+	}
+}
+
+func TestAPIPatch(t *testing.T) {
+	ctx := context.Background()
+	n.DB = testDBs["memory"]
+	id, err := n.DB.AddNovel(ctx, &Novel{Title: "patched", Author: "someone", PageCount: 100, CreatedBy: testUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.DB.DeleteNovel(ctx, id)
+
+	patch := func(ifMatch, body string) (*http.Response, *Novel) {
+		t.Helper()
+		req, _ := http.NewRequest("PATCH", serv.URL+"/api/v1/novels/"+id, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := wt.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var novel Novel
+		json.NewDecoder(resp.Body).Decode(&novel)
+		return resp, &novel
+	}
+
+	resp, got := patch(`"1"`, `{"author": " someone else ", "pageCount": null}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("PATCH: got status %d, ETag %s, want %d, %s", resp.StatusCode, resp.Header.Get("ETag"), http.StatusOK, `"2"`)
+	}
+	if got.Title != "patched" || got.Author != "someone else" || got.PageCount != 0 {
+		t.Errorf("PATCH: got %+v", got)
+	}
+	for _, tc := range []struct {
+		ifMatch, body string
+		code          int
+	}{
+		{`"1"`, `{"title": "stale"}`, http.StatusPreconditionFailed},
+		{"", `{"title": "stale", "version": 1}`, http.StatusConflict},
+		{"", `{"title": ""}`, http.StatusBadRequest},
+		{"", `{"createdBy": "me"}`, http.StatusBadRequest},
+		{"", `{"pageCount": "many"}`, http.StatusBadRequest},
+		{"", `{"genres": ["小説"]}`, http.StatusOK},
+	} {
+		if resp, _ := patch(tc.ifMatch, tc.body); resp.StatusCode != tc.code {
+			t.Errorf("PATCH If-Match %s %s: got status %d, want %d", tc.ifMatch, tc.body, resp.StatusCode, tc.code)
+		}
+	}
+	if got, err := n.DB.GetNovel(ctx, id); err != nil || got.Title != "patched" || got.Author != "someone else" || got.GenreList() != "小説" {
+		t.Errorf("after PATCH: got %+v, %v", got, err)
+	}
+}
+
 func TestAddAndDelete(t *testing.T) {
 	for name, db := range testDBs {
 		t.Run(name, func(t *testing.T) {
@@ -180,12 +497,355 @@ func TestAddAndDelete(t *testing.T) {
 	}
 }
 
+func TestAPICreateGetDelete(t *testing.T) {
+	for name, db := range testDBs {
+		t.Run(name, func(t *testing.T) {
+			n.DB = db
+			body := strings.NewReader(`{"title": "simpsons", "author": "homer"}`)
+			resp, err := wt.Post("/api/v1/novels", "application/json", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusCreated; got != want {
+				t.Fatalf("create: got status %d, want %d", got, want)
+			}
+			var created Novel
+			if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+				t.Fatalf("create: could not decode response: %v", err)
+			}
+			if created.ID == "" {
+				t.Fatal("create: got empty ID")
+			}
+			novelPath := "/api/v1/novels/" + created.ID
+			if got, want := resp.Header.Get("Location"), novelPath; got != want {
+				t.Errorf("create: got Location %q, want %q", got, want)
+			}
+			bodyContains(t, wt, novelPath, `"author":"homer"`)
+			bodyContains(t, wt, "/api/v1/novels", created.ID)
+
+			req, err := http.NewRequest("DELETE", "http://"+serv.Listener.Addr().String()+novelPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err = wt.Client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+				t.Errorf("delete: got status %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAPIBadRequest(t *testing.T) {
+	resp, err := wt.Post("/api/v1/novels", "application/json", strings.NewReader(`{"title": `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; !strings.HasPrefix(got, want) {
+		t.Errorf("got Content-Type %q, want prefix %q", got, want)
+	}
+}
+
+func TestAPIBodyTooLarge(t *testing.T) {
+	body := `{"title": "` + strings.Repeat("a", maxAPIBodySize) + `"}`
+	resp, err := wt.Post("/api/v1/novels", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	for name, db := range testDBs {
+		t.Run(name, func(t *testing.T) {
+			n.DB = db
+			ctx := context.Background()
+			id, err := n.DB.AddNovel(ctx, &Novel{Title: "吾輩は猫である", Author: "夏目漱石"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodyContains(t, wt, "/novels?q="+url.QueryEscape("漱石"), "吾輩は猫である")
+			bodyContains(t, wt, "/novels?q="+url.QueryEscape("犬"), "No novels found")
+			if err := n.DB.DeleteNovel(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+			bodyContains(t, wt, "/novels?q="+url.QueryEscape("漱石"), "No novels found")
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	for _, path := range []string{"/novels/doesnotexist", "/novels/doesnotexist/edit", "/api/v1/novels/doesnotexist"} {
+		resp, err := wt.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+			t.Errorf("GET %s: got status %d, want %d", path, got, want)
+		}
+	}
+	bodyContains(t, wt, "/novels/doesnotexist", "Not Found")
+}
+
+func TestAddInvalidNovel(t *testing.T) {
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("author", "homer")
+	m.WriteField("publishedDate", "someday")
+	m.Close()
+
+	resp, err := wt.Post("/novels", "multipart/form-data; boundary="+m.Boundary(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Add novel", "Title is required", "Date published must be", `value="homer"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("got:\n----\n%s\nWant to contain:\n%s----", b, want)
+		}
+	}
+}
+
+func TestAddWithCover(t *testing.T) {
+	body, contentType := coverForm(t, "cover story", "cover.png", testPNG(t, 400, 600))
+
+	resp, err := wt.Post("/novels", contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	novelPath := resp.Request.URL.Path
+	id := strings.TrimPrefix(novelPath, "/novels/")
+	novel, err := n.DB.GetNovel(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetNovel(%q): %v", id, err)
+	}
+	defer n.DB.DeleteNovel(context.Background(), id)
+	if !strings.HasPrefix(novel.ImageURL, "/images/") {
+		t.Fatalf("got ImageURL %q, want it served from /images/", novel.ImageURL)
+	}
+	if !strings.HasPrefix(novel.ThumbnailURL, "/images/") || novel.ThumbnailURL == novel.ImageURL {
+		t.Fatalf("got ThumbnailURL %q, want a separate image served from /images/", novel.ThumbnailURL)
+	}
+	bodyContains(t, wt, novelPath, novel.ImageURL)
+	bodyContains(t, wt, "/novels", novel.ThumbnailURL)
+
+	for url, wantWidth := range map[string]int{novel.ImageURL: 400, novel.ThumbnailURL: coverThumbnail.MaxWidth} {
+		resp, err := wt.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := image.Decode(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		if w := got.Bounds().Dx(); w != wantWidth {
+			t.Errorf("GET %s: width %d, want %d", url, w, wantWidth)
+		}
+	}
+}
+
+func TestAddWithCoverURL(t *testing.T) {
+	png := testPNG(t, 30, 40)
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer src.Close()
+	oldClient := n.coverClient
+	n.coverClient = src.Client()
+	defer func() { n.coverClient = oldClient }()
+
+	resp, err := wt.PostForm("/novels", url.Values{"title": {"imported cover"}, "coverURL": {src.URL + "/cover.png"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id := strings.TrimPrefix(resp.Request.URL.Path, "/novels/")
+	novel, err := n.DB.GetNovel(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetNovel(%q): %v", id, err)
+	}
+	defer n.DB.DeleteNovel(context.Background(), id)
+	if !strings.HasPrefix(novel.ImageURL, "/images/") || !strings.HasPrefix(novel.ThumbnailURL, "/images/") {
+		t.Fatalf("got ImageURL %q, ThumbnailURL %q, want covers served from /images/", novel.ImageURL, novel.ThumbnailURL)
+	}
+	checkStatus(t, novel.ImageURL, http.StatusOK)
+}
+
+func TestReplaceAndDeleteCover(t *testing.T) {
+	body, contentType := coverForm(t, "replaced cover", "cover.png", testPNG(t, 40, 60))
+	resp, err := wt.Post("/novels", contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	novelPath := resp.Request.URL.Path
+	old, err := n.DB.GetNovel(context.Background(), strings.TrimPrefix(novelPath, "/novels/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, contentType = coverForm(t, "replaced cover", "new.png", testPNG(t, 50, 50))
+	resp, err = wt.Post(novelPath, contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cur, err := n.DB.GetNovel(context.Background(), old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.ImageURL == old.ImageURL {
+		t.Fatalf("cover was not replaced: %q", cur.ImageURL)
+	}
+	for _, url := range append(coverURLs(old), coverURLs(cur)...) {
+		want := http.StatusOK
+		if url == old.ImageURL || url == old.ThumbnailURL {
+			want = http.StatusNotFound
+		}
+		checkStatus(t, url, want)
+	}
+
+	// Covers are kept while the novel is in the trash and deleted when it
+	// is purged.
+	resp, err = wt.Post(novelPath+":delete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, url := range coverURLs(cur) {
+		checkStatus(t, url, http.StatusOK)
+	}
+	resp, err = wt.Post("/trash/"+cur.ID+":purge", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, url := range coverURLs(cur) {
+		checkStatus(t, url, http.StatusNotFound)
+	}
+}
+
+func checkStatus(t *testing.T, path string, want int) {
+	t.Helper()
+	resp, err := wt.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != want {
+		t.Errorf("GET %s: got status %d, want %d", path, resp.StatusCode, want)
+	}
+}
+
+func TestAddFormISBNLookup(t *testing.T) {
+	bodyContains(t, wt, "/novels/add?isbn=4-10-101013-7", "夏目漱石")
+	bodyContains(t, wt, "/novels/add?isbn=4-10-101013-7", "https://covers.openlibrary.org/b/isbn/9784101010137-L.jpg")
+	bodyContains(t, wt, "/novels/add?isbn=9784003101018", "ISBN was not found.")
+	bodyContains(t, wt, "/novels/add?isbn=12345", "ISBN must be a valid ISBN-10 or ISBN-13.")
+}
+
+func TestAPIISBNLookup(t *testing.T) {
+	body, resp, err := wt.GetBody("/api/v1/isbn/9784101010137")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	var md BookMetadata
+	if err := json.Unmarshal([]byte(body), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Novel.Title != "こころ" || md.Novel.ISBN10 != "4101010137" || md.CoverURL == "" {
+		t.Errorf("got %+v, %+v", md, md.Novel)
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/isbn/9784003101018": http.StatusNotFound,
+		"/api/v1/isbn/not-an-isbn":   http.StatusBadRequest,
+	} {
+		_, resp, err := wt.GetBody(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestAddWithInvalidCover(t *testing.T) {
+	body, contentType := coverForm(t, "not a cover", "cover.png", []byte("not really a png"))
+	resp, err := wt.Post("/novels", contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if want := "Cover image must be a JPEG, PNG, GIF or WebP image."; !strings.Contains(string(b), want) {
+		t.Errorf("body does not contain %q:\n%s", want, b)
+	}
+}
+
+// testPNG returns a w x h PNG image.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x80, 0x20, 0x20, 0xff}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// coverForm returns a multipart form adding a novel titled title with the
+// cover image data uploaded as filename.
+func coverForm(t *testing.T, title, filename string, data []byte) (io.Reader, string) {
+	t.Helper()
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", title)
+	fw, err := m.CreateFormFile("image", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	m.Close()
+	return &body, "multipart/form-data; boundary=" + m.Boundary()
+}
+
 func TestSendLog(t *testing.T) {
 	buf := &bytes.Buffer{}
 	oldLogger := n.logWriter
 	n.logWriter = buf
 
-	bodyContains(t, wt, "/logs", "Log sent!")
+	bodyContains(t, adminWT, "/logs", "Log sent!")
 
 	n.logWriter = oldLogger
 	if got, want := buf.String(), "Good job!"; !strings.Contains(got, want) {
@@ -198,7 +858,7 @@ func TestSendError(t *testing.T) {
 	oldLogger := n.logWriter
 	n.logWriter = buf
 
-	bodyContains(t, wt, "/errors", "Error Reporting")
+	bodyContains(t, adminWT, "/errors", "Error Reporting")
 
 	n.logWriter = oldLogger
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DatePrecision is how much of a PartialDate is known.
+type DatePrecision int
+
+const (
+	PrecisionNone DatePrecision = iota
+	PrecisionYear
+	PrecisionMonth
+	PrecisionDay
+)
+
+// PartialDate is a calendar date that may be known only to the year or the
+// month. It is kept in canonical form "2006", "2006-01" or "2006-01-02",
+// which sorts chronologically as a string, so backends can order and
+// range-filter on it directly. The zero value is an unknown date.
+type PartialDate string
+
+// partialDateLayouts are the accepted input forms of a PartialDate, each
+// paired with the precision it carries.
+var partialDateLayouts = []struct {
+	layout    string
+	precision DatePrecision
+}{
+	{"2006", PrecisionYear},
+	{"2006-01", PrecisionMonth},
+	{"2006-1", PrecisionMonth},
+	{"2006/01", PrecisionMonth},
+	{"2006/1", PrecisionMonth},
+	{"2006年1月", PrecisionMonth},
+	{"January 2006", PrecisionMonth},
+	{"2006-01-02", PrecisionDay},
+	{"2006-1-2", PrecisionDay},
+	{"2006/01/02", PrecisionDay},
+	{"2006/1/2", PrecisionDay},
+	{"2006年1月2日", PrecisionDay},
+	{"January 2, 2006", PrecisionDay},
+	{"2 January 2006", PrecisionDay},
+}
+
+// ParsePartialDate parses s in any of the accepted forms and returns it in
+// canonical form, keeping only the precision given. The empty string
+// parses as the zero PartialDate.
+func ParsePartialDate(s string) (PartialDate, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, l := range partialDateLayouts {
+		if t, err := time.Parse(l.layout, s); err == nil {
+			return newPartialDate(t, l.precision), nil
+		}
+	}
+	return "", fmt.Errorf("must be a date such as 2006, 2006-01 or 2006-01-02")
+}
+
+func newPartialDate(t time.Time, p DatePrecision) PartialDate {
+	switch p {
+	case PrecisionYear:
+		return PartialDate(t.Format("2006"))
+	case PrecisionMonth:
+		return PartialDate(t.Format("2006-01"))
+	case PrecisionDay:
+		return PartialDate(t.Format("2006-01-02"))
+	}
+	return ""
+}
+
+// Precision reports how much of d is known.
+func (d PartialDate) Precision() DatePrecision {
+	switch len(d) {
+	case len("2006"):
+		return PrecisionYear
+	case len("2006-01"):
+		return PrecisionMonth
+	case len("2006-01-02"):
+		return PrecisionDay
+	}
+	return PrecisionNone
+}
+
+// Year returns the year of d, or 0 if d is unknown.
+func (d PartialDate) Year() int {
+	if d.Precision() == PrecisionNone {
+		return 0
+	}
+	y, _ := strconv.Atoi(string(d[:4]))
+	return y
+}
+
+// Time returns the first instant of d in UTC. Unknown months and days are
+// taken to be January and the 1st.
+func (d PartialDate) Time() time.Time {
+	var layout string
+	switch d.Precision() {
+	case PrecisionYear:
+		layout = "2006"
+	case PrecisionMonth:
+		layout = "2006-01"
+	case PrecisionDay:
+		layout = "2006-01-02"
+	default:
+		return time.Time{}
+	}
+	t, _ := time.Parse(layout, string(d))
+	return t
+}
+
+// GenreList returns the genre tags of n as a comma-separated list, the form
+// they are edited in.
+func (n *Novel) GenreList() string {
+	return strings.Join(n.Genres, ", ")
+}
+
+// normalizeISBNs validates the ISBN-10 and ISBN-13 of a novel, strips
+// hyphens and spaces, and fills in whichever is missing when it can be
+// derived from the other.
+func normalizeISBNs(isbn10, isbn13 string) (string, string, ValidationErrors) {
+	errs := ValidationErrors{}
+	isbn10 = cleanISBN(isbn10)
+	isbn13 = cleanISBN(isbn13)
+	if isbn10 != "" && !validISBN10(isbn10) {
+		errs["isbn10"] = "must be a valid 10-digit ISBN"
+	}
+	if isbn13 != "" && !validISBN13(isbn13) {
+		errs["isbn13"] = "must be a valid 13-digit ISBN"
+	}
+	if len(errs) > 0 {
+		return isbn10, isbn13, errs
+	}
+	switch {
+	case isbn10 != "" && isbn13 == "":
+		isbn13 = isbn10To13(isbn10)
+	case isbn13 != "" && isbn10 == "":
+		isbn10 = isbn13To10(isbn13)
+	case isbn10 != "" && isbn13 != "" && isbn10To13(isbn10) != isbn13:
+		errs["isbn13"] = "does not match the ISBN-10"
+		return isbn10, isbn13, errs
+	}
+	return isbn10, isbn13, nil
+}
+
+func cleanISBN(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s)))
+}
+
+func validISBN10(s string) bool {
+	if len(s) != 10 {
+		return false
+	}
+	sum := 0
+	for i, c := range s {
+		var d int
+		switch {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case c == 'X' && i == 9:
+			d = 10
+		default:
+			return false
+		}
+		sum += (10 - i) * d
+	}
+	return sum%11 == 0
+}
+
+func validISBN13(s string) bool {
+	if len(s) != 13 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return isbn13CheckDigit(s[:12]) == s[12]
+}
+
+func isbn13CheckDigit(s string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(s[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isbn10To13(s string) string {
+	body := "978" + s[:9]
+	return body + string(isbn13CheckDigit(body))
+}
+
+// isbn13To10 returns the ISBN-10 for s, or "" if s is in the 979 range,
+// which has no ISBN-10 equivalent.
+func isbn13To10(s string) string {
+	if !strings.HasPrefix(s, "978") {
+		return ""
+	}
+	body := s[3:12]
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(body[i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return body + "X"
+	}
+	return body + strconv.Itoa(check)
+}
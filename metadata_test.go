@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestParsePartialDate(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      PartialDate
+		precision DatePrecision
+	}{
+		{"", "", PrecisionNone},
+		{"1905", "1905", PrecisionYear},
+		{"1905-01", "1905-01", PrecisionMonth},
+		{"1905/1", "1905-01", PrecisionMonth},
+		{"1905年1月", "1905-01", PrecisionMonth},
+		{"1905-01-02", "1905-01-02", PrecisionDay},
+		{"1905/1/2", "1905-01-02", PrecisionDay},
+		{"1905年1月2日", "1905-01-02", PrecisionDay},
+		{"January 2, 1905", "1905-01-02", PrecisionDay},
+	}
+	for _, tc := range tests {
+		got, err := ParsePartialDate(tc.in)
+		if err != nil {
+			t.Errorf("ParsePartialDate(%q): %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParsePartialDate(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if p := got.Precision(); p != tc.precision {
+			t.Errorf("ParsePartialDate(%q).Precision() = %d, want %d", tc.in, p, tc.precision)
+		}
+	}
+	for _, in := range []string{"last year", "1905-13", "1905-02-30", "05"} {
+		if got, err := ParsePartialDate(in); err == nil {
+			t.Errorf("ParsePartialDate(%q) = %q, want error", in, got)
+		}
+	}
+
+	d := PartialDate("1905-01")
+	if got, want := d.Year(), 1905; got != want {
+		t.Errorf("Year() = %d, want %d", got, want)
+	}
+	if got, want := d.Time().Format("2006-01-02"), "1905-01-01"; got != want {
+		t.Errorf("Time() = %s, want %s", got, want)
+	}
+}
+
+func TestNormalizeISBNs(t *testing.T) {
+	tests := []struct {
+		in10, in13     string
+		want10, want13 string
+		wantErr        bool
+	}{
+		{"4-10-101013-7", "", "4101010137", "9784101010137", false},
+		{"", "978-4-10-101013-7", "4101010137", "9784101010137", false},
+		{"0-8044-2957-x", "", "080442957X", "9780804429573", false},
+		{"", "9780804429573", "080442957X", "9780804429573", false},
+		{"", "9791032305690", "", "9791032305690", false},
+		{"4101010137", "9784101010137", "4101010137", "9784101010137", false},
+		{"4101010131", "", "", "", true},
+		{"", "9784101010138", "", "", true},
+		{"4101010137", "9780804429573", "", "", true},
+	}
+	for _, tc := range tests {
+		got10, got13, errs := normalizeISBNs(tc.in10, tc.in13)
+		if tc.wantErr {
+			if errs == nil {
+				t.Errorf("normalizeISBNs(%q, %q): want error", tc.in10, tc.in13)
+			}
+			continue
+		}
+		if errs != nil {
+			t.Errorf("normalizeISBNs(%q, %q): %v", tc.in10, tc.in13, errs)
+			continue
+		}
+		if got10 != tc.want10 || got13 != tc.want13 {
+			t.Errorf("normalizeISBNs(%q, %q) = %q, %q, want %q, %q", tc.in10, tc.in13, got10, got13, tc.want10, tc.want13)
+		}
+	}
+}
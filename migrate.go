@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// migrateResult reports the outcome of copying novels between databases.
+// Counts include the novels in the trash.
+type migrateResult struct {
+	DryRun  bool
+	Source  int // novels in the source
+	Target  int // novels in the target afterwards
+	Copied  int // novels copied, or to be copied in a dry run
+	Skipped int // novels already in the target as they are in the source
+	Extra   int // novels in the target that are not in the source
+	NoOwner int // novels whose owner has no account in the target
+
+	// SourceChecksum and TargetChecksum are the checksums of the source's
+	// novels, with their owners mapped to the target, and of the novels
+	// with the same IDs in the target. They match when the migration is
+	// complete.
+	SourceChecksum string
+	TargetChecksum string
+}
+
+// novelChecksum returns a checksum of everything stored about novel. Times
+// are taken in UTC to the microsecond, the precision every database keeps.
+func novelChecksum(novel *Novel) (string, error) {
+	c := *novel
+	c.CreatedAt = c.CreatedAt.UTC().Truncate(time.Microsecond)
+	if c.DeletedAt != nil {
+		t := c.DeletedAt.UTC().Truncate(time.Microsecond)
+		c.DeletedAt = &t
+	}
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// novelSnapshot is every novel in a database, in the trash or not, with
+// its checksum.
+type novelSnapshot struct {
+	novels    map[string]*Novel
+	checksums map[string]string
+}
+
+func takeNovelSnapshot(ctx context.Context, db NovelDatabase) (*novelSnapshot, error) {
+	novels, err := db.ListNovels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trash, err := db.ListTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &novelSnapshot{novels: make(map[string]*Novel), checksums: make(map[string]string)}
+	for _, novel := range append(novels, trash...) {
+		sum, err := novelChecksum(novel)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode novel %q: %v", novel.ID, err)
+		}
+		s.novels[novel.ID] = novel
+		s.checksums[novel.ID] = sum
+	}
+	return s, nil
+}
+
+// mapOwners gives every novel in s the owner owners maps its owner to, or
+// none if there is no such owner, and returns how many novels are left
+// without one.
+func (s *novelSnapshot) mapOwners(owners map[string]string) (int, error) {
+	noOwner := 0
+	for id, novel := range s.novels {
+		if novel.CreatedBy == "" {
+			continue
+		}
+		c := *novel
+		c.CreatedBy = owners[novel.CreatedBy]
+		if c.CreatedBy == "" {
+			noOwner++
+		}
+		sum, err := novelChecksum(&c)
+		if err != nil {
+			return 0, fmt.Errorf("could not encode novel %q: %v", id, err)
+		}
+		s.novels[id] = &c
+		s.checksums[id] = sum
+	}
+	return noOwner, nil
+}
+
+// checksum returns a checksum over the novels in s with the given IDs,
+// which must be sorted. Novels missing from s count as empty.
+func (s *novelSnapshot) checksum(ids []string) string {
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s %s\n", id, s.checksums[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// migrateNovels copies every novel in src, in the trash or not, to dst
+// under the same ID, and then checks that dst holds the same novels. The
+// owner of each novel is replaced by the user owners maps it to, and
+// cleared if there is none. Novels already in dst as they would be copied
+// are skipped, so a migration
+// that was interrupted resumes where it stopped when run again. Progress
+// is written to progress after every batch. It only uses the
+// NovelDatabase interface, so it works between any two databases.
+func migrateNovels(ctx context.Context, src, dst NovelDatabase, owners map[string]string, dryRun bool, progress io.Writer) (*migrateResult, error) {
+	from, err := takeNovelSnapshot(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: could not read the source: %v", err)
+	}
+	noOwner, err := from.mapOwners(owners)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %v", err)
+	}
+	to, err := takeNovelSnapshot(ctx, dst)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: could not read the target: %v", err)
+	}
+	ids := make([]string, 0, len(from.novels))
+	for id := range from.novels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	res := &migrateResult{DryRun: dryRun, Source: len(ids), NoOwner: noOwner, SourceChecksum: from.checksum(ids)}
+	var todo []*Novel
+	for _, id := range ids {
+		if to.checksums[id] == from.checksums[id] {
+			res.Skipped++
+			continue
+		}
+		todo = append(todo, from.novels[id])
+	}
+	if dryRun {
+		res.Copied = len(todo)
+	}
+	for start := 0; start < len(todo) && !dryRun; start += maxNovelBatch {
+		end := start + maxNovelBatch
+		if end > len(todo) {
+			end = len(todo)
+		}
+		if err := dst.PutNovels(ctx, todo[start:end]); err != nil {
+			return res, fmt.Errorf("migrate: %v", err)
+		}
+		res.Copied = end
+		fmt.Fprintf(progress, "copied %d of %d novels\n", res.Copied, len(todo))
+	}
+	if !dryRun {
+		if to, err = takeNovelSnapshot(ctx, dst); err != nil {
+			return res, fmt.Errorf("migrate: could not read the target to verify it: %v", err)
+		}
+	}
+
+	res.Target = len(to.novels)
+	res.TargetChecksum = to.checksum(ids)
+	for id := range to.novels {
+		if _, ok := from.novels[id]; !ok {
+			res.Extra++
+		}
+	}
+	if dryRun {
+		return res, nil
+	}
+	var differ int
+	for _, id := range ids {
+		if to.checksums[id] != from.checksums[id] {
+			differ++
+		}
+	}
+	if differ > 0 {
+		return res, fmt.Errorf("migrate: %d novels in the target differ from the source; run the migration again", differ)
+	}
+	return res, nil
+}
+
+// migrateOwners maps the IDs of the users in src to the IDs of the users in
+// dst with the same email addresses.
+func migrateOwners(ctx context.Context, src, dst UserDatabase) (map[string]string, error) {
+	users, err := src.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list users: %v", err)
+	}
+	owners := make(map[string]string)
+	for _, u := range users {
+		t, err := dst.GetUserByEmail(ctx, u.Email)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not look up user %q in the target: %v", u.Email, err)
+		}
+		owners[u.ID] = t.ID
+	}
+	return owners, nil
+}
+
+// migrateCommand implements "novelshelf migrate", which copies the novels
+// in the configured database to another database, keeping their IDs.
+// Users and history are not copied: as by restore, novels are put on the
+// shelves of the users in the target with the same email addresses as
+// their owners.
+func (n *Novelshelf) migrateCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	target := &Config{}
+	fs.StringVar(&target.Database, "to", "", "database to copy the novels to: firestore, sqlite3 or postgres")
+	fs.StringVar(&target.DatabaseDSN, "dsn", "", "data source name of the sqlite3 or postgres database")
+	fs.StringVar(&target.ProjectID, "project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "Google Cloud project of the firestore database")
+	dryRun := fs.Bool("dry-run", false, "only count the novels to copy")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch target.Database {
+	case "firestore":
+		if target.ProjectID == "" {
+			return errors.New("migrate: give the -project of the firestore database")
+		}
+	case "sqlite3", "postgres":
+		if target.DatabaseDSN == "" {
+			return fmt.Errorf("migrate: give the -dsn of the %s database", target.Database)
+		}
+	default:
+		fs.Usage()
+		return errors.New("migrate: give the database to copy to with -to firestore, sqlite3 or postgres")
+	}
+	dst, err := newDatabase(ctx, target)
+	if err != nil {
+		return fmt.Errorf("migrate: %v", err)
+	}
+	if c, ok := dst.(interface{ Close(context.Context) error }); ok {
+		defer c.Close(ctx)
+	}
+
+	dstUsers, ok := usersOf(dst)
+	if !ok {
+		return fmt.Errorf("migrate: the %s database cannot store users", target.Database)
+	}
+	owners, err := migrateOwners(ctx, n.Users, dstUsers)
+	if err != nil {
+		return fmt.Errorf("migrate: %v", err)
+	}
+	res, err := migrateNovels(ctx, unwrapDB(n.DB), dst, owners, *dryRun, out)
+	if res != nil {
+		verb := "Copied"
+		if res.DryRun {
+			verb = "Would copy"
+		}
+		fmt.Fprintf(out, "%s %d novels; %d were already in the target\n", verb, res.Copied, res.Skipped)
+		fmt.Fprintf(out, "source: %d novels, checksum %s\n", res.Source, res.SourceChecksum)
+		if res.TargetChecksum != "" {
+			fmt.Fprintf(out, "target: %d novels, checksum %s\n", res.Target, res.TargetChecksum)
+		}
+		if res.Extra > 0 {
+			fmt.Fprintf(out, "the target also has %d novels that are not in the source\n", res.Extra)
+		}
+		if res.NoOwner > 0 {
+			fmt.Fprintf(out, "%d novels have no owner in the target; add their owners there and run the migration again to give the novels back to them\n", res.NoOwner)
+		}
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateNovels(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "novelshelf-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := newMemoryDB()
+	var ids []string
+	for _, title := range []string{"三四郎", "それから", "門"} {
+		id, err := src.AddNovel(ctx, &Novel{Title: title, Author: "夏目漱石", Genres: []string{"小説"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := src.DeleteNovel(ctx, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := newSQLDB("sqlite3", filepath.Join(dir, "novels.db"))
+	if err != nil {
+		t.Fatalf("newSQLDB: %v", err)
+	}
+	defer dst.Close(ctx)
+
+	var progress bytes.Buffer
+	res, err := migrateNovels(ctx, src, dst, nil, true, &progress)
+	if err != nil || res.Copied != 3 || res.Target != 0 {
+		t.Fatalf("dry run: got %+v, %v", res, err)
+	}
+
+	// A migration interrupted after the first novel resumes with the rest.
+	first, _ := src.GetNovel(ctx, ids[0])
+	if err := dst.PutNovels(ctx, []*Novel{first}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = migrateNovels(ctx, src, dst, nil, false, &progress)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if res.Source != 3 || res.Target != 3 || res.Copied != 2 || res.Skipped != 1 || res.Extra != 0 || res.SourceChecksum != res.TargetChecksum {
+		t.Errorf("migrate: got %+v", res)
+	}
+	if !strings.Contains(progress.String(), "copied 2 of 2 novels") {
+		t.Errorf("migrate: got progress %q", progress.String())
+	}
+	if novel, err := dst.GetNovel(ctx, ids[1]); err != nil || novel.Title != "それから" {
+		t.Errorf("GetNovel(%q) in the target: got %+v, %v", ids[1], novel, err)
+	}
+	if novel, err := dst.GetTrashedNovel(ctx, ids[2]); err != nil || novel.Title != "門" {
+		t.Errorf("GetTrashedNovel(%q) in the target: got %+v, %v", ids[2], novel, err)
+	}
+
+	// Running it again copies only what changed since.
+	if _, err := src.PatchNovel(ctx, ids[0], NovelPatch{Fields: map[string]interface{}{"title": "坊っちゃん"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.AddNovel(ctx, &Novel{Title: "extra"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = migrateNovels(ctx, src, dst, nil, false, &progress)
+	if err != nil || res.Copied != 1 || res.Skipped != 2 || res.Extra != 1 || res.SourceChecksum != res.TargetChecksum {
+		t.Errorf("migrate again: got %+v, %v", res, err)
+	}
+	if novel, err := dst.GetNovel(ctx, ids[0]); err != nil || novel.Title != "坊っちゃん" || novel.Version != 2 {
+		t.Errorf("GetNovel(%q) in the target: got %+v, %v", ids[0], novel, err)
+	}
+}
+
+// brokenDB is a NovelDatabase whose trash cannot be read, as when a
+// stored novel fails to decode.
+type brokenDB struct {
+	NovelDatabase
+}
+
+var errBrokenNovel = errors.New("could not decode novel \"broken\"")
+
+func (db brokenDB) ListTrash(ctx context.Context) ([]*Novel, error) {
+	return nil, errBrokenNovel
+}
+
+func TestMigrateNovelsSourceError(t *testing.T) {
+	ctx := context.Background()
+	src := newMemoryDB()
+	if _, err := src.AddNovel(ctx, &Novel{Title: "草枕"}); err != nil {
+		t.Fatal(err)
+	}
+	dst := newMemoryDB()
+	res, err := migrateNovels(ctx, brokenDB{src}, dst, nil, false, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), errBrokenNovel.Error()) {
+		t.Fatalf("migrate from a broken source: got %+v, %v, want the source's error", res, err)
+	}
+	if novels, _ := dst.ListNovels(ctx); len(novels) != 0 {
+		t.Errorf("migrate from a broken source: copied %d novels", len(novels))
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "novelshelf-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := newMemoryDB()
+	shelf := &Novelshelf{DB: db, Users: db, logWriter: ioutil.Discard}
+	owner := &User{Email: "owner@example.com"}
+	left := &User{Email: "left@example.com"}
+	for _, u := range []*User{owner, left} {
+		if _, err := db.AddUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := db.AddNovel(ctx, &Novel{Title: "こころ", CreatedBy: owner.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftID, err := db.AddNovel(ctx, &Novel{Title: "道草", CreatedBy: left.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner has an account in the target too, under another ID.
+	dsn := filepath.Join(dir, "novels.db")
+	dst, err := newSQLDB("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close(ctx)
+	dstOwner := &User{Email: owner.Email}
+	if _, err := dst.AddUser(ctx, dstOwner); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := shelf.migrateCommand(ctx, []string{"-to", "memory"}, &out); err == nil {
+		t.Error("migrate to memory: want error")
+	}
+	if err := shelf.migrateCommand(ctx, []string{"-to", "sqlite3", "-dsn", dsn}, &out); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if !strings.Contains(out.String(), "Copied 2 novels") || !strings.Contains(out.String(), "1 novels have no owner in the target") {
+		t.Errorf("migrate: got output %q", out.String())
+	}
+	if novel, err := dst.GetNovel(ctx, id); err != nil || novel.Title != "こころ" || novel.CreatedBy != dstOwner.ID {
+		t.Errorf("GetNovel(%q) in the target: got %+v, %v", id, novel, err)
+	}
+	if novel, err := dst.GetNovel(ctx, leftID); err != nil || novel.CreatedBy != "" {
+		t.Errorf("GetNovel(%q) in the target: got %+v, %v, want no owner", leftID, novel, err)
+	}
+}
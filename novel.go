@@ -2,63 +2,187 @@ package main
 
 import (
 	"cloud.google.com/go/errorreporting"
-	"cloud.google.com/go/storage"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/gorilla/sessions"
+	"net/http"
 	"os"
+	"time"
 
 	"io"
 )
 
+// ErrNotFound is returned by NovelDatabase implementations when the
+// requested novel does not exist.
+var ErrNotFound = errors.New("novel not found")
+
+// ErrConflict is returned by NovelDatabase implementations when a write
+// conflicts with the current state of the novel.
+var ErrConflict = errors.New("novel was modified concurrently")
+
 type Novel struct {
-	ID            string
-	Title         string
-	Author        string
-	PublishedDate string
-	ImageURL      string
-	Description   string
+	ID            string      `json:"id"`
+	Title         string      `json:"title"`
+	Author        string      `json:"author"`
+	PublishedDate PartialDate `json:"publishedDate"`
+	ImageURL      string      `json:"imageURL"`
+	ThumbnailURL  string      `json:"thumbnailURL,omitempty"` // scaled-down cover for lists
+	Description   string      `json:"description"`
+	CreatedAt     time.Time   `json:"createdAt"`
+	CreatedBy     string      `json:"createdBy,omitempty"` // ID of the user whose shelf the novel is on
+	Version       int         `json:"version"`             // incremented by every UpdateNovel
+	DeletedAt     *time.Time  `json:"deletedAt,omitempty"` // set while the novel is in the trash
+
+	ISBN10    string   `json:"isbn10,omitempty"`
+	ISBN13    string   `json:"isbn13,omitempty"`
+	Publisher string   `json:"publisher,omitempty"`
+	PageCount int      `json:"pageCount,omitempty"`
+	Language  string   `json:"language,omitempty"` // BCP 47 tag, e.g. "ja"
+	Genres    []string `json:"genres,omitempty"`
+	Series    string   `json:"series,omitempty"`
+	Volume    int      `json:"volume,omitempty"` // volume number within Series
 }
 
+// maxNovelBatch is the most novels NovelDatabase.AddNovels adds in one
+// write, which is the limit of a Firestore batch.
+const maxNovelBatch = 500
+
 type NovelDatabase interface {
 	ListNovels(context.Context) ([]*Novel, error)
+	ListNovelsPage(ctx context.Context, opts ListOptions) (*NovelPage, error)
 	GetNovel(ctx context.Context, id string) (*Novel, error)
 	AddNovel(ctx context.Context, n *Novel) (id string, err error)
+	// AddNovels adds novels like AddNovel, but in as few writes as the
+	// database allows. Up to maxNovelBatch novels are added atomically;
+	// if adding more fails, the IDs of the batches added before are
+	// returned with the error.
+	AddNovels(ctx context.Context, novels []*Novel) (ids []string, err error)
+	// PutNovels stores novels under their own IDs, as they are, replacing
+	// any novels stored under those IDs. Novels with DeletedAt set are put
+	// in the trash. Like AddNovels it writes in as few batches as the
+	// database allows. It copies novels from another database, so it
+	// records no history.
+	PutNovels(ctx context.Context, novels []*Novel) error
+	// DeleteNovel moves novel id to the trash. Trashed novels are left out
+	// of lists, and the other methods return ErrNotFound for them.
 	DeleteNovel(ctx context.Context, id string) error
+	// UpdateNovel replaces the stored novel with n, provided it is still at
+	// n.Version, and then increments n.Version. If the novel has been
+	// updated since n was read it returns ErrConflict.
 	UpdateNovel(ctx context.Context, n *Novel) error
+	// PatchNovel changes only the fields of novel id that p names,
+	// provided it is still at p.Version if that is set, increments its
+	// version and returns the novel as saved.
+	PatchNovel(ctx context.Context, id string, p NovelPatch) (*Novel, error)
+
+	// ListTrash returns the novels in the trash, most recently deleted
+	// first.
+	ListTrash(ctx context.Context) ([]*Novel, error)
+	// GetTrashedNovel returns novel id if it is in the trash and
+	// ErrNotFound otherwise.
+	GetTrashedNovel(ctx context.Context, id string) (*Novel, error)
+	// RestoreNovel takes novel id out of the trash and returns it.
+	RestoreNovel(ctx context.Context, id string) (*Novel, error)
+	// PurgeNovel permanently deletes novel id, which must be in the trash.
+	PurgeNovel(ctx context.Context, id string) error
 }
 
 type Novelshelf struct {
-	DB                NovelDatabase
-	StorageBucket     *storage.BucketHandle
-	StorageBucketName string
-	logWriter         io.Writer
-	errorClient       *errorreporting.Client
+	DB          NovelDatabase
+	Users       UserDatabase
+	History     HistoryDatabase
+	Images      ImageStore       // nil if cover uploads are disabled
+	ISBN        MetadataProvider // nil if ISBN lookup is disabled
+	coverClient *http.Client     // fetches covers imported from a URL
+	sessions    *sessions.CookieStore
+	csrf        func(http.Handler) http.Handler
+	identity    IdentityProvider // nil if only passwords are accepted
+	defaultRole Role             // role of accounts created on first sign-in
+	logWriter   io.Writer
+	errorClient *errorreporting.Client // nil if errors are only logged
+
+	trashRetention time.Duration // 0 keeps deleted novels until purged by hand
 }
 
-func NewNovelshelf(projectID string, db NovelDatabase) (*Novelshelf, error) {
+// NewNovelshelf creates a Novelshelf serving db, with the image storage,
+// sign-in and error reporting selected by cfg. Users and the history of
+// novels are stored in db.
+func NewNovelshelf(cfg *Config, db NovelDatabase) (*Novelshelf, error) {
 	ctx := context.Background()
 
-	bucketName := projectID + ".appspot.com"
-	storageClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, err
+	users, ok := usersOf(db)
+	if !ok {
+		return nil, fmt.Errorf("novelshelf: %T cannot store users", db)
 	}
-	errorClient, err := errorreporting.NewClient(ctx, projectID, errorreporting.Config{
-		ServiceVersion: "novelshelf",
-		OnError: func(err error) {
-			fmt.Fprintf(os.Stderr, "could not log error: %v", err)
-		},
-	})
+	history, ok := historyOf(db)
+	if !ok {
+		return nil, fmt.Errorf("novelshelf: %T cannot store history", db)
+	}
+	retention, err := cfg.trashRetention()
 	if err != nil {
-		return nil, fmt.Errorf("errorreporting.NewClient: %v", err)
+		return nil, err
 	}
-
+	// App Engine serves the app over HTTPS only (see app.yaml), so session
+	// and CSRF cookies can be restricted to it there.
+	secure := os.Getenv("GAE_ENV") != ""
 	n := &Novelshelf{
-		DB:                db,
-		StorageBucket:     storageClient.Bucket(bucketName),
-		StorageBucketName: bucketName,
-		logWriter:         os.Stderr,
-		errorClient:       errorClient,
+		DB:          db,
+		Users:       users,
+		History:     history,
+		coverClient: newCoverClient(),
+		sessions:    newSessionStore(cfg.SessionKey, secure),
+		defaultRole: Role(cfg.DefaultRole),
+		logWriter:   os.Stderr,
+
+		trashRetention: retention,
+	}
+	n.csrf = newCSRF(cfg.SessionKey, secure, appHandler(n.csrfErrorHandler))
+	switch cfg.AuthProvider {
+	case "oidc":
+		p, err := newOIDCProvider(ctx, cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL)
+		if err != nil {
+			return nil, err
+		}
+		n.identity = p
+	case "local":
+		n.identity = newLocalProvider()
+	}
+	switch cfg.ImageStore {
+	case "gcs":
+		images, err := newGCSImageStore(ctx, cfg.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		n.Images = images
+	case "local":
+		images, err := newLocalImageStore(cfg.ImageDir)
+		if err != nil {
+			return nil, err
+		}
+		n.Images = images
+	}
+	switch cfg.ISBNProvider {
+	case "openlibrary":
+		n.ISBN = newOpenLibraryProvider(openLibraryURL)
+	case "fixture":
+		p, err := newFixtureProvider(cfg.ISBNFixtures)
+		if err != nil {
+			return nil, err
+		}
+		n.ISBN = p
+	}
+	if cfg.ErrorReporter == "errorreporting" {
+		errorClient, err := errorreporting.NewClient(ctx, cfg.ProjectID, errorreporting.Config{
+			ServiceVersion: "novelshelf",
+			OnError: func(err error) {
+				fmt.Fprintf(os.Stderr, "could not log error: %v", err)
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("errorreporting.NewClient: %v", err)
+		}
+		n.errorClient = errorClient
 	}
 	return n, nil
 }
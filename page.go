@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// SortField names the field a novel listing is ordered by.
+type SortField string
+
+const (
+	SortByTitle     SortField = "title"
+	SortByAuthor    SortField = "author"
+	SortByPublished SortField = "published"
+	SortByCreated   SortField = "created"
+)
+
+// ListOptions selects, orders and pages a novel listing.
+//
+// Cursor is an opaque token previously returned in NovelPage.NextCursor or
+// NovelPage.PrevCursor for the same Sort and Descending; the empty cursor
+// selects the first page. Author, when set, keeps only novels by exactly
+// that author. MinYear and MaxYear, when non-zero, keep only novels whose
+// PublishedDate falls within those years, inclusive. CreatedBy, when set,
+// keeps only the novels on that user's shelf.
+type ListOptions struct {
+	PageSize   int
+	Cursor     string
+	Sort       SortField
+	Descending bool
+	Author     string
+	MinYear    int
+	MaxYear    int
+	CreatedBy  string
+}
+
+// NovelPage is a single page of a novel listing.
+type NovelPage struct {
+	Novels     []*Novel `json:"novels"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+	PrevCursor string   `json:"prevCursor,omitempty"`
+}
+
+// pageCursor is the decoded form of a page token. It records the sort key of
+// the novel at the edge of the page it was issued for and which direction to
+// page from there.
+type pageCursor struct {
+	Sort       SortField `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	Before     bool      `json:"b,omitempty"`
+	Key        string    `json:"k"`
+	ID         string    `json:"i"`
+}
+
+func encodeCursor(c pageCursor) string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(fmt.Errorf("could not encode cursor: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor decodes the page token in opts. It returns a nil cursor for
+// the first page.
+func decodeCursor(opts ListOptions) (*pageCursor, error) {
+	if opts.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", opts.Cursor)
+	}
+	c := &pageCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("invalid cursor %q", opts.Cursor)
+	}
+	if c.Sort != opts.Sort || c.Descending != opts.Descending {
+		return nil, fmt.Errorf("cursor %q does not match the requested sort order", opts.Cursor)
+	}
+	return c, nil
+}
+
+// cursorAfter returns the token for the page following novel n.
+func cursorAfter(opts ListOptions, n *Novel) string {
+	return encodeCursor(pageCursor{Sort: opts.Sort, Descending: opts.Descending, Key: sortKey(n, opts.Sort), ID: n.ID})
+}
+
+// cursorBefore returns the token for the page preceding novel n.
+func cursorBefore(opts ListOptions, n *Novel) string {
+	return encodeCursor(pageCursor{Sort: opts.Sort, Descending: opts.Descending, Before: true, Key: sortKey(n, opts.Sort), ID: n.ID})
+}
+
+// sortTimeLayout formats times in sort keys. Unlike time.RFC3339Nano it
+// keeps trailing zeros, so that keys order the same way as the times.
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// sortKey returns the value of field f of n as a string that orders the same
+// way as the field itself.
+func sortKey(n *Novel, f SortField) string {
+	switch f {
+	case SortByAuthor:
+		return n.Author
+	case SortByPublished:
+		return string(n.PublishedDate)
+	case SortByCreated:
+		return n.CreatedAt.UTC().Format(sortTimeLayout)
+	}
+	return n.Title
+}
+
+// firestoreValue converts the cursor key back to the type stored in
+// Firestore for its sort field.
+func (c *pageCursor) firestoreValue() (interface{}, error) {
+	if c.Sort != SortByCreated {
+		return c.Key, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor time %q", c.Key)
+	}
+	return t, nil
+}
+
+// firestoreField returns the document field name f is stored under.
+func (f SortField) firestoreField() string {
+	switch f {
+	case SortByAuthor:
+		return "Author"
+	case SortByPublished:
+		return "PublishedDate"
+	case SortByCreated:
+		return "CreatedAt"
+	}
+	return "Title"
+}
+
+// compareNovels returns -1, 0 or +1 depending on whether a sorts before, at
+// or after b in the order selected by opts. Ties are broken by ID.
+func compareNovels(opts ListOptions, a, b *Novel) int {
+	return compareKeys(opts, sortKey(a, opts.Sort), a.ID, sortKey(b, opts.Sort), b.ID)
+}
+
+// compare returns -1, 0 or +1 depending on whether a sorts before, at or
+// after the cursor position.
+func (c *pageCursor) compare(opts ListOptions, a *Novel) int {
+	return compareKeys(opts, sortKey(a, opts.Sort), a.ID, c.Key, c.ID)
+}
+
+func compareKeys(opts ListOptions, ak, aid, bk, bid string) int {
+	cmp := strings.Compare(ak, bk)
+	if cmp == 0 {
+		cmp = strings.Compare(aid, bid)
+	}
+	if opts.Descending {
+		return -cmp
+	}
+	return cmp
+}
+
+// matches reports whether n passes the filters in opts.
+func (o ListOptions) matches(n *Novel) bool {
+	if o.Author != "" && n.Author != o.Author {
+		return false
+	}
+	if o.CreatedBy != "" && n.CreatedBy != o.CreatedBy {
+		return false
+	}
+	if lo, hi := o.publishedRange(); lo != "" && (string(n.PublishedDate) < lo || string(n.PublishedDate) >= hi) {
+		return false
+	}
+	return true
+}
+
+// publishedRange returns the half-open range [lo, hi) of PublishedDate
+// values that fall within MinYear and MaxYear. Dates are compared as
+// strings, which orders "2006", "2006-01" and "2006-01-02" correctly.
+func (o ListOptions) publishedRange() (lo, hi string) {
+	if o.MinYear == 0 && o.MaxYear == 0 {
+		return "", ""
+	}
+	lo, hi = "0000", "9999~"
+	if o.MinYear != 0 {
+		lo = fmt.Sprintf("%04d", o.MinYear)
+	}
+	if o.MaxYear != 0 {
+		hi = fmt.Sprintf("%04d", o.MaxYear+1)
+	}
+	return lo, hi
+}
+
+// normalize fills in the default page size and sort order and clamps the
+// page size to maxPageSize.
+func (o ListOptions) normalize() ListOptions {
+	if o.PageSize <= 0 {
+		o.PageSize = defaultPageSize
+	}
+	if o.PageSize > maxPageSize {
+		o.PageSize = maxPageSize
+	}
+	if o.Sort == "" {
+		o.Sort = SortByTitle
+	}
+	return o
+}
+
+// listOptionsFromRequest reads the pageSize, cursor, sort, order, author,
+// createdBy, from and to query parameters.
+func listOptionsFromRequest(r *http.Request) (ListOptions, error) {
+	var opts ListOptions
+	if s := r.FormValue("pageSize"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size <= 0 {
+			return opts, fmt.Errorf("invalid pageSize %q", s)
+		}
+		opts.PageSize = size
+	}
+	switch s := SortField(r.FormValue("sort")); s {
+	case "", SortByTitle, SortByAuthor, SortByPublished, SortByCreated:
+		opts.Sort = s
+	default:
+		return opts, fmt.Errorf("invalid sort %q", s)
+	}
+	switch s := r.FormValue("order"); s {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("invalid order %q", s)
+	}
+	opts.Author = r.FormValue("author")
+	opts.CreatedBy = r.FormValue("createdBy")
+	for _, p := range []struct {
+		name string
+		year *int
+	}{{"from", &opts.MinYear}, {"to", &opts.MaxYear}} {
+		s := r.FormValue(p.name)
+		if s == "" {
+			continue
+		}
+		y, err := strconv.Atoi(s)
+		if err != nil || y < 1 || y > 9999 {
+			return opts, fmt.Errorf("invalid %s year %q", p.name, s)
+		}
+		*p.year = y
+	}
+	if opts.MinYear != 0 && opts.MaxYear != 0 && opts.MinYear > opts.MaxYear {
+		return opts, fmt.Errorf("from year %d is after to year %d", opts.MinYear, opts.MaxYear)
+	}
+	opts = opts.normalize()
+	opts.Cursor = r.FormValue("cursor")
+	if _, err := decodeCursor(opts); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// query returns the URL query that selects opts, without the cursor.
+func (o ListOptions) query() url.Values {
+	v := url.Values{}
+	if o.Sort != "" && o.Sort != SortByTitle {
+		v.Set("sort", string(o.Sort))
+	}
+	if o.Descending {
+		v.Set("order", "desc")
+	}
+	if o.Author != "" {
+		v.Set("author", o.Author)
+	}
+	if o.CreatedBy != "" {
+		v.Set("createdBy", o.CreatedBy)
+	}
+	if o.MinYear != 0 {
+		v.Set("from", strconv.Itoa(o.MinYear))
+	}
+	if o.MaxYear != 0 {
+		v.Set("to", strconv.Itoa(o.MaxYear))
+	}
+	if o.PageSize != 0 && o.PageSize != defaultPageSize {
+		v.Set("pageSize", strconv.Itoa(o.PageSize))
+	}
+	return v
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// novelField describes a field of Novel that users can change.
+type novelField struct {
+	name   string // name in forms and JSON
+	label  string // empty for fields that are not shown on their own
+	goName string // name of the struct field, which is also its Firestore path
+	column string // SQL column
+}
+
+// novelFields lists the fields of Novel that users can change, in the order
+// the edit form shows them.
+var novelFields = []novelField{
+	{"title", "Title", "Title", "title"},
+	{"author", "Author", "Author", "author"},
+	{"publishedDate", "Date published", "PublishedDate", "published_date"},
+	{"isbn10", "ISBN-10", "ISBN10", "isbn10"},
+	{"isbn13", "ISBN-13", "ISBN13", "isbn13"},
+	{"publisher", "Publisher", "Publisher", "publisher"},
+	{"pageCount", "Pages", "PageCount", "page_count"},
+	{"language", "Language", "Language", "language"},
+	{"series", "Series", "Series", "series"},
+	{"volume", "Volume", "Volume", "volume"},
+	{"genres", "Genres", "Genres", "genres"},
+	{"description", "Description", "Description", "description"},
+	{"imageURL", "Cover image", "ImageURL", "image_url"},
+	{"thumbnailURL", "", "ThumbnailURL", "thumbnail_url"},
+}
+
+// lookupNovelField returns the changeable field with the given name.
+func lookupNovelField(name string) (novelField, bool) {
+	for _, f := range novelFields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return novelField{}, false
+}
+
+// value returns field f of n.
+func (f novelField) value(n *Novel) reflect.Value {
+	return reflect.ValueOf(n).Elem().FieldByName(f.goName)
+}
+
+// typ returns the type of field f.
+func (f novelField) typ() reflect.Type {
+	return f.value(&Novel{}).Type()
+}
+
+// formValue returns field f of n as it is entered in the edit form.
+func (f novelField) formValue(n *Novel) string {
+	switch v := f.value(n).Interface().(type) {
+	case string:
+		return v
+	case PartialDate:
+		return string(v)
+	case int:
+		if v == 0 {
+			return ""
+		}
+		return strconv.Itoa(v)
+	case []string:
+		return strings.Join(v, ", ")
+	}
+	panic(fmt.Sprintf("novel field %s has unexpected type %T", f.name, f.value(n).Interface()))
+}
+
+// parseFormValue parses s, entered as in the edit form, as a value of field
+// f. It is the inverse of formValue.
+func (f novelField) parseFormValue(s string) (interface{}, error) {
+	switch f.value(&Novel{}).Interface().(type) {
+	case string:
+		return s, nil
+	case PartialDate:
+		return PartialDate(s), nil
+	case int:
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return 0, nil
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, errors.New("must be a whole number")
+		}
+		return v, nil
+	case []string:
+		return splitGenres(s), nil
+	}
+	panic(fmt.Sprintf("novel field %s has unexpected type %v", f.name, f.typ()))
+}
+
+// NovelPatch changes some of the fields of a novel, leaving the others as
+// they are stored.
+type NovelPatch struct {
+	// Version, if not zero, is the version the novel must still be at for
+	// the patch to apply; see UpdateNovel.
+	Version int
+	// Fields maps the names of the fields to change, as in JSON, to their
+	// new values. Each value has the type of the Novel field.
+	Fields map[string]interface{}
+}
+
+// newNovelPatch returns a patch that sets the named fields to their values
+// in n.
+func newNovelPatch(n *Novel, version int, names ...string) NovelPatch {
+	p := NovelPatch{Version: version, Fields: make(map[string]interface{})}
+	for _, name := range names {
+		f, ok := lookupNovelField(name)
+		if !ok {
+			panic(fmt.Sprintf("novel field %q cannot be changed", name))
+		}
+		p.Fields[name] = f.value(n).Interface()
+	}
+	return p
+}
+
+// check reports an error if p names a field that cannot be changed or has
+// a value of the wrong type.
+func (p NovelPatch) check() error {
+	for name, v := range p.Fields {
+		f, ok := lookupNovelField(name)
+		if !ok {
+			return fmt.Errorf("novel field %q cannot be changed", name)
+		}
+		if want := f.typ(); reflect.TypeOf(v) != want {
+			return fmt.Errorf("novel field %q must be a %v, not %T", name, want, v)
+		}
+	}
+	return nil
+}
+
+// names returns the names of the fields p changes, sorted.
+func (p NovelPatch) names() []string {
+	names := make([]string, 0, len(p.Fields))
+	for name := range p.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apply sets the fields of n that p changes. p must have passed check.
+func (p NovelPatch) apply(n *Novel) {
+	for name, v := range p.Fields {
+		f, _ := lookupNovelField(name)
+		f.value(n).Set(reflect.ValueOf(v))
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IkezawaYuki/go-novel-shelf/internal/search"
+	"log"
+	"sync"
+	"time"
+)
+
+const maxSearchResults = 100
+
+// NovelSearcher is implemented by databases that support full-text search.
+type NovelSearcher interface {
+	SearchNovels(ctx context.Context, q string) ([]*Novel, error)
+}
+
+// searchDB wraps a NovelDatabase with a full-text index over the title,
+// author and description of every novel. The index is built from the
+// wrapped database when searchDB is created and is updated at once by the
+// writes that go through it. Writes made elsewhere, by commands or other
+// instances of the app, are picked up by refresh, which compares the
+// versions of the stored novels with those indexed. A refresh reads every
+// novel, so it only runs periodically when Config.SearchRefresh is set.
+type searchDB struct {
+	NovelDatabase
+	index *search.Index
+
+	mu      sync.Mutex
+	indexed map[string]indexedNovel // by novel ID
+}
+
+// indexedNovel records which version of a novel is in the index.
+type indexedNovel struct {
+	version int
+	at      time.Time
+}
+
+var _ NovelDatabase = &searchDB{}
+var _ NovelSearcher = &searchDB{}
+
+func newSearchDB(ctx context.Context, db NovelDatabase) (*searchDB, error) {
+	s := &searchDB{NovelDatabase: db, index: search.New(), indexed: make(map[string]indexedNovel)}
+	if _, err := s.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("searchdb: could not build index: %v", err)
+	}
+	return s, nil
+}
+
+func (s *searchDB) indexNovel(n *Novel) {
+	s.index.Add(n.ID,
+		search.Field{Text: n.Title, Weight: 3},
+		search.Field{Text: n.Author, Weight: 2},
+		search.Field{Text: n.Description, Weight: 1},
+	)
+	s.mu.Lock()
+	s.indexed[n.ID] = indexedNovel{version: n.Version, at: time.Now()}
+	s.mu.Unlock()
+}
+
+func (s *searchDB) unindexNovel(id string) {
+	s.index.Remove(id)
+	s.mu.Lock()
+	delete(s.indexed, id)
+	s.mu.Unlock()
+}
+
+// refresh brings the index up to date with the wrapped database: novels
+// added, or at a version other than the one indexed, are indexed again,
+// and novels no longer listed are removed. It returns how many novels
+// changed in the index.
+func (s *searchDB) refresh(ctx context.Context) (int, error) {
+	start := time.Now()
+	novels, err := s.NovelDatabase.ListNovels(ctx)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	listed := make(map[string]bool, len(novels))
+	for _, n := range novels {
+		listed[n.ID] = true
+		s.mu.Lock()
+		in, ok := s.indexed[n.ID]
+		s.mu.Unlock()
+		if !ok || in.version != n.Version {
+			s.indexNovel(n)
+			changed++
+		}
+	}
+	// Novels indexed since the list was read may be missing from it.
+	var gone []string
+	s.mu.Lock()
+	for id, in := range s.indexed {
+		if !listed[id] && in.at.Before(start) {
+			gone = append(gone, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range gone {
+		s.unindexNovel(id)
+	}
+	return changed + len(gone), nil
+}
+
+// refreshPeriodically refreshes the index every interval until ctx is
+// done.
+func (s *searchDB) refreshPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.refresh(ctx); err != nil {
+			log.Printf("searchdb: could not refresh index: %v", err)
+		}
+	}
+}
+
+func (s *searchDB) AddNovel(ctx context.Context, n *Novel) (id string, err error) {
+	id, err = s.NovelDatabase.AddNovel(ctx, n)
+	if err != nil {
+		return "", err
+	}
+	n.ID = id
+	s.indexNovel(n)
+	return id, nil
+}
+
+func (s *searchDB) AddNovels(ctx context.Context, novels []*Novel) ([]string, error) {
+	ids, err := s.NovelDatabase.AddNovels(ctx, novels)
+	for _, n := range novels[:len(ids)] {
+		s.indexNovel(n)
+	}
+	return ids, err
+}
+
+func (s *searchDB) PutNovels(ctx context.Context, novels []*Novel) error {
+	if err := s.NovelDatabase.PutNovels(ctx, novels); err != nil {
+		return err
+	}
+	for _, n := range novels {
+		if n.DeletedAt != nil {
+			s.unindexNovel(n.ID)
+		} else {
+			s.indexNovel(n)
+		}
+	}
+	return nil
+}
+
+func (s *searchDB) UpdateNovel(ctx context.Context, n *Novel) error {
+	if err := s.NovelDatabase.UpdateNovel(ctx, n); err != nil {
+		return err
+	}
+	s.indexNovel(n)
+	return nil
+}
+
+func (s *searchDB) PatchNovel(ctx context.Context, id string, p NovelPatch) (*Novel, error) {
+	n, err := s.NovelDatabase.PatchNovel(ctx, id, p)
+	if err != nil {
+		return nil, err
+	}
+	s.indexNovel(n)
+	return n, nil
+}
+
+func (s *searchDB) DeleteNovel(ctx context.Context, id string) error {
+	if err := s.NovelDatabase.DeleteNovel(ctx, id); err != nil {
+		return err
+	}
+	s.unindexNovel(id)
+	return nil
+}
+
+func (s *searchDB) RestoreNovel(ctx context.Context, id string) (*Novel, error) {
+	n, err := s.NovelDatabase.RestoreNovel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.indexNovel(n)
+	return n, nil
+}
+
+// SearchNovels returns the novels matching q, most relevant first. Novels
+// deleted since they were indexed, such as by another instance, are left
+// out and dropped from the index.
+func (s *searchDB) SearchNovels(ctx context.Context, q string) ([]*Novel, error) {
+	results := s.index.Search(q)
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+	novels := make([]*Novel, 0, len(results))
+	for _, r := range results {
+		n, err := s.GetNovel(ctx, r.ID)
+		if errors.Is(err, ErrNotFound) {
+			s.unindexNovel(r.ID)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("searchdb: could not load result %q: %v", r.ID, err)
+		}
+		novels = append(novels, n)
+	}
+	return novels, nil
+}
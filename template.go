@@ -2,14 +2,23 @@ package main
 
 import (
 	"fmt"
+	"github.com/gorilla/csrf"
 	"html/template"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
 )
 
+// templateFuncs are available to all templates. Their definitions here are
+// placeholders; appTemplate.Execute binds them to the request.
+var templateFuncs = template.FuncMap{
+	// csrfField returns the hidden input carrying the CSRF token. Every
+	// form that POSTs must include it.
+	"csrfField": func() template.HTML { return "" },
+}
+
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	tmpl := template.Must(template.New("base.html").Funcs(templateFuncs).ParseFiles("templates/base.html"))
 	path := filepath.Join("templates", filename)
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -20,17 +29,26 @@ func parseTemplate(filename string) *appTemplate {
 }
 
 type appTemplate struct {
-	t *template.Template
+	t *template.Template // never executed itself, so that it can be cloned
 }
 
 func (tmpl *appTemplate) Execute(n *Novelshelf, w http.ResponseWriter, r *http.Request, data interface{}) *appError {
 	d := struct {
 		Data interface{}
+		User *User // signed-in user, or nil
 	}{
 		Data: data,
+		User: userFromContext(r.Context()),
 	}
 
-	if err := tmpl.t.Execute(w, d); err != nil {
+	t, err := tmpl.t.Clone()
+	if err != nil {
+		return n.appErrorf(r, err, "could not clone template: %v", err)
+	}
+	t.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML { return csrf.TemplateField(r) },
+	})
+	if err := t.Execute(w, d); err != nil {
 		return n.appErrorf(r, err, "could not write template: %v", err)
 	}
 	return nil
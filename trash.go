@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultTrashRetention is how long deleted novels stay in the trash
+// before they are purged, unless configured otherwise.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is how often the server purges the trash.
+const trashPurgeInterval = time.Hour
+
+// trashData is passed to trash.html.
+type trashData struct {
+	Novels    []*Novel
+	Retention time.Duration // 0 if novels stay in the trash until purged
+}
+
+// PurgeAt returns when novel is purged from the trash automatically.
+func (d trashData) PurgeAt(novel *Novel) time.Time {
+	return novel.DeletedAt.Add(d.Retention)
+}
+
+// trashHandler lists the trashed novels the user may restore: their own,
+// or every novel for admins.
+func (n *Novelshelf) trashHandler(w http.ResponseWriter, r *http.Request) *appError {
+	trash, err := n.DB.ListTrash(r.Context())
+	if err != nil {
+		return n.appErrorf(r, err, "could not list trash: %v", err)
+	}
+	u := userFromContext(r.Context())
+	d := trashData{Retention: n.trashRetention}
+	for _, novel := range trash {
+		if u.CanEdit(novel) {
+			d.Novels = append(d.Novels, novel)
+		}
+	}
+	return trashTmpl.Execute(n, w, r, d)
+}
+
+// trashedNovel returns the trashed novel named in r, provided the user may
+// change it.
+func (n *Novelshelf) trashedNovel(r *http.Request) (*Novel, *appError) {
+	novel, err := n.DB.GetTrashedNovel(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return nil, n.appErrorf(r, err, "could not find novel in the trash: %v", err)
+	}
+	if err := authorize(r, novel); err != nil {
+		return nil, n.appErrorf(r, err, "you may only restore or purge novels from your own shelf")
+	}
+	return novel, nil
+}
+
+// trashRestoreHandler takes a novel out of the trash.
+func (n *Novelshelf) trashRestoreHandler(w http.ResponseWriter, r *http.Request) *appError {
+	novel, appErr := n.trashedNovel(r)
+	if appErr != nil {
+		return appErr
+	}
+	if _, err := n.DB.RestoreNovel(r.Context(), novel.ID); err != nil {
+		return n.appErrorf(r, err, "could not restore novel: %v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/novels/%s", novel.ID), http.StatusFound)
+	return nil
+}
+
+// trashPurgeHandler deletes a novel in the trash, and its covers, for good.
+func (n *Novelshelf) trashPurgeHandler(w http.ResponseWriter, r *http.Request) *appError {
+	novel, appErr := n.trashedNovel(r)
+	if appErr != nil {
+		return appErr
+	}
+	if err := n.DB.PurgeNovel(r.Context(), novel.ID); err != nil {
+		return n.appErrorf(r, err, "could not purge novel: %v", err)
+	}
+	n.releaseCovers(r.Context(), novel, nil)
+	http.Redirect(w, r, "/trash", http.StatusFound)
+	return nil
+}
+
+// purgeTrash deletes the novels that were moved to the trash more than
+// olderThan ago, along with their covers. With dryRun it only reports
+// them. It returns the novels purged.
+func (n *Novelshelf) purgeTrash(ctx context.Context, olderThan time.Duration, dryRun bool) ([]*Novel, error) {
+	trash, err := n.DB.ListTrash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("trash: could not list trash: %v", err)
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var purged []*Novel
+	for _, novel := range trash {
+		if novel.DeletedAt.After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := n.DB.PurgeNovel(ctx, novel.ID); err != nil {
+				return purged, fmt.Errorf("trash: could not purge novel %q: %v", novel.ID, err)
+			}
+			n.releaseCovers(ctx, novel, nil)
+		}
+		purged = append(purged, novel)
+	}
+	return purged, nil
+}
+
+// purgeTrashPeriodically purges the novels older than n.trashRetention
+// from the trash every interval until ctx is done. It does nothing if
+// the retention is 0.
+func (n *Novelshelf) purgeTrashPeriodically(ctx context.Context, interval time.Duration) {
+	if n.trashRetention == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := n.purgeTrash(ctx, n.trashRetention, false)
+		if err != nil {
+			log.Print(err)
+		}
+		if len(purged) > 0 {
+			log.Printf("Purged %d novels from the trash", len(purged))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrashCommand implements "novelshelf purgetrash", which deletes old
+// novels from the trash.
+func (n *Novelshelf) purgeTrashCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("purgetrash", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "only list the novels that would be purged")
+	olderThan := fs.Duration("older-than", n.trashRetention, "only purge novels deleted longer ago than this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("purgetrash: unexpected arguments %q", fs.Args())
+	}
+	set := false
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == "older-than" })
+	if n.trashRetention == 0 && !set {
+		return fmt.Errorf("purgetrash: the trash retention is disabled; pass -older-than")
+	}
+
+	purged, err := n.purgeTrash(ctx, *olderThan, *dryRun)
+	verb := "purged"
+	if *dryRun {
+		verb = "would purge"
+	}
+	for _, novel := range purged {
+		fmt.Fprintf(out, "%s %s %q\n", verb, novel.ID, novel.Title)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d novels deleted more than %v ago\n", len(purged), *olderThan)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	n.DB = testDBs["memory"]
+	ctx := context.Background()
+	resp, err := wt.PostForm("/novels", url.Values{"title": {"彼岸過迄"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	novelPath := resp.Request.URL.Path
+	id := strings.TrimPrefix(novelPath, "/novels/")
+	defer n.DB.PurgeNovel(ctx, id)
+	defer n.DB.DeleteNovel(ctx, id)
+
+	bodyContains(t, wt, novelPath, "Move to trash")
+	resp, err = wt.Post(novelPath+":delete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp, _ := doRequest(t, wt.Client, "GET", novelPath); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("trashed novel: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	bodyContains(t, wt, "/trash", "彼岸過迄")
+
+	// Other editors neither see nor restore the novel; viewers have no
+	// trash.
+	_, other := addTestUser(t, "trash-editor@example.com", RoleEditor)
+	if _, body := doRequest(t, other, "GET", "/trash"); strings.Contains(body, "彼岸過迄") {
+		t.Errorf("other editor: trash lists a novel from another shelf")
+	}
+	if resp, _ := doRequest(t, other, "POST", "/trash/"+id+":restore"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other editor: got status %d for a restore, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	_, viewer := addTestUser(t, "trash-viewer@example.com", RoleViewer)
+	if resp, _ := doRequest(t, viewer, "GET", "/trash"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer: got status %d for the trash, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	resp, err = wt.Post("/trash/"+id+":restore", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != novelPath {
+		t.Errorf("restore: got status %d at %s, want %d at %s", resp.StatusCode, resp.Request.URL.Path, http.StatusOK, novelPath)
+	}
+	bodyContains(t, wt, novelPath+"/history", "restored from the trash")
+
+	resp, err = wt.Post(novelPath+":delete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = wt.Post("/trash/"+id+":purge", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/trash" {
+		t.Errorf("purge: got redirected to %s, want /trash", resp.Request.URL.Path)
+	}
+	if _, err := n.DB.GetTrashedNovel(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTrashedNovel after purge: got err %v, want ErrNotFound", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	n.DB = testDBs["memory"]
+	ctx := context.Background()
+	id, err := n.DB.AddNovel(ctx, &Novel{Title: "明暗"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DB.DeleteNovel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	defer n.DB.PurgeNovel(ctx, id)
+	contains := func(novels []*Novel) bool {
+		for _, novel := range novels {
+			if novel.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	if purged, err := n.purgeTrash(ctx, time.Hour, false); err != nil || contains(purged) {
+		t.Errorf("purgeTrash(1h): got %v, %v, want the novel kept", purged, err)
+	}
+	if purged, err := n.purgeTrash(ctx, 0, true); err != nil || !contains(purged) {
+		t.Errorf("purgeTrash(0, dry run): got %v, %v, want the novel listed", purged, err)
+	}
+	if _, err := n.DB.GetTrashedNovel(ctx, id); err != nil {
+		t.Errorf("GetTrashedNovel after dry run: %v", err)
+	}
+
+	// The command purges novels past the configured retention unless told
+	// otherwise, and must be told if there is none.
+	var out bytes.Buffer
+	if err := n.purgeTrashCommand(ctx, nil, &out); err != nil || strings.Contains(out.String(), "purged "+id) {
+		t.Errorf("purgetrash: got output %q, %v, want the novel kept", out.String(), err)
+	}
+	retention := n.trashRetention
+	n.trashRetention = 0
+	err = n.purgeTrashCommand(ctx, nil, &out)
+	n.trashRetention = retention
+	if err == nil {
+		t.Error("purgetrash without a retention or -older-than: want error")
+	}
+	if err := n.purgeTrashCommand(ctx, []string{"-older-than", "0s"}, &out); err != nil {
+		t.Fatalf("purgetrash: %v", err)
+	}
+	if !strings.Contains(out.String(), "purged "+id) {
+		t.Errorf("purgetrash: got output %q, want novel %q purged", out.String(), id)
+	}
+	if _, err := n.DB.GetTrashedNovel(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTrashedNovel after purge: got err %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrUserNotFound is returned by UserDatabase implementations when the
+// requested user does not exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserExists is returned by UserDatabase.AddUser when a user with the
+// same email address or identity already exists.
+var ErrUserExists = errors.New("user already exists")
+
+// Role is what a user may do. Each role may do everything the roles
+// before it may.
+type Role string
+
+const (
+	// RoleViewer may browse the shelf, like someone who is not signed in.
+	RoleViewer Role = "viewer"
+	// RoleEditor may also add novels and change those on their own shelf.
+	RoleEditor Role = "editor"
+	// RoleAdmin may also change every novel, manage users and use the
+	// diagnostic endpoints.
+	RoleAdmin Role = "admin"
+)
+
+// roles lists the roles from least to most privileged.
+var roles = []Role{RoleViewer, RoleEditor, RoleAdmin}
+
+// rank orders roles by privilege; unknown roles rank below all others.
+func (r Role) rank() int {
+	for i, role := range roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// parseRole returns the role named s.
+func parseRole(s string) (Role, error) {
+	if r := Role(s); r.rank() > 0 {
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q", s)
+}
+
+// User is an account that can sign in to Novelshelf, either with a
+// password or through an identity provider.
+type User struct {
+	ID    string `json:"id"`
+	Email string `json:"email"` // lower case, unique
+	Name  string `json:"name"`
+
+	// PasswordHash is the bcrypt hash of the user's password, or empty if
+	// the user can only sign in through an identity provider.
+	PasswordHash string `json:"-"`
+
+	// Provider and Subject identify the user at the identity provider they
+	// signed up through, e.g. an OIDC issuer URL and its "sub" claim. Both
+	// are empty for password accounts.
+	Provider string `json:"-"`
+	Subject  string `json:"-"`
+
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HasRole reports whether u may do what role may. A nil u, for someone who
+// is not signed in, has no role.
+func (u *User) HasRole(role Role) bool {
+	return u != nil && u.Role.rank() >= role.rank()
+}
+
+// IsAdmin reports whether u has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.HasRole(RoleAdmin)
+}
+
+// CanEdit reports whether u may change or delete novel: admins may change
+// any novel, editors only those on their own shelf. Novels added before
+// shelves had owners can only be changed by admins.
+func (u *User) CanEdit(novel *Novel) bool {
+	if u.IsAdmin() {
+		return true
+	}
+	return u.HasRole(RoleEditor) && novel.CreatedBy != "" && novel.CreatedBy == u.ID
+}
+
+// UserDatabase stores user accounts. The databases that implement
+// NovelDatabase implement it too, keeping users next to the shelf.
+type UserDatabase interface {
+	GetUser(ctx context.Context, id string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	// GetUserByIdentity returns the user with the given subject at
+	// provider.
+	GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	// AddUser assigns u an ID and stores it. It returns ErrUserExists if
+	// the email address or identity is taken.
+	AddUser(ctx context.Context, u *User) (id string, err error)
+	UpdateUser(ctx context.Context, u *User) error
+	// ListUsers returns all users, ordered by email address.
+	ListUsers(ctx context.Context) ([]*User, error)
+}
+
+// usersOf returns the UserDatabase that shares storage with db, if any.
+func usersOf(db NovelDatabase) (UserDatabase, bool) {
+	u, ok := unwrapDB(db).(UserDatabase)
+	return u, ok
+}
+
+// normalizeEmail returns the form email addresses are stored and looked up
+// in.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// sameIdentity reports whether a and b were signed up through the same
+// identity at the same provider.
+func sameIdentity(a, b *User) bool {
+	return a.Subject != "" && a.Provider == b.Provider && a.Subject == b.Subject
+}
+
+// commandInput is where commands read input such as passwords from.
+var commandInput io.Reader = os.Stdin
+
+// adduserCommand implements "novelshelf adduser", which creates a password
+// account. The password is read from the first line of standard input.
+func (n *Novelshelf) adduserCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("adduser", flag.ContinueOnError)
+	fs.SetOutput(out)
+	email := fs.String("email", "", "email address to sign in with (required)")
+	name := fs.String("name", "", "display name")
+	role := fs.String("role", string(RoleEditor), "role of the user: viewer, editor or admin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !strings.Contains(*email, "@") || fs.NArg() > 0 {
+		fs.Usage()
+		return errors.New("adduser: -email is required")
+	}
+	r, err := parseRole(*role)
+	if err != nil {
+		return fmt.Errorf("adduser: %v", err)
+	}
+
+	fmt.Fprintf(out, "Password for %s: ", *email)
+	password, err := bufio.NewReader(commandInput).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("adduser: could not read password: %v", err)
+	}
+	fmt.Fprintln(out)
+	hash, err := hashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return fmt.Errorf("adduser: %v", err)
+	}
+	u := &User{Email: *email, Name: *name, PasswordHash: hash, Role: r}
+	if _, err := n.Users.AddUser(ctx, u); err != nil {
+		return fmt.Errorf("adduser: %w", err)
+	}
+	fmt.Fprintf(out, "Added %s %s (%s)\n", u.Role, u.Email, u.ID)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/language"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLen       = 200
+	maxAuthorLen      = 100
+	maxDescriptionLen = 5000
+	maxURLLen         = 2048
+	maxPublisherLen   = 200
+	maxSeriesLen      = 200
+	maxGenreLen       = 50
+	maxGenres         = 20
+	maxPageCount      = 100000
+)
+
+// ValidationErrors maps form field names to a message describing what is
+// wrong with the submitted value.
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	fields := make([]string, 0, len(v))
+	for f := range v {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f, v[f]))
+	}
+	return "invalid novel: " + strings.Join(msgs, "; ")
+}
+
+// validateNovel checks n for missing or malformed fields, trimming
+// surrounding space and normalizing PublishedDate, ISBNs, Language and
+// Genres as it goes. It returns nil if n is valid.
+func validateNovel(n *Novel) ValidationErrors {
+	errs := ValidationErrors{}
+
+	n.Title = strings.TrimSpace(n.Title)
+	n.Author = strings.TrimSpace(n.Author)
+	n.PublishedDate = PartialDate(strings.TrimSpace(string(n.PublishedDate)))
+	n.ImageURL = strings.TrimSpace(n.ImageURL)
+	n.ThumbnailURL = strings.TrimSpace(n.ThumbnailURL)
+	n.Description = strings.TrimSpace(n.Description)
+	n.Publisher = strings.TrimSpace(n.Publisher)
+	n.Language = strings.TrimSpace(n.Language)
+	n.Series = strings.TrimSpace(n.Series)
+
+	switch {
+	case n.Title == "":
+		errs["title"] = "is required"
+	case utf8.RuneCountInString(n.Title) > maxTitleLen:
+		errs["title"] = fmt.Sprintf("must be at most %d characters", maxTitleLen)
+	}
+	checkLen(errs, "author", n.Author, maxAuthorLen)
+	checkLen(errs, "description", n.Description, maxDescriptionLen)
+	checkLen(errs, "publisher", n.Publisher, maxPublisherLen)
+	checkLen(errs, "series", n.Series, maxSeriesLen)
+
+	if d, err := ParsePartialDate(string(n.PublishedDate)); err != nil {
+		errs["publishedDate"] = err.Error()
+	} else {
+		n.PublishedDate = d
+	}
+	if n.ImageURL != "" {
+		if err := validateImageURL(n.ImageURL); err != nil {
+			errs["imageURL"] = err.Error()
+		}
+	}
+	if n.ThumbnailURL != "" {
+		if err := validateImageURL(n.ThumbnailURL); err != nil {
+			errs["thumbnailURL"] = err.Error()
+		}
+	}
+
+	isbn10, isbn13, isbnErrs := normalizeISBNs(n.ISBN10, n.ISBN13)
+	n.ISBN10, n.ISBN13 = isbn10, isbn13
+	for f, msg := range isbnErrs {
+		errs[f] = msg
+	}
+
+	if n.PageCount < 0 || n.PageCount > maxPageCount {
+		errs["pageCount"] = fmt.Sprintf("must be between 0 and %d", maxPageCount)
+	}
+	if n.Volume < 0 {
+		errs["volume"] = "must not be negative"
+	}
+	if n.Language != "" {
+		tag, err := language.Parse(n.Language)
+		if err != nil {
+			errs["language"] = "must be a language code such as ja or en"
+		} else {
+			n.Language = tag.String()
+		}
+	}
+
+	genres := make([]string, 0, len(n.Genres))
+	seen := make(map[string]bool)
+	for _, g := range n.Genres {
+		g = strings.TrimSpace(g)
+		if g == "" || seen[g] {
+			continue
+		}
+		seen[g] = true
+		if utf8.RuneCountInString(g) > maxGenreLen {
+			errs["genres"] = fmt.Sprintf("must each be at most %d characters", maxGenreLen)
+		}
+		genres = append(genres, g)
+	}
+	if len(genres) > maxGenres {
+		errs["genres"] = fmt.Sprintf("must be at most %d tags", maxGenres)
+	}
+	n.Genres = nil
+	if len(genres) > 0 {
+		n.Genres = genres
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func checkLen(errs ValidationErrors, field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		errs[field] = fmt.Sprintf("must be at most %d characters", max)
+	}
+}
+
+// formInt parses the optional integer form field name, recording an error
+// in errs if it is not a number.
+func formInt(r *http.Request, name string, errs ValidationErrors) int {
+	s := strings.TrimSpace(r.FormValue(name))
+	if s == "" {
+		return 0
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		errs[name] = "must be a whole number"
+		return 0
+	}
+	return v
+}
+
+// splitGenres splits a comma-separated list of genre tags. Japanese commas
+// are accepted as separators too.
+func splitGenres(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '、' || r == '，'
+	})
+}
+
+// validateImageURL accepts absolute http and https URLs, and paths served
+// by the local image store.
+func validateImageURL(s string) error {
+	if len(s) > maxURLLen {
+		return fmt.Errorf("must be at most %d characters", maxURLLen)
+	}
+	if strings.HasPrefix(s, localImagesPath) && !strings.Contains(s, "..") {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	return nil
+}
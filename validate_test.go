@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateNovel(t *testing.T) {
+	n := &Novel{Title: "  吾輩は猫である ", PublishedDate: "1905/1"}
+	if errs := validateNovel(n); errs != nil {
+		t.Fatalf("validateNovel: got %v, want nil", errs)
+	}
+	if got, want := n.Title, "吾輩は猫である"; got != want {
+		t.Errorf("Title = %q, want %q", got, want)
+	}
+	if got, want := n.PublishedDate, PartialDate("1905-01"); got != want {
+		t.Errorf("PublishedDate = %q, want %q", got, want)
+	}
+
+	n = &Novel{Title: "こころ", ISBN10: "4-10-101013-7", Language: "JA", Genres: []string{" 小説", "", "小説", "純文学"}}
+	if errs := validateNovel(n); errs != nil {
+		t.Fatalf("validateNovel: got %v, want nil", errs)
+	}
+	if got, want := n.ISBN13, "9784101010137"; got != want {
+		t.Errorf("ISBN13 = %q, want %q", got, want)
+	}
+	if got, want := n.Language, "ja"; got != want {
+		t.Errorf("Language = %q, want %q", got, want)
+	}
+	if got, want := n.GenreList(), "小説, 純文学"; got != want {
+		t.Errorf("GenreList() = %q, want %q", got, want)
+	}
+
+	n = &Novel{
+		Author:        strings.Repeat("a", maxAuthorLen+1),
+		PublishedDate: "someday",
+		ImageURL:      "javascript:alert(1)",
+		ISBN13:        "9784101010138",
+		PageCount:     -1,
+		Language:      "not a language",
+	}
+	errs := validateNovel(n)
+	for _, field := range []string{"title", "author", "publishedDate", "imageURL", "isbn13", "pageCount", "language"} {
+		if _, ok := errs[field]; !ok {
+			t.Errorf("validateNovel: want error for %s, got %v", field, errs)
+		}
+	}
+	if _, ok := errs["description"]; ok {
+		t.Errorf("validateNovel: unexpected error for description: %v", errs)
+	}
+}